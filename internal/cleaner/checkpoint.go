@@ -0,0 +1,286 @@
+package cleaner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leijianzhong001/redis_agent/task"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	checkpointFilePrefix = "clean-"
+	checkpointFileSuffix = ".json"
+)
+
+// checkpointStore 为空时不保存检查点
+var checkpointStore *CheckpointStore
+
+// NodeCheckpoint 一个节点的清理进度
+type NodeCheckpoint struct {
+	// 下一次scan的游标
+	Cursor uint64 `json:"cursor,string"`
+	// 已经执行过unlink的key数量
+	UnlinkedKeys uint64 `json:"unlinkedKeys"`
+	// 已经扫描到但是还没有执行unlink的key, 游标已经越过了它们, 恢复时需要先删除
+	PendingKeys []string `json:"pendingKeys"`
+	// 是否已经遍历完成, 完成的节点恢复时只删除PendingKeys, 不再从游标0重新遍历
+	Done bool `json:"done"`
+}
+
+// CleanCheckpoint 清理任务的检查点
+type CleanCheckpoint struct {
+	TaskId int `json:"taskId"`
+	// 创建任务时的参数, 恢复时使用相同的参数重新创建任务
+	TaskParam map[string]string `json:"taskParam"`
+	// 节点地址 => 进度
+	Nodes     map[string]*NodeCheckpoint `json:"nodes"`
+	UpdatedAt time.Time                  `json:"updatedAt"`
+}
+
+// CheckpointStore 以json文件的形式把检查点保存在本地目录中, 每个任务一个文件
+type CheckpointStore struct {
+	dir      string
+	interval time.Duration
+}
+
+// InitCheckpointStore 初始化检查点目录, interval为保存检查点的最小间隔
+func InitCheckpointStore(dir string, interval time.Duration) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return errors.Wrapf(err, "create checkpoint dir %s fail", dir)
+	}
+	checkpointStore = &CheckpointStore{dir: dir, interval: interval}
+	return nil
+}
+
+func (store *CheckpointStore) path(taskId int) string {
+	return filepath.Join(store.dir, checkpointFilePrefix+strconv.Itoa(taskId)+checkpointFileSuffix)
+}
+
+// Save 先写临时文件再重命名, 防止进程退出时留下不完整的检查点
+func (store *CheckpointStore) Save(checkpoint *CleanCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmpPath := store.path(checkpoint.TaskId) + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, store.path(checkpoint.TaskId))
+}
+
+// Load 读取任务的检查点, 不存在时返回nil
+func (store *CheckpointStore) Load(taskId int) (*CleanCheckpoint, error) {
+	data, err := ioutil.ReadFile(store.path(taskId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var checkpoint CleanCheckpoint
+	if err = json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, errors.Wrapf(err, "decode checkpoint of task %d fail", taskId)
+	}
+	return &checkpoint, nil
+}
+
+// Remove 任务完成之后删除检查点
+func (store *CheckpointStore) Remove(taskId int) error {
+	if err := os.Remove(store.path(taskId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List 所有检查点, 按照任务id排序
+func (store *CheckpointStore) List() ([]*CleanCheckpoint, error) {
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+	checkpoints := make([]*CleanCheckpoint, 0, len(files))
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, checkpointFilePrefix) || !strings.HasSuffix(name, checkpointFileSuffix) {
+			continue
+		}
+		taskId, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, checkpointFilePrefix), checkpointFileSuffix))
+		if err != nil {
+			continue
+		}
+		checkpoint, err := store.Load(taskId)
+		if err != nil {
+			log.Warnf("skip broken checkpoint %s: %v", name, err)
+			continue
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i].TaskId < checkpoints[j].TaskId })
+	return checkpoints, nil
+}
+
+// checkpointer 在清理过程中按照间隔保存一个任务的检查点, 集群模式下会被多个节点的goroutine并发调用
+// 为nil时所有方法都不做任何事情
+type checkpointer struct {
+	store      *CheckpointStore
+	lock       sync.Mutex
+	checkpoint *CleanCheckpoint
+	// 创建时间, 节点第一次保存之前作为上一次保存的时间
+	created time.Time
+	// 节点地址 => 上一次保存该节点进度的时间
+	lastSave map[string]time.Time
+}
+
+// newCheckpointer 没有配置检查点目录或者dryRun时返回nil
+// 从检查点恢复时沿用原有节点的进度, 这样还没有开始扫描的节点在再次中断后也不会从头开始
+func newCheckpointer(taskInfo *task.GenericTaskInfo, cleanTaskParam *task.CleanTaskParam, resume *CleanCheckpoint) *checkpointer {
+	if checkpointStore == nil || cleanTaskParam.DryRun {
+		return nil
+	}
+	taskParam := make(map[string]string, len(taskInfo.TaskParam))
+	for name, value := range taskInfo.TaskParam {
+		taskParam[name] = value
+	}
+	nodes := make(map[string]*NodeCheckpoint)
+	if resume != nil {
+		for addr, node := range resume.Nodes {
+			nodes[addr] = node
+		}
+	}
+	return &checkpointer{
+		store: checkpointStore,
+		checkpoint: &CleanCheckpoint{
+			TaskId:    taskInfo.TaskId,
+			TaskParam: taskParam,
+			Nodes:     nodes,
+		},
+		created:  time.Now(),
+		lastSave: make(map[string]time.Time),
+	}
+}
+
+// update 距离节点上一次保存超过间隔时记录节点最新的进度并保存检查点
+// 没有超过间隔时检查点中保留该节点上一次保存的进度, 游标和未删除的key仍然是一致的
+func (c *checkpointer) update(progress *NodeCleanProgress, keyGroupBySlot map[int][]string) {
+	if c == nil {
+		return
+	}
+	// update只在scan之后调用, 此时游标为0说明节点已经遍历完成, 完成时立即保存, 避免恢复时重新遍历
+	done := progress.Done || progress.Cursor == 0
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	lastSave, ok := c.lastSave[progress.Addr]
+	if !ok {
+		lastSave = c.created
+	}
+	if !done && time.Since(lastSave) < c.store.interval {
+		return
+	}
+
+	pendingKeys := make([]string, 0)
+	for _, keys := range keyGroupBySlot {
+		pendingKeys = append(pendingKeys, keys...)
+	}
+	c.checkpoint.Nodes[progress.Addr] = &NodeCheckpoint{
+		Cursor:       progress.Cursor,
+		UnlinkedKeys: progress.UnlinkedKeys,
+		PendingKeys:  pendingKeys,
+		Done:         done,
+	}
+	c.checkpoint.UpdatedAt = time.Now()
+	if err := c.store.Save(c.checkpoint); err != nil {
+		log.Errorf("save checkpoint of task %d error: %v", c.checkpoint.TaskId, err)
+		return
+	}
+	c.lastSave[progress.Addr] = time.Now()
+}
+
+// finish 任务完成之后删除检查点, 失败的任务保留检查点用于恢复
+func (c *checkpointer) finish() {
+	if c == nil {
+		return
+	}
+	if err := c.store.Remove(c.checkpoint.TaskId); err != nil {
+		log.Errorf("remove checkpoint of task %d error: %v", c.checkpoint.TaskId, err)
+	}
+}
+
+// CheckCheckpoint 同一个任务id还有检查点时拒绝创建不是恢复的任务, 防止新任务覆盖未完成任务的检查点
+func CheckCheckpoint(taskId int, cleanTaskParam *task.CleanTaskParam) error {
+	if checkpointStore == nil || cleanTaskParam.Resume {
+		return nil
+	}
+	checkpoint, err := checkpointStore.Load(taskId)
+	if err != nil {
+		return err
+	}
+	if checkpoint != nil {
+		return errors.Errorf("task %d has an unfinished checkpoint, resume it or use another task id", taskId)
+	}
+	return nil
+}
+
+// loadResumeCheckpoint 任务是从检查点恢复时返回检查点
+func loadResumeCheckpoint(taskInfo *task.GenericTaskInfo, cleanTaskParam *task.CleanTaskParam) (*CleanCheckpoint, error) {
+	if checkpointStore == nil || !cleanTaskParam.Resume {
+		return nil, nil
+	}
+	return checkpointStore.Load(taskInfo.TaskId)
+}
+
+// ResumeTaskInfo 根据检查点构造恢复任务, 单节点模式的 cursor 参数为检查点中的游标
+func ResumeTaskInfo(taskId int) (*task.GenericTaskInfo, error) {
+	if checkpointStore == nil {
+		return nil, errors.New("checkpoint store is not configured")
+	}
+	checkpoint, err := checkpointStore.Load(taskId)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint == nil {
+		return nil, errors.Errorf("no checkpoint found for task %d", taskId)
+	}
+	return resumeTaskInfo(checkpoint), nil
+}
+
+func resumeTaskInfo(checkpoint *CleanCheckpoint) *task.GenericTaskInfo {
+	taskParam := make(map[string]string, len(checkpoint.TaskParam)+1)
+	for name, value := range checkpoint.TaskParam {
+		taskParam[name] = value
+	}
+	taskParam["resume"] = "true"
+	if len(checkpoint.Nodes) == 1 {
+		for _, node := range checkpoint.Nodes {
+			taskParam["cursor"] = fmt.Sprint(node.Cursor)
+		}
+	}
+	return &task.GenericTaskInfo{TaskId: checkpoint.TaskId, TaskType: task.CLEAN, TaskParam: taskParam}
+}
+
+// ResumableTasks 所有有检查点的清理任务, 用于启动时自动恢复
+func ResumableTasks() ([]*task.GenericTaskInfo, error) {
+	if checkpointStore == nil {
+		return nil, nil
+	}
+	checkpoints, err := checkpointStore.List()
+	if err != nil {
+		return nil, err
+	}
+	taskInfos := make([]*task.GenericTaskInfo, 0, len(checkpoints))
+	for _, checkpoint := range checkpoints {
+		taskInfos = append(taskInfos, resumeTaskInfo(checkpoint))
+	}
+	return taskInfos, nil
+}
@@ -0,0 +1,174 @@
+package cleaner
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/leijianzhong001/redis_agent/task"
+)
+
+func TestCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &CheckpointStore{dir: dir}
+
+	if cp, err := store.Load(1); cp != nil || err != nil {
+		t.Fatalf("Load() of missing checkpoint = %v, %v", cp, err)
+	}
+	for _, taskId := range []int{12, 3} {
+		cp := &CleanCheckpoint{
+			TaskId:    taskId,
+			TaskParam: map[string]string{"userName": "user1"},
+			Nodes:     map[string]*NodeCheckpoint{"127.0.0.1:6379": {Cursor: 1 << 63, UnlinkedKeys: 5, PendingKeys: []string{"user1:a"}}},
+		}
+		if err = store.Save(cp); err != nil {
+			t.Fatalf("Save() error: %v", err)
+		}
+	}
+	ioutil.WriteFile(dir+"/other.json", []byte("{}"), 0644)
+
+	cp, err := store.Load(12)
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	node := cp.Nodes["127.0.0.1:6379"]
+	if node.Cursor != 1<<63 || node.UnlinkedKeys != 5 || len(node.PendingKeys) != 1 {
+		t.Errorf("node = %+v", node)
+	}
+
+	checkpoints, err := store.List()
+	if err != nil || len(checkpoints) != 2 || checkpoints[0].TaskId != 3 || checkpoints[1].TaskId != 12 {
+		t.Fatalf("List() = %v, %v", checkpoints, err)
+	}
+	if err = store.Remove(12); err != nil {
+		t.Fatalf("Remove() error: %v", err)
+	}
+	if err = store.Remove(12); err != nil {
+		t.Errorf("Remove() of missing checkpoint error: %v", err)
+	}
+	if checkpoints, _ = store.List(); len(checkpoints) != 1 {
+		t.Errorf("List() after Remove() = %v", checkpoints)
+	}
+}
+
+func TestCheckpointerInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpointStore = &CheckpointStore{dir: dir, interval: time.Hour}
+	defer func() { checkpointStore = nil }()
+
+	taskInfo := &task.GenericTaskInfo{TaskId: 7, TaskParam: map[string]string{"userName": "user1"}}
+	if newCheckpointer(taskInfo, &task.CleanTaskParam{DryRun: true}, nil) != nil {
+		t.Fatalf("dryRun task should not save checkpoints")
+	}
+	c := newCheckpointer(taskInfo, &task.CleanTaskParam{}, nil)
+	progress := &NodeCleanProgress{Addr: "127.0.0.1:6379", Cursor: 10}
+	c.update(progress, map[int][]string{1: {"user1:a"}})
+	if cp, _ := checkpointStore.Load(7); cp != nil {
+		t.Fatalf("checkpoint saved before interval elapsed")
+	}
+
+	c.created = time.Now().Add(-2 * time.Hour)
+	progress.Cursor = 20
+	c.update(progress, map[int][]string{1: {"user1:a"}, 2: {"user1:b"}})
+	cp, err := checkpointStore.Load(7)
+	if err != nil || cp == nil {
+		t.Fatalf("Load() = %v, %v", cp, err)
+	}
+	if node := cp.Nodes[progress.Addr]; node.Cursor != 20 || len(node.PendingKeys) != 2 || node.Done {
+		t.Errorf("node = %+v", node)
+	}
+
+	// 间隔之内的进度不会写入检查点, 检查点中保留上一次保存时一致的游标和未删除的key
+	progress.Cursor = 30
+	c.update(progress, map[int][]string{4: {"user1:d"}})
+	if cp, _ = checkpointStore.Load(7); cp.Nodes[progress.Addr].Cursor != 20 || len(cp.Nodes[progress.Addr].PendingKeys) != 2 {
+		t.Errorf("node within interval = %+v", cp.Nodes[progress.Addr])
+	}
+
+	// 遍历完成的节点不受间隔限制立即保存
+	progress.Cursor = 0
+	c.update(progress, map[int][]string{3: {"user1:c"}})
+	if cp, _ = checkpointStore.Load(7); cp == nil || !cp.Nodes[progress.Addr].Done || len(cp.Nodes[progress.Addr].PendingKeys) != 1 {
+		t.Fatalf("finished node should be saved with done, checkpoint = %+v", cp)
+	}
+
+	c.finish()
+	if cp, _ = checkpointStore.Load(7); cp != nil {
+		t.Errorf("checkpoint should be removed after finish")
+	}
+	// nil的checkpointer不做任何事情
+	var none *checkpointer
+	none.update(progress, nil)
+	none.finish()
+}
+
+func TestCheckCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpointStore = &CheckpointStore{dir: dir, interval: time.Hour}
+	defer func() { checkpointStore = nil }()
+
+	checkpoint := &CleanCheckpoint{TaskId: 5, Nodes: map[string]*NodeCheckpoint{"127.0.0.1:6379": {Cursor: 10}}}
+	if err = checkpointStore.Save(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	// 同一个任务id的新任务, 包括dryRun, 都不能覆盖未完成任务的检查点
+	for _, param := range []task.CleanTaskParam{{}, {DryRun: true}} {
+		if err = CheckCheckpoint(5, &param); err == nil {
+			t.Errorf("CheckCheckpoint(%+v) should fail when checkpoint exists", param)
+		}
+	}
+	if err = CheckCheckpoint(5, &task.CleanTaskParam{Resume: true}); err != nil {
+		t.Errorf("CheckCheckpoint() of resume task error: %v", err)
+	}
+	if err = CheckCheckpoint(6, &task.CleanTaskParam{}); err != nil {
+		t.Errorf("CheckCheckpoint() of another task error: %v", err)
+	}
+
+	taskInfo := &task.GenericTaskInfo{TaskId: 5}
+	if resume, err := loadResumeCheckpoint(taskInfo, &task.CleanTaskParam{DryRun: true}); resume != nil || err != nil {
+		t.Errorf("loadResumeCheckpoint() of new task = %v, %v", resume, err)
+	}
+	resume, err := loadResumeCheckpoint(taskInfo, &task.CleanTaskParam{Resume: true})
+	if err != nil || resume == nil || resume.Nodes["127.0.0.1:6379"].Cursor != 10 {
+		t.Errorf("loadResumeCheckpoint() of resume task = %v, %v", resume, err)
+	}
+}
+
+func TestResumeTaskInfo(t *testing.T) {
+	cp := &CleanCheckpoint{
+		TaskId:    9,
+		TaskParam: map[string]string{"userName": "user1", "cursor": "0"},
+		Nodes:     map[string]*NodeCheckpoint{"127.0.0.1:6379": {Cursor: 42}},
+	}
+	taskInfo := resumeTaskInfo(cp)
+	param, err := taskInfo.CleanTaskParam()
+	if err != nil {
+		t.Fatalf("CleanTaskParam() error: %v", err)
+	}
+	if taskInfo.TaskId != 9 || taskInfo.TaskType != task.CLEAN || !param.Resume || param.Cursor != 42 || param.UserName != "user1" {
+		t.Errorf("taskInfo = %+v, param = %+v", taskInfo, param)
+	}
+	if cp.TaskParam["resume"] != "" {
+		t.Errorf("checkpoint param should not be modified")
+	}
+
+	// 集群模式每个节点的游标从检查点中读取, cursor参数保持不变
+	cp.TaskParam["cluster"] = "true"
+	cp.Nodes["127.0.0.1:6380"] = &NodeCheckpoint{Cursor: 7}
+	if taskInfo = resumeTaskInfo(cp); taskInfo.TaskParam["cursor"] != "0" {
+		t.Errorf("cluster cursor = %s", taskInfo.TaskParam["cursor"])
+	}
+}
@@ -2,6 +2,7 @@ package cleaner
 
 import (
 	"context"
+	"github.com/go-redis/redis/v8"
 	"github.com/leijianzhong001/redis_agent/internal/utils"
 	"github.com/leijianzhong001/redis_agent/task"
 	log "github.com/sirupsen/logrus"
@@ -16,8 +17,50 @@ var batchCount = 2000
 // 批次浮动值 每次操作的值大于batchCount-batchFloat就可以执行
 var batchFloat = 500
 
+// 所有slot中还没有删除的key数量的上限, 达到上限时删除所有slot中的key
+// key分散在大量slot中时每个slot都达不到batchCount, 不限制的话未删除的key以及检查点会随着key的数量增长
+var maxPendingKeys = 10000
+
 type SystemDataCleaner struct{}
 
+// NodeCleanProgress 一个节点上的清理进度, 单节点模式下保存在 GenericTaskInfo.TaskResult 中
+type NodeCleanProgress struct {
+	// 节点地址
+	Addr string `json:"addr"`
+	// 当前游标
+	Cursor uint64 `json:"cursor,string"`
+	// 已经执行过unlink的key数量
+	UnlinkedKeys uint64 `json:"unlinkedKeys"`
+	// 匹配 userName:* 但是不满足过滤条件而被跳过的key数量
+	SkippedKeys uint64 `json:"skippedKeys"`
+	// 是否已经遍历完成
+	Done bool `json:"done"`
+	// 清理失败的原因
+	Error string `json:"error,omitempty"`
+	// dryRun时当前节点的预览结果
+	DryRun *DryRunResult `json:"dryRun,omitempty"`
+	// 因为实例负载过高而退避的次数
+	ThrottledTimes uint64 `json:"throttledTimes"`
+	// 最近一次退避的原因
+	ThrottleReason string `json:"throttleReason,omitempty"`
+}
+
+// snapshot 复制一份进度, 清理过程中progress只由所属节点的goroutine修改, 查询任务看到的是最近一次发布的副本
+func (progress *NodeCleanProgress) snapshot() *NodeCleanProgress {
+	copied := *progress
+	if progress.DryRun != nil {
+		copied.DryRun = progress.DryRun.clone()
+	}
+	return &copied
+}
+
+// ClusterCleanResult 集群模式下每个主节点的清理进度, 保存在 GenericTaskInfo.TaskResult 中
+type ClusterCleanResult struct {
+	Nodes map[string]*NodeCleanProgress `json:"nodes"`
+	// dryRun时所有节点合并之后的预览结果
+	DryRun *DryRunResult `json:"dryRun,omitempty"`
+}
+
 func (cleaner *SystemDataCleaner) ExecuteClean(taskInfo *task.GenericTaskInfo) error {
 	return cleaner.Clean(taskInfo)
 }
@@ -32,25 +75,276 @@ func (cleaner *SystemDataCleaner) Clean(taskInfo *task.GenericTaskInfo) error {
 		return err
 	}
 
-	cursor := cleanTaskParam.Cursor
-	// 要清理数据的用户空间
-	userName := cleanTaskParam.UserName
+	filter, err := newKeyFilter(cleanTaskParam)
+	if err != nil {
+		log.Error("parse clean filter occurred error", err)
+		return err
+	}
+
+	resume, err := loadResumeCheckpoint(taskInfo, cleanTaskParam)
+	if err != nil {
+		log.Error("load checkpoint occurred error", err)
+		return err
+	}
+	cp := newCheckpointer(taskInfo, cleanTaskParam, resume)
+	limiter := newRateLimiter(cleanTaskParam.MaxOpsPerSec, cleanTaskParam.MaxKeysPerSec)
+
+	if cleanTaskParam.Cluster {
+		return cleaner.cleanCluster(taskInfo, cleanTaskParam, filter, resume, cp, limiter)
+	}
+
 	// 获得redis客户端
 	client := utils.GetRedisClient()
+	progress := &NodeCleanProgress{Addr: client.Options().Addr, Cursor: cleanTaskParam.Cursor}
+	// dryRun时只统计将要删除的key, 不执行unlink
+	if cleanTaskParam.DryRun {
+		progress.DryRun = newDryRunResult()
+	}
+	// 发布最新的进度
+	publish := func() {
+		snapshot := progress.snapshot()
+		taskInfo.UpdateResult(func() {
+			taskInfo.LastScanTime = time.Now()
+			cleanTaskParam.Cursor = snapshot.Cursor
+			taskInfo.TaskResult = snapshot
+		})
+	}
+	publish()
+	var pendingKeys []string
+	if resume != nil {
+		// 单节点模式的检查点只有一个节点, 游标已经通过cursor参数传入
+		for _, node := range resume.Nodes {
+			progress.UnlinkedKeys = node.UnlinkedKeys
+			progress.Done = node.Done
+			pendingKeys = node.PendingKeys
+		}
+		log.Infof("task %d resume from cursor %d, done: %v, pending keys: %d", taskInfo.TaskId, progress.Cursor, progress.Done, len(pendingKeys))
+	}
+
+	throttle := newThrottler(client, limiter, taskThresholds(cleanTaskParam), progress)
+	err = cleanNode(client, filter, progress, pendingKeys, throttle, func(keyGroupBySlot map[int][]string) {
+		publish()
+		cp.update(progress, keyGroupBySlot)
+	})
+	if err != nil {
+		progress.Error = err.Error()
+	}
+	publish()
+	if err != nil {
+		return err
+	}
+	cp.finish()
+
+	if progress.DryRun != nil {
+		log.Infof("task %d dry run done, matched keys: %d, estimated freed bytes: %d", taskInfo.TaskId, progress.DryRun.MatchedKeys, progress.DryRun.EstimatedFreedBytes)
+		return nil
+	}
+	log.Infof("task %d scan and unlink done", taskInfo.TaskId)
+	return nil
+}
+
+// cleanCluster 在集群的每个主节点上并发执行scan和unlink, 每个节点使用自己的游标
+func (cleaner *SystemDataCleaner) cleanCluster(taskInfo *task.GenericTaskInfo, cleanTaskParam *task.CleanTaskParam, filter *keyFilter, resume *CleanCheckpoint, cp *checkpointer, limiter *rateLimiter) error {
+	// result只在UpdateResult中修改
+	result := &ClusterCleanResult{Nodes: make(map[string]*NodeCleanProgress)}
+	taskInfo.UpdateResult(func() {
+		taskInfo.TaskResult = result
+	})
+
+	clusterClient := utils.GetRedisClusterClient()
+	if resume != nil {
+		// 故障转移之后主节点可能已经改变, 所以先通过集群客户端删除所有节点上未删除的key, 再按照节点恢复游标
+		if err := unlinkPendingKeys(clusterClient, resume); err != nil {
+			log.Error("unlink pending keys occurred error", err)
+			return err
+		}
+	}
+
+	thresholds := taskThresholds(cleanTaskParam)
+	err := clusterClient.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		progress := &NodeCleanProgress{Addr: client.Options().Addr}
+		if cleanTaskParam.DryRun {
+			progress.DryRun = newDryRunResult()
+		}
+		if resume != nil {
+			if node, ok := resume.Nodes[progress.Addr]; ok {
+				progress.Cursor = node.Cursor
+				progress.UnlinkedKeys = node.UnlinkedKeys
+				progress.Done = node.Done
+			}
+		}
+		// 发布当前节点最新的进度
+		publish := func() {
+			snapshot := progress.snapshot()
+			taskInfo.UpdateResult(func() {
+				taskInfo.LastScanTime = time.Now()
+				result.Nodes[snapshot.Addr] = snapshot
+			})
+		}
+		publish()
+		if progress.Done {
+			// 未删除的key已经通过unlinkPendingKeys删除
+			log.Infof("task %d skip node %s, it is already done", taskInfo.TaskId, progress.Addr)
+			return nil
+		}
+
+		log.Infof("task %d start clean on node %s from cursor %d", taskInfo.TaskId, progress.Addr, progress.Cursor)
+		throttle := newThrottler(client, limiter, thresholds, progress)
+		err := cleanNode(client, filter, progress, nil, throttle, func(keyGroupBySlot map[int][]string) {
+			publish()
+			cp.update(progress, keyGroupBySlot)
+		})
+		if err != nil {
+			progress.Error = err.Error()
+		}
+		publish()
+		if err != nil {
+			return err
+		}
+		log.Infof("task %d clean on node %s done", taskInfo.TaskId, progress.Addr)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cp.finish()
+
+	if cleanTaskParam.DryRun {
+		// 所有节点都已经结束, result.Nodes 不会再被修改
+		dryRun := newDryRunResult()
+		for _, progress := range result.Nodes {
+			dryRun.merge(progress.DryRun)
+		}
+		taskInfo.UpdateResult(func() {
+			result.DryRun = dryRun
+		})
+		log.Infof("task %d dry run on %d masters done, matched keys: %d", taskInfo.TaskId, len(result.Nodes), dryRun.MatchedKeys)
+		return nil
+	}
+	log.Infof("task %d scan and unlink on %d masters done", taskInfo.TaskId, len(result.Nodes))
+	return nil
+}
 
+// unlinkPendingKeys 通过集群客户端删除检查点中所有节点上已经扫描到但是还没有删除的key
+func unlinkPendingKeys(clusterClient *redis.ClusterClient, resume *CleanCheckpoint) error {
+	keyGroupBySlot := make(map[int][]string)
+	for _, node := range resume.Nodes {
+		for _, key := range node.PendingKeys {
+			slot := utils.Slot(key)
+			keyGroupBySlot[slot] = append(keyGroupBySlot[slot], key)
+		}
+	}
+	for _, keys := range keyGroupBySlot {
+		if _, err := clusterClient.Unlink(ctx, keys...).Result(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanNode 在一个节点上从progress.Cursor开始遍历用户的key, 对满足过滤条件的key执行unlink
+// pendingKeys为从检查点恢复的未删除的key, progress.Done为true时只删除pendingKeys, 不再遍历
+// 每扫描一批以还没有删除的key调用一次onBatch, 全部删除之后再调用一次
+// 每个命令执行之前都会经过throttle限流
+func cleanNode(client *redis.Client, filter *keyFilter, progress *NodeCleanProgress, pendingKeys []string, throttle *throttler, onBatch func(keyGroupBySlot map[int][]string)) error {
+	cursor := progress.Cursor
 	// 16380/20 = 820
 	keyGroupBySlot := make(map[int][]string, 820)
-	for {
+	for _, key := range pendingKeys {
+		slot := utils.Slot(key)
+		keyGroupBySlot[slot] = append(keyGroupBySlot[slot], key)
+	}
+	// 所有slot中还没有删除的key数量
+	pending := len(pendingKeys)
+	unlink := func(keys []string) error {
+		if err := throttle.wait(1, len(keys)); err != nil {
+			return err
+		}
+		n, err := client.Unlink(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		progress.UnlinkedKeys += uint64(n)
+		pending -= len(keys)
+		return nil
+	}
+	// flush 通过pipeline删除所有slot中还没有删除的key, 每个slot一个unlink命令
+	flush := func() error {
+		slots := 0
+		for _, keys := range keyGroupBySlot {
+			if len(keys) != 0 {
+				slots++
+			}
+		}
+		if slots == 0 {
+			return nil
+		}
+		if err := throttle.wait(slots, pending); err != nil {
+			return err
+		}
+		cmds, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, keys := range keyGroupBySlot {
+				if len(keys) != 0 {
+					pipe.Unlink(ctx, keys...)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			progress.UnlinkedKeys += uint64(cmd.(*redis.IntCmd).Val())
+		}
+		for slot, keys := range keyGroupBySlot {
+			keyGroupBySlot[slot] = keys[0:0]
+		}
+		pending = 0
+		return nil
+	}
+	for !progress.Done {
 		var keys []string
 		var err error
-		taskInfo.LastScanTime = time.Now()
+		if err = throttle.wait(1, 0); err != nil {
+			log.Error("throttle occurred error", err)
+			return err
+		}
 		// 这里的2000只是个建议值，并且添加了match参数之后，返回的key数量时不确定的，但可以肯定小于2000
-		keys, cursor, err = client.Scan(ctx, cursor, userName+":*", 2000).Result()
+		keys, cursor, err = client.Scan(ctx, cursor, filter.match, 2000).Result()
 		if err != nil {
 			log.Error("scan redis occurred error", err)
 			return err
 		}
 
+		scanned := len(keys)
+		keys = filter.matchNames(keys)
+		// 只有名称满足过滤条件的key才需要执行过滤命令
+		if n := filter.commandsPerKey(); n > 0 && len(keys) > 0 {
+			if err = throttle.wait(n*len(keys), 0); err != nil {
+				log.Error("throttle occurred error", err)
+				return err
+			}
+		}
+		if keys, err = filter.filter(client, keys); err != nil {
+			log.Error("filter keys occurred error", err)
+			return err
+		}
+		progress.SkippedKeys += uint64(scanned - len(keys))
+
+		if progress.DryRun != nil {
+			// 每个key执行TYPE和MEMORY USAGE两个命令
+			if err = throttle.wait(2*len(keys), 0); err != nil {
+				log.Error("throttle occurred error", err)
+				return err
+			}
+			if err = progress.DryRun.inspect(client, keys); err != nil {
+				log.Error("inspect keys occurred error", err)
+				return err
+			}
+			// 清空本批key, 跳过下面的分组和unlink
+			keys = nil
+		}
+
 		// 按照slot进行分组, 因为unlink命令后面跟着的key列表必须属于同一个slot
 		for _, key := range keys {
 			// 获得该key的slot
@@ -64,10 +358,10 @@ func (cleaner *SystemDataCleaner) Clean(taskInfo *task.GenericTaskInfo) error {
 
 			// 添加到对应的keySlot中
 			keyGroupBySlot[slot] = append(keyGroupBySlot[slot], key)
+			pending++
 			if len(keyGroupBySlot[slot]) >= batchCount-batchFloat {
 				// 如果当前slot中的key满足一定的数量，则执行一次unlink
-				_, err := client.Unlink(ctx, keyGroupBySlot[slot]...).Result()
-				if err != nil {
+				if err := unlink(keyGroupBySlot[slot]); err != nil {
 					log.Error("unlink keys occurred error", err)
 					return err
 				}
@@ -77,8 +371,16 @@ func (cleaner *SystemDataCleaner) Clean(taskInfo *task.GenericTaskInfo) error {
 			}
 		}
 
+		if pending >= maxPendingKeys {
+			if err = flush(); err != nil {
+				log.Error("flush pending keys occurred error", err)
+				return err
+			}
+		}
+
 		// 记录最新的游标
-		cleanTaskParam.Cursor = cursor
+		progress.Cursor = cursor
+		onBatch(keyGroupBySlot)
 
 		// 一旦游标再次为0，则退出遍历
 		if cursor == 0 {
@@ -86,18 +388,13 @@ func (cleaner *SystemDataCleaner) Clean(taskInfo *task.GenericTaskInfo) error {
 		}
 	}
 
-	for _, keys := range keyGroupBySlot {
-		if len(keys) != 0 {
-			// 如果有slot对应的key还没有删除
-			_, err := client.Unlink(ctx, keys...).Result()
-			if err != nil {
-				log.Error("final unlink keys occurred error", err)
-				return err
-			}
-		}
+	// 如果有slot对应的key还没有删除
+	if err := flush(); err != nil {
+		log.Error("final unlink keys occurred error", err)
+		return err
 	}
-
-	log.Infof("task %d scan and unlink done", taskInfo.TaskId)
+	progress.Done = true
+	onBatch(nil)
 	return nil
 }
 
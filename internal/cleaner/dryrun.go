@@ -0,0 +1,115 @@
+package cleaner
+
+import (
+	"errors"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// dryRun时记录的key名称的数量
+var dryRunSampleSize = 100
+
+// CleanTypeStat 某种数据类型将要删除的key数量和内存
+type CleanTypeStat struct {
+	KeyCount uint64 `json:"keyCount"`
+	Overhead uint64 `json:"overhead"`
+}
+
+// DryRunResult dryRun的预览结果, 保存在节点的清理进度中, 集群模式下还会合并所有节点的结果
+type DryRunResult struct {
+	// 匹配的key数量
+	MatchedKeys uint64 `json:"matchedKeys"`
+	// 预计释放的内存, 为 MEMORY USAGE 的总和
+	EstimatedFreedBytes uint64 `json:"estimatedFreedBytes"`
+	// 按照数据类型统计
+	Types map[string]*CleanTypeStat `json:"types"`
+	// 部分将要删除的key
+	SampleKeys []string `json:"sampleKeys"`
+}
+
+func newDryRunResult() *DryRunResult {
+	return &DryRunResult{Types: make(map[string]*CleanTypeStat), SampleKeys: make([]string, 0, dryRunSampleSize)}
+}
+
+// inspect 使用pipeline得到一批key的类型和内存开销, scan之后被删除的key不计入结果
+func (result *DryRunResult) inspect(client *redis.Client, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	pipe := client.Pipeline()
+	typeCmds := make([]*redis.StatusCmd, len(keys))
+	usageCmds := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		typeCmds[i] = pipe.Type(ctx, key)
+		usageCmds[i] = pipe.MemoryUsage(ctx, key)
+	}
+	var replyError redis.Error
+	if _, err := pipe.Exec(ctx); err != nil && !errors.As(err, &replyError) {
+		return err
+	}
+
+	for i, key := range keys {
+		typeName, err := typeCmds[i].Result()
+		if err != nil || typeName == "none" {
+			continue
+		}
+		usage, err := usageCmds[i].Result()
+		if err != nil {
+			continue
+		}
+		result.add(key, typeName, uint64(usage))
+	}
+	return nil
+}
+
+// add 累加一个将要删除的key, 最多记录dryRunSampleSize个key名称
+func (result *DryRunResult) add(key string, typeName string, usage uint64) {
+	stat, ok := result.Types[typeName]
+	if !ok {
+		stat = &CleanTypeStat{}
+		result.Types[typeName] = stat
+	}
+	stat.KeyCount++
+	stat.Overhead += usage
+	result.MatchedKeys++
+	result.EstimatedFreedBytes += usage
+	if len(result.SampleKeys) < dryRunSampleSize {
+		result.SampleKeys = append(result.SampleKeys, key)
+	}
+}
+
+// clone 复制一份预览结果, 用于在清理过程中发布给查询任务的接口
+func (result *DryRunResult) clone() *DryRunResult {
+	cloned := &DryRunResult{
+		MatchedKeys:         result.MatchedKeys,
+		EstimatedFreedBytes: result.EstimatedFreedBytes,
+		Types:               make(map[string]*CleanTypeStat, len(result.Types)),
+		SampleKeys:          append(make([]string, 0, len(result.SampleKeys)), result.SampleKeys...),
+	}
+	for typeName, stat := range result.Types {
+		copied := *stat
+		cloned.Types[typeName] = &copied
+	}
+	return cloned
+}
+
+// merge 合并其他节点的预览结果
+func (result *DryRunResult) merge(other *DryRunResult) {
+	result.MatchedKeys += other.MatchedKeys
+	result.EstimatedFreedBytes += other.EstimatedFreedBytes
+	for typeName, stat := range other.Types {
+		merged, ok := result.Types[typeName]
+		if !ok {
+			merged = &CleanTypeStat{}
+			result.Types[typeName] = merged
+		}
+		merged.KeyCount += stat.KeyCount
+		merged.Overhead += stat.Overhead
+	}
+	for _, key := range other.SampleKeys {
+		if len(result.SampleKeys) >= dryRunSampleSize {
+			break
+		}
+		result.SampleKeys = append(result.SampleKeys, key)
+	}
+}
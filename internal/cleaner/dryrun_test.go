@@ -0,0 +1,93 @@
+package cleaner
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/leijianzhong001/redis_agent/task"
+)
+
+func TestDryRunResultAdd(t *testing.T) {
+	dryRunSampleSize = 2
+	defer func() { dryRunSampleSize = 100 }()
+
+	result := newDryRunResult()
+	result.add("user1:a", "hash", 100)
+	result.add("user1:b", "string", 10)
+	result.add("user1:c", "hash", 50)
+	if result.MatchedKeys != 3 || result.EstimatedFreedBytes != 160 {
+		t.Errorf("result = %+v", result)
+	}
+	if hash := result.Types["hash"]; hash.KeyCount != 2 || hash.Overhead != 150 {
+		t.Errorf("hash stat = %+v", hash)
+	}
+	if str := result.Types["string"]; str.KeyCount != 1 || str.Overhead != 10 {
+		t.Errorf("string stat = %+v", str)
+	}
+	// 只记录前dryRunSampleSize个key
+	if len(result.SampleKeys) != 2 || result.SampleKeys[0] != "user1:a" || result.SampleKeys[1] != "user1:b" {
+		t.Errorf("sample keys = %v", result.SampleKeys)
+	}
+}
+
+func TestDryRunResultMerge(t *testing.T) {
+	dryRunSampleSize = 3
+	defer func() { dryRunSampleSize = 100 }()
+
+	node1 := newDryRunResult()
+	node1.MatchedKeys, node1.EstimatedFreedBytes = 2, 300
+	node1.Types["hash"] = &CleanTypeStat{KeyCount: 2, Overhead: 300}
+	node1.SampleKeys = []string{"user1:a", "user1:b"}
+	node2 := newDryRunResult()
+	node2.MatchedKeys, node2.EstimatedFreedBytes = 2, 50
+	node2.Types["hash"] = &CleanTypeStat{KeyCount: 1, Overhead: 40}
+	node2.Types["string"] = &CleanTypeStat{KeyCount: 1, Overhead: 10}
+	node2.SampleKeys = []string{"user1:c", "user1:d"}
+
+	merged := newDryRunResult()
+	merged.merge(node1)
+	merged.merge(node2)
+	if merged.MatchedKeys != 4 || merged.EstimatedFreedBytes != 350 {
+		t.Errorf("merged = %+v", merged)
+	}
+	if hash := merged.Types["hash"]; hash.KeyCount != 3 || hash.Overhead != 340 || merged.Types["string"].KeyCount != 1 {
+		t.Errorf("merged types = %+v", merged.Types)
+	}
+	if len(merged.SampleKeys) != 3 {
+		t.Errorf("sample keys = %v", merged.SampleKeys)
+	}
+}
+
+func TestNodeCleanProgressSnapshot(t *testing.T) {
+	progress := &NodeCleanProgress{Addr: "127.0.0.1:6379", DryRun: newDryRunResult()}
+	progress.DryRun.add("user1:a", "hash", 100)
+	snapshot := progress.snapshot()
+	progress.Cursor = 10
+	progress.DryRun.add("user1:b", "hash", 50)
+	if snapshot.Cursor != 0 || snapshot.DryRun.MatchedKeys != 1 || snapshot.DryRun.Types["hash"].KeyCount != 1 || len(snapshot.DryRun.SampleKeys) != 1 {
+		t.Errorf("snapshot changed with progress: %+v %+v", snapshot, snapshot.DryRun)
+	}
+
+	// 发布进度的同时序列化任务信息, 使用 -race 运行时不应该报告数据竞争
+	result := &ClusterCleanResult{Nodes: make(map[string]*NodeCleanProgress)}
+	taskInfo := &task.GenericTaskInfo{TaskType: task.CLEAN, TaskResult: result}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if _, err := json.Marshal(taskInfo); err != nil {
+				t.Errorf("marshal task info error: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		progress.Cursor++
+		progress.DryRun.add("user1:c", "string", 10)
+		snapshot := progress.snapshot()
+		taskInfo.UpdateResult(func() {
+			result.Nodes[snapshot.Addr] = snapshot
+		})
+	}
+	<-done
+}
@@ -0,0 +1,264 @@
+package cleaner
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/leijianzhong001/redis_agent/internal/rdb/types"
+	"github.com/leijianzhong001/redis_agent/internal/reader"
+	"github.com/leijianzhong001/redis_agent/internal/utils"
+	"github.com/leijianzhong001/redis_agent/task"
+)
+
+// 可以用于过滤的数据类型
+var filterTypes = map[string]bool{
+	types.StringType: true,
+	types.ListType:   true,
+	types.SetType:    true,
+	types.ZSetType:   true,
+	types.HashType:   true,
+	types.StreamType: true,
+}
+
+// keyFilter 清理任务的过滤条件, 只删除以 userName: 开头并且满足所有条件的key
+type keyFilter struct {
+	// 用户的key的前缀, 任何过滤条件都不会删除其他用户的key
+	prefix string
+	// SCAN 的 MATCH 参数
+	match          string
+	types          map[string]bool
+	expireMode     string
+	maxTTL         time.Duration
+	minIdleTime    time.Duration
+	minLength      int64
+	minMemoryUsage int64
+	patterns       []string
+	regex          *regexp.Regexp
+}
+
+// ValidateFilter 校验清理任务的过滤条件
+func ValidateFilter(cleanTaskParam *task.CleanTaskParam) error {
+	_, err := newKeyFilter(cleanTaskParam)
+	return err
+}
+
+func newKeyFilter(cleanTaskParam *task.CleanTaskParam) (*keyFilter, error) {
+	filter := &keyFilter{
+		prefix:         cleanTaskParam.UserName + ":",
+		expireMode:     cleanTaskParam.ExpireMode,
+		maxTTL:         time.Duration(cleanTaskParam.MaxTTL) * time.Second,
+		minIdleTime:    time.Duration(cleanTaskParam.MinIdleTime) * time.Second,
+		minLength:      cleanTaskParam.MinLength,
+		minMemoryUsage: cleanTaskParam.MinMemoryUsage,
+	}
+	filter.match = filter.prefix + "*"
+
+	if cleanTaskParam.Types != "" {
+		filter.types = make(map[string]bool)
+		for _, typeName := range strings.Split(cleanTaskParam.Types, ",") {
+			typeName = strings.TrimSpace(typeName)
+			if !filterTypes[typeName] {
+				return nil, fmt.Errorf("unsupported type %s in types", typeName)
+			}
+			filter.types[typeName] = true
+		}
+	}
+
+	switch filter.expireMode {
+	case "", task.CleanExpireVolatile, task.CleanExpirePersistent:
+	default:
+		return nil, fmt.Errorf("expireMode must be %s or %s", task.CleanExpireVolatile, task.CleanExpirePersistent)
+	}
+	if filter.maxTTL < 0 || filter.minIdleTime < 0 || filter.minLength < 0 || filter.minMemoryUsage < 0 {
+		return nil, errors.New("maxTtl, minIdleTime, minLength and minMemoryUsage must not be negative")
+	}
+	if filter.maxTTL > 0 && filter.expireMode == task.CleanExpirePersistent {
+		return nil, errors.New("maxTtl only matches keys with ttl, conflicts with expireMode persistent")
+	}
+
+	if cleanTaskParam.Patterns != "" {
+		for _, pattern := range strings.Split(cleanTaskParam.Patterns, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				filter.patterns = append(filter.patterns, pattern)
+			}
+		}
+		// 只有一个模式并且限定在用户的前缀下时, 直接作为SCAN的MATCH, 减少返回的key
+		if len(filter.patterns) == 1 && strings.HasPrefix(filter.patterns[0], filter.prefix) {
+			filter.match = filter.patterns[0]
+		}
+	}
+	if cleanTaskParam.Regex != "" {
+		regex, err := regexp.Compile(cleanTaskParam.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %v", err)
+		}
+		filter.regex = regex
+	}
+	return filter, nil
+}
+
+// matchName 按照key的名称过滤
+func (filter *keyFilter) matchName(key string) bool {
+	if !strings.HasPrefix(key, filter.prefix) {
+		return false
+	}
+	if filter.regex != nil && !filter.regex.MatchString(key) {
+		return false
+	}
+	if len(filter.patterns) == 0 {
+		return true
+	}
+	for _, pattern := range filter.patterns {
+		if utils.GlobMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandsPerKey 过滤每个key需要执行的命令数, 为0时只按照名称过滤
+func (filter *keyFilter) commandsPerKey() int {
+	n := 0
+	if filter.types != nil || filter.minLength > 0 {
+		// TYPE, 有minLength时还需要一个得到长度的命令
+		n++
+		if filter.minLength > 0 {
+			n++
+		}
+	}
+	if filter.expireMode != "" || filter.maxTTL > 0 {
+		n++
+	}
+	if filter.minIdleTime > 0 {
+		n++
+	}
+	if filter.minMemoryUsage > 0 {
+		n++
+	}
+	return n
+}
+
+// matchTTL 按照PTTL的结果过滤, -1表示没有设置过期时间
+func (filter *keyFilter) matchTTL(pttl time.Duration) bool {
+	switch filter.expireMode {
+	case task.CleanExpireVolatile:
+		if pttl < 0 {
+			return false
+		}
+	case task.CleanExpirePersistent:
+		if pttl >= 0 {
+			return false
+		}
+	}
+	return filter.maxTTL <= 0 || (pttl >= 0 && pttl < filter.maxTTL)
+}
+
+// matchNames 得到一批key中名称满足过滤条件的key, 不需要访问redis
+func (filter *keyFilter) matchNames(keys []string) []string {
+	matched := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if filter.matchName(key) {
+			matched = append(matched, key)
+		}
+	}
+	return matched
+}
+
+// filter 在名称满足过滤条件的key中得到满足其他过滤条件的key, 每个key执行commandsPerKey个命令
+// scan之后被删除的key会被跳过
+func (filter *keyFilter) filter(client *redis.Client, matched []string) ([]string, error) {
+	if len(matched) == 0 || filter.commandsPerKey() == 0 {
+		return matched, nil
+	}
+
+	typeCmds := make([]*redis.StatusCmd, len(matched))
+	pttlCmds := make([]*redis.DurationCmd, len(matched))
+	idleCmds := make([]*redis.DurationCmd, len(matched))
+	usageCmds := make([]*redis.IntCmd, len(matched))
+	pipe := client.Pipeline()
+	for i, key := range matched {
+		if filter.types != nil || filter.minLength > 0 {
+			typeCmds[i] = pipe.Type(ctx, key)
+		}
+		if filter.expireMode != "" || filter.maxTTL > 0 {
+			pttlCmds[i] = pipe.PTTL(ctx, key)
+		}
+		if filter.minIdleTime > 0 {
+			idleCmds[i] = pipe.ObjectIdleTime(ctx, key)
+		}
+		if filter.minMemoryUsage > 0 {
+			usageCmds[i] = pipe.MemoryUsage(ctx, key)
+		}
+	}
+	// 被删除的key会返回redis.Nil, 这类错误逐个命令检查
+	var replyError redis.Error
+	if _, err := pipe.Exec(ctx); err != nil && !errors.As(err, &replyError) {
+		return nil, err
+	}
+
+	selected := make([]string, 0, len(matched))
+	typeNames := make([]string, 0, len(matched))
+	for i, key := range matched {
+		var typeName string
+		if typeCmds[i] != nil {
+			var err error
+			if typeName, err = typeCmds[i].Result(); err != nil || typeName == "none" {
+				continue
+			}
+			if filter.types != nil && !filter.types[typeName] {
+				continue
+			}
+		}
+		if pttlCmds[i] != nil {
+			pttl, err := pttlCmds[i].Result()
+			if err != nil || pttl == -2 || !filter.matchTTL(pttl) {
+				continue
+			}
+		}
+		if idleCmds[i] != nil {
+			idle, err := idleCmds[i].Result()
+			if err != nil {
+				// 淘汰策略为LFU时不记录空闲时间, 此时无法按照空闲时间过滤
+				if errors.As(err, &replyError) && err != redis.Nil {
+					return nil, fmt.Errorf("object idletime error: %v", err)
+				}
+				continue
+			}
+			if idle <= filter.minIdleTime {
+				continue
+			}
+		}
+		if usageCmds[i] != nil {
+			usage, err := usageCmds[i].Result()
+			if err != nil || usage <= filter.minMemoryUsage {
+				continue
+			}
+		}
+		selected = append(selected, key)
+		typeNames = append(typeNames, typeName)
+	}
+	if filter.minLength <= 0 || len(selected) == 0 {
+		return selected, nil
+	}
+
+	// 长度的命令与类型有关, 需要第二次pipeline, 模块类型没有长度, 不会被删除
+	lenPipe := client.Pipeline()
+	lenCmds := make([]*redis.IntCmd, len(selected))
+	for i, key := range selected {
+		lenCmds[i] = reader.LengthCmd(ctx, lenPipe, typeNames[i], key)
+	}
+	if _, err := lenPipe.Exec(ctx); err != nil && !errors.As(err, &replyError) {
+		return nil, err
+	}
+	result := make([]string, 0, len(selected))
+	for i, key := range selected {
+		if lenCmds[i] != nil && lenCmds[i].Val() > filter.minLength {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
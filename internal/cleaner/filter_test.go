@@ -0,0 +1,103 @@
+package cleaner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leijianzhong001/redis_agent/task"
+)
+
+func TestNewKeyFilter(t *testing.T) {
+	invalid := []task.CleanTaskParam{
+		{UserName: "user1", Types: "hash,bitmap"},
+		{UserName: "user1", ExpireMode: "expired"},
+		{UserName: "user1", MinIdleTime: -1},
+		{UserName: "user1", MaxTTL: 60, ExpireMode: task.CleanExpirePersistent},
+		{UserName: "user1", Regex: "user1:("},
+	}
+	for _, param := range invalid {
+		if err := ValidateFilter(&param); err == nil {
+			t.Errorf("ValidateFilter(%+v) should fail", param)
+		}
+	}
+
+	filter, err := newKeyFilter(&task.CleanTaskParam{UserName: "user1"})
+	if err != nil {
+		t.Fatalf("newKeyFilter() error: %v", err)
+	}
+	if filter.match != "user1:*" || filter.commandsPerKey() != 0 {
+		t.Errorf("filter = %+v", filter)
+	}
+
+	// 只有一个限定在用户前缀下的模式时直接作为SCAN的MATCH
+	filter, _ = newKeyFilter(&task.CleanTaskParam{UserName: "user1", Patterns: "user1:cache:*"})
+	if filter.match != "user1:cache:*" {
+		t.Errorf("match = %s", filter.match)
+	}
+	filter, _ = newKeyFilter(&task.CleanTaskParam{UserName: "user1", Patterns: "*:cache:*, user1:tmp:*"})
+	if filter.match != "user1:*" || len(filter.patterns) != 2 {
+		t.Errorf("match = %s, patterns = %v", filter.match, filter.patterns)
+	}
+
+	filter, _ = newKeyFilter(&task.CleanTaskParam{UserName: "user1", Types: "hash", MinLength: 10, ExpireMode: task.CleanExpireVolatile, MinIdleTime: 3600, MinMemoryUsage: 1024})
+	if n := filter.commandsPerKey(); n != 5 {
+		t.Errorf("commandsPerKey() = %d, want 5", n)
+	}
+}
+
+func TestKeyFilterMatchName(t *testing.T) {
+	filter, _ := newKeyFilter(&task.CleanTaskParam{UserName: "user1", Patterns: "*:cache:*,*:tmp:*", Regex: `:\d+$`})
+	cases := map[string]bool{
+		"user1:cache:1":   true,
+		"user1:tmp:22":    true,
+		"user1:cache:x":   false,
+		"user1:order:1":   false,
+		"user2:cache:1":   false,
+		"user10:cache:1":  false,
+		"user1:cache:1:a": false,
+	}
+	keys := make([]string, 0, len(cases))
+	for key, want := range cases {
+		if got := filter.matchName(key); got != want {
+			t.Errorf("matchName(%s) = %v, want %v", key, got, want)
+		}
+		keys = append(keys, key)
+	}
+	// 只保留名称匹配的key, 过滤命令的配额按照它们的数量预订
+	matched := filter.matchNames(keys)
+	if len(matched) != 2 {
+		t.Errorf("matchNames() = %v, want 2 keys", matched)
+	}
+	for _, key := range matched {
+		if !cases[key] {
+			t.Errorf("matchNames() returned unmatched key %s", key)
+		}
+	}
+}
+
+func TestKeyFilterMatchTTL(t *testing.T) {
+	noExpire := time.Duration(-1)
+	cases := []struct {
+		param task.CleanTaskParam
+		pttl  time.Duration
+		want  bool
+	}{
+		{task.CleanTaskParam{}, noExpire, true},
+		{task.CleanTaskParam{ExpireMode: task.CleanExpireVolatile}, noExpire, false},
+		{task.CleanTaskParam{ExpireMode: task.CleanExpireVolatile}, time.Second, true},
+		{task.CleanTaskParam{ExpireMode: task.CleanExpirePersistent}, noExpire, true},
+		{task.CleanTaskParam{ExpireMode: task.CleanExpirePersistent}, time.Second, false},
+		{task.CleanTaskParam{MaxTTL: 60}, noExpire, false},
+		{task.CleanTaskParam{MaxTTL: 60}, 59 * time.Second, true},
+		{task.CleanTaskParam{MaxTTL: 60}, time.Minute, false},
+	}
+	for _, c := range cases {
+		filter, err := newKeyFilter(&c.param)
+		if err != nil {
+			t.Fatalf("newKeyFilter(%+v) error: %v", c.param, err)
+		}
+		if got := filter.matchTTL(c.pttl); got != c.want {
+			t.Errorf("%+v matchTTL(%v) = %v, want %v", c.param, c.pttl, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package cleaner
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/leijianzhong001/redis_agent/internal/config"
+	"github.com/leijianzhong001/redis_agent/internal/utils"
+	"github.com/leijianzhong001/redis_agent/task"
+	log "github.com/sirupsen/logrus"
+)
+
+// 退避时间的初始值, 之后每次翻倍
+var minBackoff = 100 * time.Millisecond
+
+// pacer 按照固定速率分配配额, 每分配n个单位, 下一次可用的时间向后推迟 n/limit 秒
+type pacer struct {
+	limit int
+	next  time.Time
+}
+
+// reserve 预订n个单位的配额, 返回需要等待的时间
+func (p *pacer) reserve(now time.Time, n int) time.Duration {
+	if p.limit <= 0 || n <= 0 {
+		return 0
+	}
+	if p.next.Before(now) {
+		p.next = now
+	}
+	wait := p.next.Sub(now)
+	p.next = p.next.Add(time.Duration(float64(time.Second) * float64(n) / float64(p.limit)))
+	return wait
+}
+
+// rateLimiter 限制一个任务每秒执行的命令数和删除的key数, 集群模式下所有节点共享
+type rateLimiter struct {
+	lock sync.Mutex
+	ops  pacer
+	keys pacer
+}
+
+func newRateLimiter(maxOpsPerSec, maxKeysPerSec int) *rateLimiter {
+	return &rateLimiter{ops: pacer{limit: maxOpsPerSec}, keys: pacer{limit: maxKeysPerSec}}
+}
+
+// reserve 预订ops个命令和keys个key的配额, 返回需要等待的时间
+func (l *rateLimiter) reserve(ops, keys int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	opsWait := l.ops.reserve(now, ops)
+	keysWait := l.keys.reserve(now, keys)
+	if opsWait > keysWait {
+		return opsWait
+	}
+	return keysWait
+}
+
+// instanceThresholds 实例负载的阈值, 值为0的阈值不检查
+type instanceThresholds struct {
+	maxInstanceOps     int64
+	maxLatency         time.Duration
+	maxLazyfreePending int64
+	checkInterval      time.Duration
+	maxBackoff         time.Duration
+	// 持续退避的总时间超过该值时任务失败
+	backoffTimeout time.Duration
+}
+
+// taskThresholds 配置文件中的阈值, 任务参数中大于0的阈值覆盖配置文件
+func taskThresholds(cleanTaskParam *task.CleanTaskParam) instanceThresholds {
+	throttle := config.Agent.Clean.Throttle
+	thresholds := instanceThresholds{
+		maxInstanceOps:     throttle.MaxInstanceOps,
+		maxLatency:         time.Duration(throttle.MaxLatency) * time.Millisecond,
+		maxLazyfreePending: throttle.MaxLazyfreePending,
+		checkInterval:      time.Duration(throttle.CheckInterval) * time.Millisecond,
+		maxBackoff:         time.Duration(throttle.MaxBackoff) * time.Millisecond,
+		backoffTimeout:     time.Duration(throttle.BackoffTimeout) * time.Second,
+	}
+	if cleanTaskParam.MaxInstanceOps > 0 {
+		thresholds.maxInstanceOps = cleanTaskParam.MaxInstanceOps
+	}
+	if cleanTaskParam.MaxLatency > 0 {
+		thresholds.maxLatency = time.Duration(cleanTaskParam.MaxLatency) * time.Millisecond
+	}
+	if cleanTaskParam.MaxLazyfreePending > 0 {
+		thresholds.maxLazyfreePending = cleanTaskParam.MaxLazyfreePending
+	}
+	return thresholds
+}
+
+// enabled 是否有需要检查的阈值, 没有时不检查实例负载
+func (thresholds instanceThresholds) enabled() bool {
+	return thresholds.maxInstanceOps > 0 || thresholds.maxLatency > 0 || thresholds.maxLazyfreePending > 0
+}
+
+// exceeded 返回超出的阈值, 没有超出时返回空字符串
+func (thresholds instanceThresholds) exceeded(latency time.Duration, instanceOps, lazyfreePending int64) string {
+	if thresholds.maxLatency > 0 && latency > thresholds.maxLatency {
+		return fmt.Sprintf("latency %v exceeds %v", latency, thresholds.maxLatency)
+	}
+	if thresholds.maxInstanceOps > 0 && instanceOps > thresholds.maxInstanceOps {
+		return fmt.Sprintf("instantaneous_ops_per_sec %d exceeds %d", instanceOps, thresholds.maxInstanceOps)
+	}
+	if thresholds.maxLazyfreePending > 0 && lazyfreePending > thresholds.maxLazyfreePending {
+		return fmt.Sprintf("lazyfree_pending_objects %d exceeds %d", lazyfreePending, thresholds.maxLazyfreePending)
+	}
+	return ""
+}
+
+// nextBackoff 退避时间从minBackoff开始每次翻倍, 不超过maxBackoff
+func (thresholds instanceThresholds) nextBackoff(backoff time.Duration) time.Duration {
+	if backoff < minBackoff {
+		backoff = minBackoff
+	} else {
+		backoff *= 2
+	}
+	if thresholds.maxBackoff > 0 && backoff > thresholds.maxBackoff {
+		backoff = thresholds.maxBackoff
+	}
+	return backoff
+}
+
+// throttler 一个节点上的限流, 先按照任务的速率限制等待, 再按照间隔检查实例负载, 负载过高时退避直到恢复
+type throttler struct {
+	client     *redis.Client
+	limiter    *rateLimiter
+	thresholds instanceThresholds
+	progress   *NodeCleanProgress
+	lastCheck  time.Time
+}
+
+func newThrottler(client *redis.Client, limiter *rateLimiter, thresholds instanceThresholds, progress *NodeCleanProgress) *throttler {
+	return &throttler{client: client, limiter: limiter, thresholds: thresholds, progress: progress}
+}
+
+// wait 执行ops个命令, 删除keys个key之前调用
+func (t *throttler) wait(ops, keys int) error {
+	if delay := t.limiter.reserve(ops, keys); delay > 0 {
+		time.Sleep(delay)
+	}
+	if !t.thresholds.enabled() || time.Since(t.lastCheck) < t.thresholds.checkInterval {
+		return nil
+	}
+
+	var backoff, total time.Duration
+	for {
+		reason, err := t.overloaded()
+		if err != nil {
+			return err
+		}
+		if reason == "" {
+			break
+		}
+		// 实例的负载一直降不下来时任务失败, 而不是一直处于执行中的状态
+		if t.thresholds.backoffTimeout > 0 && total >= t.thresholds.backoffTimeout {
+			return fmt.Errorf("node %s is still overloaded after backing off %v: %s", t.progress.Addr, total, reason)
+		}
+		backoff = t.thresholds.nextBackoff(backoff)
+		total += backoff
+		t.progress.ThrottledTimes++
+		t.progress.ThrottleReason = reason
+		log.Warnf("node %s is overloaded: %s, back off %v", t.progress.Addr, reason, backoff)
+		time.Sleep(backoff)
+	}
+	t.lastCheck = time.Now()
+	return nil
+}
+
+// overloaded 以PING的往返时间作为延迟, 结合INFO中的负载指标判断实例是否负载过高
+func (t *throttler) overloaded() (string, error) {
+	start := time.Now()
+	if err := t.client.Ping(ctx).Err(); err != nil {
+		return "", err
+	}
+	latency := time.Since(start)
+
+	var instanceOps, lazyfreePending int64
+	if t.thresholds.maxInstanceOps > 0 {
+		infoStats, err := t.client.Info(ctx, "stats").Result()
+		if err != nil {
+			return "", err
+		}
+		instanceOps, _ = strconv.ParseInt(utils.ParseInfoProp(infoStats, "instantaneous_ops_per_sec"), 10, 64)
+	}
+	if t.thresholds.maxLazyfreePending > 0 {
+		infoMemory, err := t.client.Info(ctx, "memory").Result()
+		if err != nil {
+			return "", err
+		}
+		lazyfreePending, _ = strconv.ParseInt(utils.ParseInfoProp(infoMemory, "lazyfree_pending_objects"), 10, 64)
+	}
+	return t.thresholds.exceeded(latency, instanceOps, lazyfreePending), nil
+}
@@ -0,0 +1,165 @@
+package cleaner
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/leijianzhong001/redis_agent/internal/config"
+	"github.com/leijianzhong001/redis_agent/task"
+)
+
+func TestPacer(t *testing.T) {
+	now := time.Now()
+	p := &pacer{limit: 100}
+	if wait := p.reserve(now, 50); wait != 0 {
+		t.Errorf("first reserve wait = %v, want 0", wait)
+	}
+	// 前50个单位占用了500ms
+	if wait := p.reserve(now, 1); wait != 500*time.Millisecond {
+		t.Errorf("second reserve wait = %v, want 500ms", wait)
+	}
+	// 空闲之后不会累积配额
+	if wait := p.reserve(now.Add(2*time.Second), 10); wait != 0 {
+		t.Errorf("reserve after idle wait = %v, want 0", wait)
+	}
+
+	unlimited := &pacer{}
+	unlimited.reserve(now, 1000)
+	if wait := unlimited.reserve(now, 1000); wait != 0 {
+		t.Errorf("unlimited reserve wait = %v, want 0", wait)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(10, 1000)
+	limiter.reserve(1, 500)
+	// 命令数的配额还剩余, 但是key数的配额需要等待500ms
+	if wait := limiter.reserve(1, 0); wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("ops wait = %v", wait)
+	}
+	if wait := limiter.reserve(0, 1); wait < 400*time.Millisecond {
+		t.Errorf("keys wait = %v", wait)
+	}
+}
+
+func TestInstanceThresholds(t *testing.T) {
+	thresholds := instanceThresholds{
+		maxInstanceOps:     1000,
+		maxLatency:         50 * time.Millisecond,
+		maxLazyfreePending: 100,
+		maxBackoff:         time.Second,
+	}
+	if reason := thresholds.exceeded(time.Millisecond, 1000, 100); reason != "" {
+		t.Errorf("exceeded() = %q, want empty", reason)
+	}
+	if reason := thresholds.exceeded(60*time.Millisecond, 0, 0); !strings.Contains(reason, "latency") {
+		t.Errorf("exceeded() = %q, want latency", reason)
+	}
+	if reason := thresholds.exceeded(0, 1001, 0); !strings.Contains(reason, "instantaneous_ops_per_sec") {
+		t.Errorf("exceeded() = %q, want instantaneous_ops_per_sec", reason)
+	}
+	if reason := thresholds.exceeded(0, 0, 101); !strings.Contains(reason, "lazyfree_pending_objects") {
+		t.Errorf("exceeded() = %q, want lazyfree_pending_objects", reason)
+	}
+	if reason := (instanceThresholds{}).exceeded(time.Hour, 1<<40, 1<<40); reason != "" {
+		t.Errorf("zero thresholds exceeded() = %q, want empty", reason)
+	}
+
+	var backoff time.Duration
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, want := range expected {
+		backoff = thresholds.nextBackoff(backoff)
+		if backoff != want*time.Millisecond {
+			t.Errorf("backoff %d = %v, want %v", i, backoff, want*time.Millisecond)
+		}
+	}
+}
+
+func TestTaskThresholds(t *testing.T) {
+	// 默认不检查实例负载
+	if thresholds := taskThresholds(&task.CleanTaskParam{}); thresholds.enabled() {
+		t.Errorf("default thresholds = %+v, want disabled", thresholds)
+	}
+
+	origin := config.Agent.Clean.Throttle
+	defer func() { config.Agent.Clean.Throttle = origin }()
+	config.Agent.Clean.Throttle.MaxInstanceOps = 50000
+	config.Agent.Clean.Throttle.MaxLatency = 50
+	thresholds := taskThresholds(&task.CleanTaskParam{MaxLatency: 20, MaxLazyfreePending: 1000})
+	if !thresholds.enabled() || thresholds.maxInstanceOps != 50000 || thresholds.maxLatency != 20*time.Millisecond || thresholds.maxLazyfreePending != 1000 {
+		t.Errorf("thresholds = %+v", thresholds)
+	}
+}
+
+// serveOverloadedRedis 启动一个只支持PING和INFO的RESP服务端, instantaneous_ops_per_sec一直为ops
+func serveOverloadedRedis(t *testing.T, ops int) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				for {
+					line, err := rd.ReadString('\n')
+					if err != nil {
+						return
+					}
+					var n int
+					fmt.Sscanf(line, "*%d", &n)
+					var command string
+					for i := 0; i < n*2; i++ {
+						if line, err = rd.ReadString('\n'); err != nil {
+							return
+						}
+						if i == 1 {
+							command = strings.ToLower(strings.TrimSpace(line))
+						}
+					}
+					reply := "+PONG\r\n"
+					if command == "info" {
+						info := fmt.Sprintf("# Stats\r\ninstantaneous_ops_per_sec:%d\r\n", ops)
+						reply = fmt.Sprintf("$%d\r\n%s\r\n", len(info), info)
+					}
+					if _, err = conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestThrottlerBackoffTimeout(t *testing.T) {
+	minBackoff = time.Millisecond
+	defer func() { minBackoff = 100 * time.Millisecond }()
+
+	client := redis.NewClient(&redis.Options{Addr: serveOverloadedRedis(t, 1000)})
+	defer client.Close()
+	progress := &NodeCleanProgress{Addr: "127.0.0.1:6379"}
+	thresholds := instanceThresholds{maxInstanceOps: 100, maxBackoff: 2 * time.Millisecond, backoffTimeout: 20 * time.Millisecond}
+	throttle := newThrottler(client, newRateLimiter(0, 0), thresholds, progress)
+
+	// 实例的负载一直超过阈值时, 退避的总时间超过上限之后返回错误
+	err := throttle.wait(1, 0)
+	if err == nil || !strings.Contains(err.Error(), "instantaneous_ops_per_sec 1000 exceeds 100") {
+		t.Fatalf("wait() error = %v, want overloaded error", err)
+	}
+	if progress.ThrottledTimes == 0 || !strings.Contains(progress.ThrottleReason, "instantaneous_ops_per_sec") {
+		t.Errorf("progress = %+v", progress)
+	}
+}
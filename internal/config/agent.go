@@ -0,0 +1,159 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+type tomlSnapshot struct {
+	// 内存分析快照的保存目录, 为空时不保存快照
+	Dir string `toml:"dir"`
+	// 最多保留的快照数量, 超出时删除最早的快照, 0表示不限制
+	Retention int `toml:"retention"`
+}
+
+// TenantQuota 用户的内存配额, 值为0的限制不生效
+type TenantQuota struct {
+	// 用户名称, 为 * 时对没有单独配置配额的用户生效
+	UserName string `toml:"user"`
+	// 内存开销的上限, 单位是字节
+	MaxBytes uint64 `toml:"max_bytes"`
+	// key数量的上限
+	MaxKeys uint64 `toml:"max_keys"`
+	// 内存开销占maxmemory的比例上限, 取值范围(0, 1]
+	MaxMemoryRatio float64 `toml:"max_memory_ratio"`
+}
+
+type tomlQuota struct {
+	// 出现超出配额的用户时以POST方式通知的地址, 为空时不通知
+	Webhook string        `toml:"webhook"`
+	Tenants []TenantQuota `toml:"tenants"`
+}
+
+// tomlThrottle 清理时根据实例负载退避的阈值, 值为0的阈值不检查, 默认都不检查
+// 清理任务的 maxInstanceOps、maxLatency、maxLazyfreePending 参数会覆盖这里的阈值
+type tomlThrottle struct {
+	// instantaneous_ops_per_sec 的上限
+	MaxInstanceOps int64 `toml:"max_instance_ops"`
+	// 往返延迟的上限, 单位是毫秒
+	MaxLatency int `toml:"max_latency"`
+	// lazyfree_pending_objects 的上限, 超过时说明后台线程来不及释放unlink的key
+	MaxLazyfreePending int64 `toml:"max_lazyfree_pending"`
+	// 检查实例负载的间隔, 单位是毫秒
+	CheckInterval int `toml:"check_interval"`
+	// 退避时间的上限, 单位是毫秒, 退避时间从100ms开始每次翻倍
+	MaxBackoff int `toml:"max_backoff"`
+	// 持续退避的总时间的上限, 单位是秒, 超过时清理任务失败
+	BackoffTimeout int `toml:"backoff_timeout"`
+}
+
+type tomlClean struct {
+	// 清理任务检查点的保存目录, 为空时不保存检查点
+	CheckpointDir string `toml:"checkpoint_dir"`
+	// 保存检查点的间隔, 单位是秒
+	CheckpointInterval int `toml:"checkpoint_interval"`
+	// 启动时是否自动恢复有检查点的清理任务, 默认关闭, 关闭时通过 POST /task/{taskId}/resume 手动恢复
+	AutoResume bool `toml:"auto_resume"`
+	// 实例负载过高时的退避阈值
+	Throttle tomlThrottle `toml:"throttle"`
+}
+
+type tomlStatistic struct {
+	// 允许通过rdbPath参数分析的rdb文件所在的目录, rdbPath只能指向这些目录下的文件
+	RdbDirs []string `toml:"rdb_dirs"`
+}
+
+type tomlAgentConfig struct {
+	// http服务监听的地址
+	Address   string        `toml:"address"`
+	Snapshot  tomlSnapshot  `toml:"snapshot"`
+	Quota     tomlQuota     `toml:"quota"`
+	Clean     tomlClean     `toml:"clean"`
+	Statistic tomlStatistic `toml:"statistic"`
+}
+
+// Agent redis_agent自身的配置, 与同步相关的 Config 相互独立
+var Agent tomlAgentConfig
+
+func init() {
+	Agent.Address = ":6389"
+	Agent.Snapshot.Dir = "/data/redis-agent/snapshots"
+	Agent.Snapshot.Retention = 90
+	Agent.Statistic.RdbDirs = []string{"/data"}
+	Agent.Clean.CheckpointDir = "/data/redis-agent/checkpoints"
+	Agent.Clean.CheckpointInterval = 10
+	Agent.Clean.Throttle.CheckInterval = 1000
+	Agent.Clean.Throttle.MaxBackoff = 5000
+	Agent.Clean.Throttle.BackoffTimeout = 600
+}
+
+// LoadAgentConfig 从toml文件中加载agent配置, 文件中没有的配置项使用默认值, 如:
+//
+//	address = ":6389"
+//	[snapshot]
+//	dir = "/data/redis-agent/snapshots"
+//	retention = 90
+//	[quota]
+//	webhook = "http://alert.example.com/redis"
+//	[[quota.tenants]]
+//	user = "user1"
+//	max_bytes = 1073741824
+//	max_memory_ratio = 0.3
+//	[statistic]
+//	rdb_dirs = ["/data", "/backup/redis"]
+//	[clean]
+//	checkpoint_dir = "/data/redis-agent/checkpoints"
+//	checkpoint_interval = 10
+//	auto_resume = true
+//	[clean.throttle]
+//	max_instance_ops = 50000
+//	max_latency = 50
+//	max_lazyfree_pending = 100000
+//	backoff_timeout = 600
+func LoadAgentConfig(filename string) error {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	decoder := toml.NewDecoder(bytes.NewReader(buf))
+	decoder.SetStrict(true)
+	if err = decoder.Decode(&Agent); err != nil {
+		if missingError, ok := err.(*toml.StrictMissingError); ok {
+			return fmt.Errorf("decode agent config error:\n%s", missingError.String())
+		}
+		return err
+	}
+
+	if Agent.Snapshot.Retention < 0 {
+		return fmt.Errorf("snapshot retention must not be negative: %d", Agent.Snapshot.Retention)
+	}
+	if Agent.Clean.CheckpointInterval <= 0 {
+		return fmt.Errorf("clean checkpoint_interval must be positive: %d", Agent.Clean.CheckpointInterval)
+	}
+	for _, dir := range Agent.Statistic.RdbDirs {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("statistic rdb_dirs must be absolute paths: %s", dir)
+		}
+	}
+	throttle := Agent.Clean.Throttle
+	if throttle.MaxInstanceOps < 0 || throttle.MaxLatency < 0 || throttle.MaxLazyfreePending < 0 {
+		return fmt.Errorf("clean throttle thresholds must not be negative")
+	}
+	if throttle.CheckInterval <= 0 || throttle.MaxBackoff <= 0 || throttle.BackoffTimeout <= 0 {
+		return fmt.Errorf("clean throttle check_interval, max_backoff and backoff_timeout must be positive")
+	}
+	for i, quota := range Agent.Quota.Tenants {
+		if quota.UserName == "" {
+			return fmt.Errorf("quota %d: user must not be empty", i)
+		}
+		if quota.MaxMemoryRatio < 0 || quota.MaxMemoryRatio > 1 {
+			return fmt.Errorf("quota of %s: max_memory_ratio must be between 0 and 1", quota.UserName)
+		}
+	}
+	return nil
+}
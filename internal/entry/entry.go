@@ -11,10 +11,18 @@ type Entry struct {
 	Key         string // 当前key
 	Overhead    uint64 // 当前key的内存开销,单位是字节
 	IsExpireKey bool   // 是否是带过期时间的key
+	ExpireAt    int64  // 过期时间的unix时间戳,单位是毫秒,没有过期时间时为0
+	Idle        int64  // LRU空闲时间,单位是秒,rdb中没有记录时为-1
+	Freq        int64  // LFU访问频率,rdb中没有记录时为-1
+	Type        string // 对象类型,如 string、hash
+	Encoding    string // 对象加载到redis中以后的编码,如 listpack、hashtable
+	Length      uint64 // string为value的字节数,其余类型为元素数量
 }
 
 func NewEntry() *Entry {
 	e := new(Entry)
+	e.Idle = -1
+	e.Freq = -1
 	return e
 }
 
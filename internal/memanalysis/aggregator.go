@@ -0,0 +1,360 @@
+package memanalysis
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leijianzhong001/redis_agent/internal/utils"
+	"github.com/leijianzhong001/redis_agent/task"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// clusterAnalysis 最近一次集群汇总的结果
+var clusterAnalysis *ClusterAnalysis
+
+// 轮询分片任务状态的间隔
+var peerPollInterval = 5 * time.Second
+
+// 分片上的任务id冲突时重新生成id的次数
+var peerCreateRetries = 3
+
+var peerHttpClient = &http.Client{Timeout: 30 * time.Second}
+
+// ShardResult 一个分片的内存统计任务
+type ShardResult struct {
+	// 分片上agent的地址
+	Agent string `json:"agent"`
+	// 执行统计的redis节点, 通过 CLUSTER NODES 发现时才有
+	Node string `json:"node,omitempty"`
+	// 分片上的任务id
+	TaskId int `json:"taskId"`
+	// 分片的key数量和内存开销
+	KeyCount uint64 `json:"keyCount"`
+	Overhead uint64 `json:"overhead"`
+}
+
+// ShardContribution 一个分片对某个用户的贡献
+type ShardContribution struct {
+	Agent    string `json:"agent"`
+	KeyCount uint64 `json:"keyCount"`
+	Overhead uint64 `json:"overhead"`
+	// 占该用户集群总开销的比例
+	Proportion float64 `json:"proportion"`
+}
+
+// ClusterUserOverhead 用户在整个集群中的开销
+type ClusterUserOverhead struct {
+	OverheadStat
+	UserName string `json:"userName"`
+	// 按照数据类型统计的开销
+	Types map[string]*OverheadStat `json:"types"`
+	// 每个分片的贡献, 按照开销从大到小排序
+	Shards []*ShardContribution `json:"shards"`
+}
+
+// ClusterAnalysis 集群级别的内存分析结果
+type ClusterAnalysis struct {
+	Shards       []*ShardResult                  `json:"shards"`
+	Users        map[string]*ClusterUserOverhead `json:"users"`
+	AnalysisDate time.Time                       `json:"analysisDate"`
+}
+
+// peerShard 需要执行统计的分片
+type peerShard struct {
+	agent string
+	node  string
+	// 分片只有主节点时使用scan模式, 因为rdb模式不能在主节点上执行
+	scanMode bool
+}
+
+// peerResponse 与 server.CommonResult 的json格式一致
+type peerResponse struct {
+	IsSuc bool
+	Msg   string
+	Data  json.RawMessage
+}
+
+// peerTaskInfo 分片上的统计任务, 与 task.GenericTaskInfo 的json格式一致, 任务结果为本次统计每个用户的开销
+type peerTaskInfo struct {
+	Status     int                      `json:"status"`
+	TaskLog    []string                 `json:"taskLog"`
+	TaskResult map[string]*UserOverhead `json:"taskResult"`
+}
+
+func ExecuteAggregate(taskInfo *task.GenericTaskInfo) error {
+	aggregateTaskParam, err := taskInfo.AggregateTaskParam()
+	if err != nil {
+		return err
+	}
+
+	shards, err := discoverShards(aggregateTaskParam)
+	if err != nil {
+		return err
+	}
+	log.Infof("aggregate statistic on %d shards", len(shards))
+
+	statisticParam := taskInfo.StatisticParamOfAggregate()
+	deadline := time.Now().Add(time.Duration(aggregateTaskParam.Timeout) * time.Minute)
+	results := make([]*ShardResult, len(shards))
+	users := make([]map[string]*UserOverhead, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard peerShard) {
+			defer wg.Done()
+			param := statisticParam
+			if shard.scanMode {
+				param = make(map[string]string, len(statisticParam)+1)
+				for name, value := range statisticParam {
+					param[name] = value
+				}
+				param["mode"] = task.StatisticModeScan
+			}
+			results[i] = &ShardResult{Agent: shard.agent, Node: shard.node}
+			results[i].TaskId, users[i], errs[i] = runPeerStatistic(shard.agent, param, deadline)
+		}(i, shard)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			// 任何一个分片失败时集群视图都是不完整的, 不替换原来的结果
+			return errors.Wrapf(err, "statistic on shard %s fail", shards[i].agent)
+		}
+	}
+	analysis := mergeShards(results, users)
+	reportLocker.Lock()
+	clusterAnalysis = analysis
+	reportLocker.Unlock()
+	log.Infof("cluster analysis is done, user count: %d", len(analysis.Users))
+	return nil
+}
+
+// discoverShards 使用指定的agent地址, 没有指定时通过 CLUSTER NODES 为每个分片选择一个节点
+func discoverShards(param *task.AggregateTaskParam) ([]peerShard, error) {
+	if strings.TrimSpace(param.Peers) != "" {
+		var shards []peerShard
+		for _, peer := range strings.Split(param.Peers, ",") {
+			if peer = strings.TrimSpace(peer); peer != "" {
+				shards = append(shards, peerShard{agent: peer})
+			}
+		}
+		return shards, nil
+	}
+
+	nodes, err := utils.GetRedisClient().ClusterNodes(ctx).Result()
+	if err != nil {
+		return nil, errors.New("cluster nodes command execute fail: " + err.Error())
+	}
+	shards := parseClusterShards(nodes, param.AgentPort)
+	if len(shards) == 0 {
+		return nil, errors.New("no shard found in cluster nodes")
+	}
+	return shards, nil
+}
+
+// parseClusterShards 解析 CLUSTER NODES 的结果, 每个分片优先选择一个正常的从节点, 没有从节点时选择主节点
+// 每一行的格式为 <id> <ip:port@cport[,hostname]> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...
+func parseClusterShards(nodes string, agentPort int) []peerShard {
+	type clusterNode struct {
+		id, host, addr string
+	}
+	masters := make(map[string]clusterNode)
+	replicas := make(map[string]clusterNode)
+	for _, line := range strings.Split(strings.TrimSpace(nodes), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		flags := fields[2]
+		if strings.Contains(flags, "fail") || strings.Contains(flags, "handshake") || strings.Contains(flags, "noaddr") {
+			continue
+		}
+		addr := fields[1]
+		if index := strings.IndexAny(addr, "@,"); index >= 0 {
+			addr = addr[:index]
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		node := clusterNode{id: fields[0], host: host, addr: addr}
+		if strings.Contains(flags, "master") {
+			// 没有分配slot的主节点不属于任何分片
+			if len(fields) > 8 {
+				masters[node.id] = node
+			}
+		} else if strings.Contains(flags, "slave") {
+			if _, ok := replicas[fields[3]]; !ok {
+				replicas[fields[3]] = node
+			}
+		}
+	}
+
+	shards := make([]peerShard, 0, len(masters))
+	for masterId, master := range masters {
+		node, scanMode := master, true
+		if replica, ok := replicas[masterId]; ok {
+			node, scanMode = replica, false
+		}
+		shards = append(shards, peerShard{
+			agent:    net.JoinHostPort(node.host, strconv.Itoa(agentPort)),
+			node:     node.addr,
+			scanMode: scanMode,
+		})
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].node < shards[j].node })
+	return shards
+}
+
+// runPeerStatistic 在agent上创建内存统计任务, 等待完成之后从任务结果中获取本次统计的结果, 返回分片上的任务id
+func runPeerStatistic(agent string, param map[string]string, deadline time.Time) (int, map[string]*UserOverhead, error) {
+	taskId, err := createPeerTask(agent, param)
+	if err != nil {
+		return 0, nil, err
+	}
+	log.Infof("statistic task %d is created on agent %s", taskId, agent)
+
+	for {
+		var peerTask peerTaskInfo
+		if err = callPeer(http.MethodGet, agent, fmt.Sprintf("/task/%d", taskId), nil, &peerTask); err != nil {
+			return taskId, nil, err
+		}
+		if peerTask.Status == task.SUC {
+			if peerTask.TaskResult == nil {
+				return taskId, nil, errors.Errorf("statistic task %d has no result, agent %s may be outdated", taskId, agent)
+			}
+			return taskId, peerTask.TaskResult, nil
+		}
+		if peerTask.Status == task.FAIL {
+			lastLog := ""
+			if len(peerTask.TaskLog) > 0 {
+				lastLog = peerTask.TaskLog[len(peerTask.TaskLog)-1]
+			}
+			return taskId, nil, errors.Errorf("statistic task %d failed: %s", taskId, lastLog)
+		}
+		if time.Now().After(deadline) {
+			return taskId, nil, errors.Errorf("statistic task %d timeout", taskId)
+		}
+		time.Sleep(peerPollInterval)
+	}
+}
+
+// createPeerTask 以随机的任务id在agent上创建内存统计任务, 任务id已经存在时重新生成
+func createPeerTask(agent string, param map[string]string) (int, error) {
+	var err error
+	for i := 0; i < peerCreateRetries; i++ {
+		var id *big.Int
+		if id, err = rand.Int(rand.Reader, big.NewInt(math.MaxInt32)); err != nil {
+			return 0, err
+		}
+		taskInfo := &task.GenericTaskInfo{TaskId: int(id.Int64()) + 1, TaskType: task.STATISTIC, TaskParam: param}
+		var body []byte
+		if body, err = json.Marshal(taskInfo); err != nil {
+			return 0, err
+		}
+		if err = callPeer(http.MethodPost, agent, "/task", body, nil); err == nil {
+			return taskInfo.TaskId, nil
+		}
+		if !strings.Contains(err.Error(), "already exists") {
+			return 0, err
+		}
+		log.Warnf("statistic task %d already exists on agent %s, retry with another task id", taskInfo.TaskId, agent)
+	}
+	return 0, err
+}
+
+// callPeer 调用其他agent的接口, result不为空时把返回的Data解析到result中
+func callPeer(method string, agent string, path string, body []byte, result interface{}) error {
+	req, err := http.NewRequest(method, "http://"+agent+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := peerHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s %s returns http status %d", method, path, resp.StatusCode)
+	}
+
+	var peerResp peerResponse
+	if err = json.NewDecoder(resp.Body).Decode(&peerResp); err != nil {
+		return errors.Wrapf(err, "decode response of %s %s fail", method, path)
+	}
+	if !peerResp.IsSuc {
+		return errors.Errorf("%s %s fail: %s", method, path, peerResp.Msg)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(peerResp.Data, result)
+}
+
+// mergeShards 把每个分片的统计结果合并为集群视图
+func mergeShards(results []*ShardResult, users []map[string]*UserOverhead) *ClusterAnalysis {
+	analysis := &ClusterAnalysis{
+		Shards:       results,
+		Users:        make(map[string]*ClusterUserOverhead),
+		AnalysisDate: time.Now(),
+	}
+	for i, shardUsers := range users {
+		for userName, userOverhead := range shardUsers {
+			clusterUser, ok := analysis.Users[userName]
+			if !ok {
+				clusterUser = &ClusterUserOverhead{UserName: userName, Types: make(map[string]*OverheadStat)}
+				analysis.Users[userName] = clusterUser
+			}
+			clusterUser.KeyCount += userOverhead.KeyCount
+			clusterUser.ExpireKeyCount += userOverhead.ExpireKeyCount
+			clusterUser.Overhead += userOverhead.Overhead
+			for typeName, stat := range userOverhead.Types {
+				clusterStat := typeStat(clusterUser.Types, typeName)
+				clusterStat.KeyCount += stat.KeyCount
+				clusterStat.ExpireKeyCount += stat.ExpireKeyCount
+				clusterStat.Overhead += stat.Overhead
+			}
+			clusterUser.Shards = append(clusterUser.Shards, &ShardContribution{
+				Agent:    results[i].Agent,
+				KeyCount: userOverhead.KeyCount,
+				Overhead: userOverhead.Overhead,
+			})
+			results[i].KeyCount += userOverhead.KeyCount
+			results[i].Overhead += userOverhead.Overhead
+		}
+	}
+
+	for _, clusterUser := range analysis.Users {
+		for _, shard := range clusterUser.Shards {
+			if clusterUser.Overhead > 0 {
+				shard.Proportion = float64(shard.Overhead) / float64(clusterUser.Overhead)
+			}
+		}
+		sort.Slice(clusterUser.Shards, func(i, j int) bool {
+			return clusterUser.Shards[i].Overhead > clusterUser.Shards[j].Overhead
+		})
+	}
+	return analysis
+}
+
+// GetClusterAnalysis 最近一次集群汇总的结果
+func GetClusterAnalysis() *ClusterAnalysis {
+	reportLocker.RLock()
+	defer reportLocker.RUnlock()
+	return clusterAnalysis
+}
@@ -0,0 +1,117 @@
+package memanalysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leijianzhong001/redis_agent/task"
+)
+
+func TestParseClusterShards(t *testing.T) {
+	nodes := `07c37dfeb235213a872192d90877d0cd55635b91 10.0.0.2:6379@16379 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected
+67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 10.0.0.3:6379@16379 slave 292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 0 1426238316232 2 disconnected
+e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 10.0.0.1:6379@16379,redis-0 myself,master - 0 0 1 connected 0-5460
+292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 10.0.0.4:6379@16379 master - 0 1426238318243 2 connected 5461-10922
+824fe116063bc5fcf9f4ffd895bc17aee7731ac3 10.0.0.5:6379@16379 master - 0 1426238316232 3 connected 10923-16383
+6ec23923021cf3ffec47632106199cb7f496ce01 10.0.0.6:6379@16379 slave,fail 824fe116063bc5fcf9f4ffd895bc17aee7731ac3 0 1426238316232 5 connected
+33cba0b4cfb7e6bb61d3e7ba0ac0e2e0f10f1a39 10.0.0.7:6379@16379 master - 0 1426238316232 6 connected`
+	shards := parseClusterShards(nodes, 6389)
+	if len(shards) != 3 {
+		t.Fatalf("parseClusterShards() = %+v", shards)
+	}
+	want := []peerShard{
+		{agent: "10.0.0.2:6389", node: "10.0.0.2:6379"},
+		{agent: "10.0.0.3:6389", node: "10.0.0.3:6379"},
+		// 从节点已经下线, 在主节点上使用scan模式
+		{agent: "10.0.0.5:6389", node: "10.0.0.5:6379", scanMode: true},
+	}
+	for i := range want {
+		if shards[i] != want[i] {
+			t.Errorf("shard %d = %+v, want %+v", i, shards[i], want[i])
+		}
+	}
+}
+
+// fakeAgent 模拟一个agent, 前conflicts次创建任务时返回任务id已经存在, 任务在第二次查询时完成
+// 完成之后 /analysisInfo 返回的是其他统计任务的结果, 汇总时只能使用任务结果
+func fakeAgent(t *testing.T, users map[string]*UserOverhead, conflicts int) *httptest.Server {
+	polls := 0
+	var created task.GenericTaskInfo
+	write := func(w http.ResponseWriter, data interface{}) {
+		payload, _ := json.Marshal(data)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"IsSuc": true, "Data": json.RawMessage(payload)})
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == http.MethodPost && req.URL.Path == "/task":
+			if conflicts > 0 {
+				conflicts--
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"IsSuc": false, "Msg": "1 task is already exists, can't create again!"})
+				return
+			}
+			if err := json.NewDecoder(req.Body).Decode(&created); err != nil {
+				t.Errorf("decode task error: %v", err)
+			}
+			write(w, nil)
+		case req.URL.Path == fmt.Sprintf("/task/%d", created.TaskId):
+			polls++
+			created.Status = task.PROGRESS
+			if polls > 1 {
+				created.Status = task.SUC
+				created.TaskResult = users
+			}
+			write(w, &created)
+		case req.URL.Path == "/analysisInfo":
+			write(w, map[string]*UserOverhead{"other": {UserName: "other", KeyCount: 1, Overhead: 1}})
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+}
+
+func TestExecuteAggregate(t *testing.T) {
+	peerPollInterval = time.Millisecond
+	shard1 := fakeAgent(t, map[string]*UserOverhead{
+		"user1": {UserName: "user1", KeyCount: 3, Overhead: 300, Types: map[string]*OverheadStat{"hash": {KeyCount: 3, Overhead: 300}}},
+		"user2": {UserName: "user2", KeyCount: 1, Overhead: 10},
+	}, 1)
+	defer shard1.Close()
+	shard2 := fakeAgent(t, map[string]*UserOverhead{
+		"user1": {UserName: "user1", KeyCount: 1, Overhead: 100, Types: map[string]*OverheadStat{"hash": {KeyCount: 1, Overhead: 100}}},
+	}, 0)
+	defer shard2.Close()
+
+	agent1 := strings.TrimPrefix(shard1.URL, "http://")
+	agent2 := strings.TrimPrefix(shard2.URL, "http://")
+	taskInfo := &task.GenericTaskInfo{
+		TaskId:    7,
+		TaskType:  task.AGGREGATE,
+		TaskParam: map[string]string{"peers": agent1 + "," + agent2, "workers": "4"},
+	}
+	if err := ExecuteAggregate(taskInfo); err != nil {
+		t.Fatalf("ExecuteAggregate() error: %v", err)
+	}
+
+	analysis := GetClusterAnalysis()
+	if len(analysis.Shards) != 2 || analysis.Shards[0].TaskId <= 0 || analysis.Shards[1].TaskId <= 0 || analysis.Shards[0].Overhead != 310 {
+		t.Errorf("shards = %+v, %+v", analysis.Shards[0], analysis.Shards[1])
+	}
+	user1 := analysis.Users["user1"]
+	if user1.KeyCount != 4 || user1.Overhead != 400 || user1.Types["hash"].Overhead != 400 {
+		t.Fatalf("user1 = %+v", user1)
+	}
+	if len(user1.Shards) != 2 || user1.Shards[0].Agent != agent1 || user1.Shards[0].Proportion != 0.75 {
+		t.Errorf("user1 shards = %+v, %+v", user1.Shards[0], user1.Shards[1])
+	}
+	if _, ok := analysis.Users["other"]; ok {
+		t.Errorf("result of another statistic task should not be merged")
+	}
+	if taskInfo.StatisticParamOfAggregate()["peers"] != "" {
+		t.Errorf("peers should not be forwarded to shards")
+	}
+}
@@ -0,0 +1,134 @@
+package memanalysis
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/leijianzhong001/redis_agent/internal/utils"
+	"github.com/pkg/errors"
+)
+
+// 归属规则类型
+const (
+	// RuleDelimiter 按照分隔符切分key, 取前depth段作为用户, 如 user1:order:1 => user1
+	RuleDelimiter = "delimiter"
+	// RuleRegex 使用正则表达式匹配key, 取名为user的捕获组, 没有时取第一个捕获组作为用户
+	RuleRegex = "regex"
+	// RuleHashTag 取key中的hash tag作为用户, 如 {user1}:order:1 => user1
+	RuleHashTag = "hashtag"
+)
+
+// UnattributedUser 没有匹配任何归属规则的key都统计到这个用户下, 保证总量完整
+const UnattributedUser = "<unattributed>"
+
+// AttributionRule key到用户的归属规则
+type AttributionRule struct {
+	// 规则类型 delimiter/regex/hashtag
+	Type string `json:"type"`
+	// delimiter规则的分隔符, 默认为 :
+	Delimiter string `json:"delimiter"`
+	// delimiter规则取前几段作为用户, 默认为1
+	Depth int `json:"depth"`
+	// regex规则的正则表达式
+	Pattern string `json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+// DefaultAttributionRules 默认按照第一个冒号之前的部分作为用户
+var DefaultAttributionRules = []AttributionRule{{Type: RuleDelimiter, Delimiter: ":", Depth: 1}}
+
+// Attributor 按照规则的顺序依次匹配, 使用第一个匹配的规则得到key所属的用户
+type Attributor struct {
+	rules []AttributionRule
+}
+
+// ParseAttributionRules 解析json数组格式的归属规则, 为空时使用默认规则, 如:
+//
+//	[{"type":"hashtag"},{"type":"regex","pattern":"^app\\|(?P<user>[^|]+)\\|"},{"type":"delimiter","delimiter":":","depth":2}]
+func ParseAttributionRules(rulesJson string) (*Attributor, error) {
+	if strings.TrimSpace(rulesJson) == "" {
+		return NewAttributor(DefaultAttributionRules)
+	}
+	var rules []AttributionRule
+	if err := json.Unmarshal([]byte(rulesJson), &rules); err != nil {
+		return nil, errors.Wrap(err, "attributionRules must be a json array")
+	}
+	return NewAttributor(rules)
+}
+
+// NewAttributor 校验并编译归属规则
+func NewAttributor(rules []AttributionRule) (*Attributor, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("at least one attribution rule is required")
+	}
+	compiled := make([]AttributionRule, len(rules))
+	for i, rule := range rules {
+		switch rule.Type {
+		case RuleDelimiter:
+			if rule.Delimiter == "" {
+				rule.Delimiter = ":"
+			}
+			if rule.Depth == 0 {
+				rule.Depth = 1
+			}
+			if rule.Depth < 0 {
+				return nil, errors.Errorf("attribution rule %d: depth must be positive", i)
+			}
+		case RuleRegex:
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, errors.Wrapf(err, "attribution rule %d: invalid pattern", i)
+			}
+			if re.NumSubexp() == 0 {
+				return nil, errors.Errorf("attribution rule %d: pattern must have a capture group", i)
+			}
+			rule.re = re
+		case RuleHashTag:
+		default:
+			return nil, errors.Errorf("attribution rule %d: unknown type %s", i, rule.Type)
+		}
+		compiled[i] = rule
+	}
+	return &Attributor{rules: compiled}, nil
+}
+
+// Attribute 得到key所属的用户, 没有匹配任何规则时返回 UnattributedUser 和 false
+func (a *Attributor) Attribute(key string) (string, bool) {
+	for i := range a.rules {
+		if userName, ok := a.rules[i].match(key); ok && userName != "" {
+			return userName, true
+		}
+	}
+	return UnattributedUser, false
+}
+
+func (rule *AttributionRule) match(key string) (string, bool) {
+	switch rule.Type {
+	case RuleDelimiter:
+		// 前depth段之后还需要有内容, 否则说明key中没有用户前缀
+		parts := strings.SplitN(key, rule.Delimiter, rule.Depth+1)
+		if len(parts) <= rule.Depth {
+			return "", false
+		}
+		return strings.Join(parts[:rule.Depth], rule.Delimiter), true
+	case RuleRegex:
+		match := rule.re.FindStringSubmatch(key)
+		if match == nil {
+			return "", false
+		}
+		if index := rule.re.SubexpIndex("user"); index > 0 {
+			return match[index], true
+		}
+		return match[1], true
+	case RuleHashTag:
+		tag := utils.Key(key)
+		if tag == key {
+			// 没有hash tag
+			return "", false
+		}
+		return tag, true
+	}
+	return "", false
+}
@@ -0,0 +1,49 @@
+package memanalysis
+
+import "testing"
+
+func TestAttribute(t *testing.T) {
+	attributor, err := ParseAttributionRules(`[
+		{"type":"hashtag"},
+		{"type":"regex","pattern":"^app\\|(?P<user>[^|]+)\\|"},
+		{"type":"delimiter","delimiter":":","depth":2}
+	]`)
+	if err != nil {
+		t.Fatalf("ParseAttributionRules() error: %v", err)
+	}
+	cases := map[string]string{
+		"{tenant1}:order:1":  "tenant1",
+		"app|tenant2|cache":  "tenant2",
+		"user1:order:1":      "user1:order",
+		"user1:order":        UnattributedUser,
+		"nodelimiter":        UnattributedUser,
+		"{}:empty:hash:tag":  "{}:empty",
+		"app||empty:user:id": "app||empty:user",
+	}
+	for key, want := range cases {
+		if got, _ := attributor.Attribute(key); got != want {
+			t.Errorf("Attribute(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestDefaultAttributionRules(t *testing.T) {
+	attributor, err := ParseAttributionRules("")
+	if err != nil {
+		t.Fatalf("ParseAttributionRules() error: %v", err)
+	}
+	if got, ok := attributor.Attribute("user1:key"); !ok || got != "user1" {
+		t.Errorf("Attribute(user1:key) = %q, %t", got, ok)
+	}
+	if got, ok := attributor.Attribute("user1"); ok || got != UnattributedUser {
+		t.Errorf("Attribute(user1) = %q, %t", got, ok)
+	}
+}
+
+func TestInvalidAttributionRules(t *testing.T) {
+	for _, rules := range []string{`{}`, `[]`, `[{"type":"unknown"}]`, `[{"type":"regex","pattern":"^app"}]`, `[{"type":"regex","pattern":"("}]`} {
+		if _, err := ParseAttributionRules(rules); err == nil {
+			t.Errorf("ParseAttributionRules(%s) should fail", rules)
+		}
+	}
+}
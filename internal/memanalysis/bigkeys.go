@@ -0,0 +1,189 @@
+package memanalysis
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+
+	"github.com/leijianzhong001/redis_agent/internal/entry"
+)
+
+// DefaultBigKeyTopN 默认保留的大key数量
+const DefaultBigKeyTopN = 20
+
+// BigKey 大key的信息
+type BigKey struct {
+	Key      string `json:"key"`
+	DbId     int    `json:"dbId"`
+	UserName string `json:"userName"`
+	Type     string `json:"type"`
+	Encoding string `json:"encoding"`
+	// 内存开销
+	Overhead uint64 `json:"overhead"`
+	// string为value的字节数, 其余类型为元素数量
+	Length uint64 `json:"length"`
+	// 过期时间的unix时间戳, 单位是毫秒, 没有过期时间时为0
+	ExpireAt int64 `json:"expireAt"`
+	// 相对于分析时间的剩余存活时间, 单位是毫秒, 与 PTTL 一致: 没有过期时间时为-1
+	TTL int64 `json:"ttl"`
+}
+
+// BigKeyRank 按照内存开销和元素数量分别排序的大key, 从大到小排列
+type BigKeyRank struct {
+	ByOverhead []*BigKey `json:"byOverhead"`
+	ByLength   []*BigKey `json:"byLength"`
+}
+
+// BigKeyReport 全局和每个用户的大key
+type BigKeyReport struct {
+	TopN         int                    `json:"topN"`
+	Overall      *BigKeyRank            `json:"overall"`
+	Users        map[string]*BigKeyRank `json:"users"`
+	AnalysisDate time.Time              `json:"analysisDate"`
+}
+
+// bigKeyHeap 按照metric排序的小顶堆, 堆顶是当前保留的最小的key
+type bigKeyHeap struct {
+	keys   []*BigKey
+	metric func(*BigKey) uint64
+}
+
+func (h *bigKeyHeap) Len() int           { return len(h.keys) }
+func (h *bigKeyHeap) Less(i, j int) bool { return h.metric(h.keys[i]) < h.metric(h.keys[j]) }
+func (h *bigKeyHeap) Swap(i, j int)      { h.keys[i], h.keys[j] = h.keys[j], h.keys[i] }
+func (h *bigKeyHeap) Push(x interface{}) { h.keys = append(h.keys, x.(*BigKey)) }
+func (h *bigKeyHeap) Pop() interface{} {
+	last := h.keys[len(h.keys)-1]
+	h.keys = h.keys[:len(h.keys)-1]
+	return last
+}
+
+func overheadMetric(bigKey *BigKey) uint64 { return bigKey.Overhead }
+func lengthMetric(bigKey *BigKey) uint64   { return bigKey.Length }
+
+// topN 保留metric最大的n个key
+type topN struct {
+	n    int
+	heap bigKeyHeap
+}
+
+func newTopN(n int, metric func(*BigKey) uint64) *topN {
+	return &topN{n: n, heap: bigKeyHeap{metric: metric}}
+}
+
+// accept 值为value的key能否进入topN, 用于在创建BigKey之前过滤掉绝大多数的key
+func (t *topN) accept(value uint64) bool {
+	return t.heap.Len() < t.n || value > t.heap.metric(t.heap.keys[0])
+}
+
+func (t *topN) offer(bigKey *BigKey) {
+	if t.heap.Len() < t.n {
+		heap.Push(&t.heap, bigKey)
+		return
+	}
+	t.heap.keys[0] = bigKey
+	heap.Fix(&t.heap, 0)
+}
+
+// sorted 从大到小排列的key
+func (t *topN) sorted() []*BigKey {
+	keys := make([]*BigKey, len(t.heap.keys))
+	copy(keys, t.heap.keys)
+	sort.SliceStable(keys, func(i, j int) bool { return t.heap.metric(keys[i]) > t.heap.metric(keys[j]) })
+	return keys
+}
+
+// bigKeyRanker 一个范围(全局或者某个用户)内按照内存开销和元素数量的topN
+type bigKeyRanker struct {
+	byOverhead *topN
+	byLength   *topN
+}
+
+func newBigKeyRanker(n int) *bigKeyRanker {
+	return &bigKeyRanker{byOverhead: newTopN(n, overheadMetric), byLength: newTopN(n, lengthMetric)}
+}
+
+func (r *bigKeyRanker) rank() *BigKeyRank {
+	return &BigKeyRank{ByOverhead: r.byOverhead.sorted(), ByLength: r.byLength.sorted()}
+}
+
+// BigKeyCollector 在统计过程中维护全局和每个用户的大key, 每个堆最多保留topN个key
+type BigKeyCollector struct {
+	topN         int
+	overall      *bigKeyRanker
+	users        map[string]*bigKeyRanker
+	analysisDate time.Time
+}
+
+// NewBigKeyCollector topN不大于0时使用默认值
+func NewBigKeyCollector(topN int) *BigKeyCollector {
+	if topN <= 0 {
+		topN = DefaultBigKeyTopN
+	}
+	return &BigKeyCollector{
+		topN:         topN,
+		overall:      newBigKeyRanker(topN),
+		users:        make(map[string]*bigKeyRanker, 16),
+		analysisDate: time.Now(),
+	}
+}
+
+// Add 把entry加入到全局和所属用户的堆中, 只有进入某个堆时才会创建BigKey
+func (c *BigKeyCollector) Add(userName string, e *entry.Entry) {
+	ranker, ok := c.users[userName]
+	if !ok {
+		ranker = newBigKeyRanker(c.topN)
+		c.users[userName] = ranker
+	}
+
+	var bigKey *BigKey
+	offer := func(t *topN, value uint64) {
+		if !t.accept(value) {
+			return
+		}
+		if bigKey == nil {
+			bigKey = c.newBigKey(userName, e)
+		}
+		t.offer(bigKey)
+	}
+	offer(c.overall.byOverhead, e.Overhead)
+	offer(ranker.byOverhead, e.Overhead)
+	offer(c.overall.byLength, e.Length)
+	offer(ranker.byLength, e.Length)
+}
+
+func (c *BigKeyCollector) newBigKey(userName string, e *entry.Entry) *BigKey {
+	bigKey := &BigKey{
+		Key:      e.Key,
+		DbId:     e.DbId,
+		UserName: userName,
+		Type:     e.Type,
+		Encoding: e.Encoding,
+		Overhead: e.Overhead,
+		Length:   e.Length,
+		ExpireAt: e.ExpireAt,
+		TTL:      -1,
+	}
+	if e.IsExpireKey {
+		bigKey.TTL = e.ExpireAt - c.analysisDate.UnixNano()/int64(time.Millisecond)
+		if bigKey.TTL < 0 {
+			// 生成rdb之后已经过期
+			bigKey.TTL = 0
+		}
+	}
+	return bigKey
+}
+
+// Report 生成大key报告
+func (c *BigKeyCollector) Report() *BigKeyReport {
+	report := &BigKeyReport{
+		TopN:         c.topN,
+		Overall:      c.overall.rank(),
+		Users:        make(map[string]*BigKeyRank, len(c.users)),
+		AnalysisDate: c.analysisDate,
+	}
+	for userName, ranker := range c.users {
+		report.Users[userName] = ranker.rank()
+	}
+	return report
+}
@@ -0,0 +1,51 @@
+package memanalysis
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/leijianzhong001/redis_agent/internal/entry"
+)
+
+func TestBigKeyCollector(t *testing.T) {
+	collector := NewBigKeyCollector(3)
+	for i := 1; i <= 10; i++ {
+		e := entry.NewEntry()
+		e.Key = fmt.Sprintf("user%d:key%d", i%2, i)
+		e.Type = "hash"
+		e.Overhead = uint64(i * 100)
+		// 元素数量与内存开销的顺序相反
+		e.Length = uint64(100 - i)
+		collector.Add(fmt.Sprintf("user%d", i%2), e)
+	}
+	expiring := entry.NewEntry()
+	expiring.Key = "user1:expiring"
+	expiring.Overhead = 5000
+	expiring.IsExpireKey = true
+	expiring.ExpireAt = collector.analysisDate.UnixNano()/1e6 + 60000
+	collector.Add("user1", expiring)
+
+	report := collector.Report()
+	keys := func(bigKeys []*BigKey) string {
+		var s string
+		for _, bigKey := range bigKeys {
+			s += bigKey.Key + " "
+		}
+		return s
+	}
+	if got := keys(report.Overall.ByOverhead); got != "user1:expiring user0:key10 user1:key9 " {
+		t.Errorf("overall by overhead = %s", got)
+	}
+	if got := keys(report.Overall.ByLength); got != "user1:key1 user0:key2 user1:key3 " {
+		t.Errorf("overall by length = %s", got)
+	}
+	if got := keys(report.Users["user0"].ByOverhead); got != "user0:key10 user0:key8 user0:key6 " {
+		t.Errorf("user0 by overhead = %s", got)
+	}
+	if ttl := report.Overall.ByOverhead[0].TTL; ttl != 60000 {
+		t.Errorf("TTL = %d, want 60000", ttl)
+	}
+	if ttl := report.Overall.ByOverhead[1].TTL; ttl != -1 {
+		t.Errorf("TTL without expire = %d, want -1", ttl)
+	}
+}
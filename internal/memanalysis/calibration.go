@@ -0,0 +1,266 @@
+package memanalysis
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/leijianzhong001/redis_agent/internal/entry"
+	"github.com/leijianzhong001/redis_agent/internal/utils"
+	"github.com/leijianzhong001/redis_agent/task"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// calibrationReport 最近一次校准的结果
+var calibrationReport *CalibrationReport
+
+// CalibrationSample 一个抽样key的估算值和实际值
+type CalibrationSample struct {
+	Key      string `json:"key"`
+	DbId     int    `json:"dbId"`
+	Type     string `json:"type"`
+	Encoding string `json:"encoding"`
+	// MemOverhead估算的开销
+	Estimated uint64 `json:"estimated"`
+	// MEMORY USAGE得到的开销, 带过期时间的key与估算一样加上过期字典的24字节
+	Actual uint64 `json:"actual"`
+	// 相对误差 (估算值-实际值)/实际值
+	Error float64 `json:"error"`
+}
+
+// ErrorDistribution 一组样本的相对误差分布
+type ErrorDistribution struct {
+	Count int `json:"count"`
+	// 平均误差, 为正说明整体高估
+	MeanError float64 `json:"meanError"`
+	// 平均绝对误差
+	MeanAbsError float64 `json:"meanAbsError"`
+	MinError     float64 `json:"minError"`
+	P50Error     float64 `json:"p50Error"`
+	P90Error     float64 `json:"p90Error"`
+	P99Error     float64 `json:"p99Error"`
+	MaxError     float64 `json:"maxError"`
+	// 样本的估算总和与实际总和
+	EstimatedTotal uint64 `json:"estimatedTotal"`
+	ActualTotal    uint64 `json:"actualTotal"`
+}
+
+// CalibrationReport 校准结果
+type CalibrationReport struct {
+	// 参与比较的样本数量, 抽样之后被删除的key不参与比较
+	SampleCount int `json:"sampleCount"`
+	// 整体的误差分布
+	Overall *ErrorDistribution `json:"overall"`
+	// 按照数据类型的误差分布
+	Types map[string]*ErrorDistribution `json:"types"`
+	// 误差最大的样本, 按照绝对误差从大到小排序
+	WorstSamples []*CalibrationSample `json:"worstSamples"`
+	// rdb中所有key的估算总开销, 包含全局字典rehash的开销
+	EstimatedTotal uint64 `json:"estimatedTotal"`
+	// INFO memory 中的 used_memory 和 used_memory_dataset
+	UsedMemory        uint64 `json:"usedMemory"`
+	UsedMemoryDataset uint64 `json:"usedMemoryDataset"`
+	// 估算总开销与 used_memory_dataset 的比值
+	DatasetRatio float64   `json:"datasetRatio"`
+	AnalysisDate time.Time `json:"analysisDate"`
+}
+
+// reservoir 蓄水池抽样, 在不知道key总数的情况下等概率地抽取size个key
+type reservoir struct {
+	size    int
+	seen    int
+	rng     *rand.Rand
+	samples []*CalibrationSample
+}
+
+func newReservoir(size int) *reservoir {
+	return &reservoir{size: size, rng: rand.New(rand.NewSource(time.Now().UnixNano())), samples: make([]*CalibrationSample, 0, size)}
+}
+
+func (r *reservoir) add(e *entry.Entry) {
+	r.seen++
+	index := len(r.samples)
+	if index >= r.size {
+		if index = r.rng.Intn(r.seen); index >= r.size {
+			return
+		}
+	}
+	sample := &CalibrationSample{Key: e.Key, DbId: e.DbId, Type: e.Type, Encoding: e.Encoding, Estimated: e.Overhead}
+	if index == len(r.samples) {
+		r.samples = append(r.samples, sample)
+	} else {
+		r.samples[index] = sample
+	}
+}
+
+func ExecuteCalibrate(taskInfo *task.GenericTaskInfo) error {
+	calibrateTaskParam, err := taskInfo.CalibrateTaskParam()
+	if err != nil {
+		return err
+	}
+	return Calibrate(calibrateTaskParam)
+}
+
+// Calibrate 解析rdb文件时抽样, 然后到redis中使用 MEMORY USAGE 得到抽样key的实际开销
+func Calibrate(calibrateTaskParam *task.CalibrateTaskParam) error {
+	rdbReader, err := newStatisticReader(&calibrateTaskParam.StatisticTaskParam)
+	if err != nil {
+		return err
+	}
+
+	samples := newReservoir(calibrateTaskParam.SampleSize)
+	var keyCount, expireKeyCount, estimatedTotal uint64
+	for e := range rdbReader.StartRead() {
+		if len(e.Key) == 0 {
+			continue
+		}
+		keyCount++
+		if e.IsExpireKey {
+			expireKeyCount++
+		}
+		estimatedTotal += e.Overhead
+		samples.add(e)
+	}
+	if err = rdbReader.Err(); err != nil {
+		log.Errorf("read rdb error: %v", err)
+		return err
+	}
+	// 与统计任务一样加上全局字典和过期字典rehash的开销
+	estimatedTotal += utils.FieldBucketOverhead(keyCount) + utils.FieldBucketOverhead(expireKeyCount)
+
+	measured, err := measureSamples(samples.samples)
+	if err != nil {
+		return err
+	}
+
+	report := summarizeCalibration(measured)
+	report.EstimatedTotal = estimatedTotal
+	infoMemory, err := utils.GetRedisClient().Info(ctx, "memory").Result()
+	if err != nil {
+		return errors.New("info memory command execute fail: " + err.Error())
+	}
+	report.UsedMemory, _ = strconv.ParseUint(utils.ParseInfoProp(infoMemory, "used_memory"), 10, 64)
+	report.UsedMemoryDataset, _ = strconv.ParseUint(utils.ParseInfoProp(infoMemory, "used_memory_dataset"), 10, 64)
+	if report.UsedMemoryDataset > 0 {
+		report.DatasetRatio = float64(report.EstimatedTotal) / float64(report.UsedMemoryDataset)
+	}
+
+	reportLocker.Lock()
+	calibrationReport = report
+	reportLocker.Unlock()
+	log.Infof("calibration is done, sample count: %d, mean error: %.4f, dataset ratio: %.4f",
+		report.SampleCount, report.Overall.MeanError, report.DatasetRatio)
+	return nil
+}
+
+// measureSamples 按照逻辑库分组, 使用pipeline执行 MEMORY USAGE key SAMPLES 0 得到精确的开销
+// 生成rdb之后被删除的key会被跳过
+func measureSamples(samples []*CalibrationSample) ([]*CalibrationSample, error) {
+	byDb := make(map[int][]*CalibrationSample)
+	for _, sample := range samples {
+		byDb[sample.DbId] = append(byDb[sample.DbId], sample)
+	}
+
+	measured := make([]*CalibrationSample, 0, len(samples))
+	for db, dbSamples := range byDb {
+		options := *utils.GetRedisClient().Options()
+		options.DB = db
+		client := redis.NewClient(&options)
+
+		pipe := client.Pipeline()
+		usageCmds := make([]*redis.IntCmd, len(dbSamples))
+		pttlCmds := make([]*redis.DurationCmd, len(dbSamples))
+		for i, sample := range dbSamples {
+			usageCmds[i] = pipe.MemoryUsage(ctx, sample.Key, 0)
+			pttlCmds[i] = pipe.PTTL(ctx, sample.Key)
+		}
+		_, err := pipe.Exec(ctx)
+		_ = client.Close()
+		var replyError redis.Error
+		if err != nil && !errors.As(err, &replyError) {
+			return nil, errors.Wrapf(err, "memory usage in db %d fail", db)
+		}
+
+		for i, sample := range dbSamples {
+			usage, err := usageCmds[i].Result()
+			if err != nil {
+				continue
+			}
+			sample.Actual = uint64(usage)
+			if pttlCmds[i].Val() >= 0 {
+				sample.Actual += 24
+			}
+			measured = append(measured, sample)
+		}
+	}
+	return measured, nil
+}
+
+// summarizeCalibration 计算整体和每种数据类型的误差分布
+func summarizeCalibration(samples []*CalibrationSample) *CalibrationReport {
+	report := &CalibrationReport{
+		SampleCount:  len(samples),
+		Types:        make(map[string]*ErrorDistribution),
+		AnalysisDate: time.Now(),
+	}
+	byType := make(map[string][]*CalibrationSample)
+	for _, sample := range samples {
+		if sample.Actual > 0 {
+			sample.Error = (float64(sample.Estimated) - float64(sample.Actual)) / float64(sample.Actual)
+		}
+		byType[sample.Type] = append(byType[sample.Type], sample)
+	}
+
+	report.Overall = errorDistribution(samples)
+	for typeName, typeSamples := range byType {
+		report.Types[typeName] = errorDistribution(typeSamples)
+	}
+
+	worst := make([]*CalibrationSample, len(samples))
+	copy(worst, samples)
+	sort.Slice(worst, func(i, j int) bool { return math.Abs(worst[i].Error) > math.Abs(worst[j].Error) })
+	if len(worst) > 20 {
+		worst = worst[:20]
+	}
+	report.WorstSamples = worst
+	return report
+}
+
+func errorDistribution(samples []*CalibrationSample) *ErrorDistribution {
+	distribution := &ErrorDistribution{Count: len(samples)}
+	if len(samples) == 0 {
+		return distribution
+	}
+	errs := make([]float64, len(samples))
+	var sum, absSum float64
+	for i, sample := range samples {
+		errs[i] = sample.Error
+		sum += sample.Error
+		absSum += math.Abs(sample.Error)
+		distribution.EstimatedTotal += sample.Estimated
+		distribution.ActualTotal += sample.Actual
+	}
+	sort.Float64s(errs)
+	percentile := func(p float64) float64 {
+		return errs[int(math.Ceil(p*float64(len(errs))))-1]
+	}
+	distribution.MeanError = sum / float64(len(errs))
+	distribution.MeanAbsError = absSum / float64(len(errs))
+	distribution.MinError = errs[0]
+	distribution.P50Error = percentile(0.5)
+	distribution.P90Error = percentile(0.9)
+	distribution.P99Error = percentile(0.99)
+	distribution.MaxError = errs[len(errs)-1]
+	return distribution
+}
+
+// GetCalibrationReport 最近一次校准的结果
+func GetCalibrationReport() *CalibrationReport {
+	reportLocker.RLock()
+	defer reportLocker.RUnlock()
+	return calibrationReport
+}
@@ -0,0 +1,51 @@
+package memanalysis
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/leijianzhong001/redis_agent/internal/entry"
+)
+
+func TestReservoir(t *testing.T) {
+	r := newReservoir(10)
+	for i := 0; i < 1000; i++ {
+		e := entry.NewEntry()
+		e.Key = fmt.Sprintf("key%d", i)
+		r.add(e)
+	}
+	if len(r.samples) != 10 || r.seen != 1000 {
+		t.Fatalf("samples = %d, seen = %d", len(r.samples), r.seen)
+	}
+	keys := make(map[string]bool)
+	for _, sample := range r.samples {
+		keys[sample.Key] = true
+	}
+	if len(keys) != 10 {
+		t.Errorf("samples should be distinct: %v", keys)
+	}
+}
+
+func TestSummarizeCalibration(t *testing.T) {
+	samples := []*CalibrationSample{
+		{Key: "a", Type: "string", Estimated: 110, Actual: 100},
+		{Key: "b", Type: "string", Estimated: 90, Actual: 100},
+		{Key: "c", Type: "hash", Estimated: 150, Actual: 100},
+		{Key: "d", Type: "hash", Estimated: 100, Actual: 100},
+	}
+	report := summarizeCalibration(samples)
+	if report.SampleCount != 4 || report.WorstSamples[0].Key != "c" {
+		t.Fatalf("report = %+v", report)
+	}
+	str := report.Types["string"]
+	if str.Count != 2 || str.MeanError > 1e-9 || str.MeanAbsError < 0.1-1e-9 || str.MeanAbsError > 0.1+1e-9 {
+		t.Errorf("string distribution = %+v", str)
+	}
+	if str.EstimatedTotal != 200 || str.ActualTotal != 200 {
+		t.Errorf("string totals = %d/%d", str.EstimatedTotal, str.ActualTotal)
+	}
+	overall := report.Overall
+	if overall.MinError > -0.1+1e-9 || overall.MaxError < 0.5-1e-9 || overall.P50Error != 0 {
+		t.Errorf("overall distribution = %+v", overall)
+	}
+}
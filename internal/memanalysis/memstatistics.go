@@ -3,17 +3,37 @@ package memanalysis
 import (
 	"context"
 	"encoding/json"
+	"github.com/leijianzhong001/redis_agent/internal/config"
+	"github.com/leijianzhong001/redis_agent/internal/entry"
+	"github.com/leijianzhong001/redis_agent/internal/rdb"
+	"github.com/leijianzhong001/redis_agent/internal/rdb/types"
 	"github.com/leijianzhong001/redis_agent/internal/reader"
 	"github.com/leijianzhong001/redis_agent/internal/utils"
+	"github.com/leijianzhong001/redis_agent/task"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var ctx = context.Background()
+
+// reportLocker 保护下面这些最近一次分析的结果, 任务执行完成时整体替换, http接口同时在读取
+// 结果替换之后不再修改, 读取时只需要在取得引用时持有读锁
+var reportLocker sync.RWMutex
+
 var userAndOverhead map[string]*UserOverhead
 
+// prefixTree 最近一次统计的前缀树
+var prefixTree *PrefixTree
+
+// bigKeyReport 最近一次统计的大key
+var bigKeyReport *BigKeyReport
+
 // UserOverhead 用户和开销数据
 type UserOverhead struct {
 	// 用户
@@ -24,41 +44,108 @@ type UserOverhead struct {
 	ExpireKeyCount uint64 `json:"expireKeyCount"`
 	// 当前用户的内存开销
 	Overhead uint64 `json:"overhead"`
+	// 按照数据类型(string/list/hash/set/zset/stream/module)统计的开销
+	Types map[string]*OverheadStat `json:"types"`
+	// 按照逻辑库统计的开销
+	Dbs map[int]*DbOverhead `json:"dbs"`
 	// 内存分析时间
 	AnalysisDate time.Time `json:"analysisDate"`
 }
 
-func ExecuteStatistic() error {
-	return Statistic()
+// OverheadStat 某一类key的数量和内存开销, 不包含全局字典rehash的开销, 所以各类的总和略小于 UserOverhead.Overhead
+type OverheadStat struct {
+	// key数量
+	KeyCount uint64 `json:"keyCount"`
+	// 过期key数量
+	ExpireKeyCount uint64 `json:"expireKeyCount"`
+	// 内存开销
+	Overhead uint64 `json:"overhead"`
 }
 
-func Statistic() error {
-	userAndOverheadTemp := make(map[string]*UserOverhead, 16)
-	// 到从节点上 dump rdb 文件
-	err := dumpRdb()
+// DbOverhead 用户在某个逻辑库中的开销
+type DbOverhead struct {
+	OverheadStat
+	// 当前逻辑库中按照数据类型统计的开销
+	Types map[string]*OverheadStat `json:"types"`
+}
+
+func (stat *OverheadStat) add(e *entry.Entry) {
+	stat.KeyCount++
+	stat.Overhead += e.Overhead
+	if e.IsExpireKey {
+		stat.ExpireKeyCount++
+	}
+}
+
+// typeStat 得到数据类型对应的统计, 不存在时初始化
+func typeStat(typeStats map[string]*OverheadStat, typeName string) *OverheadStat {
+	stat, ok := typeStats[typeName]
+	if !ok {
+		stat = &OverheadStat{}
+		typeStats[typeName] = stat
+	}
+	return stat
+}
+
+// addBreakdown 按照数据类型和逻辑库累加entry的开销
+func (userOverhead *UserOverhead) addBreakdown(e *entry.Entry) {
+	typeStat(userOverhead.Types, e.Type).add(e)
+
+	dbOverhead, ok := userOverhead.Dbs[e.DbId]
+	if !ok {
+		dbOverhead = &DbOverhead{Types: make(map[string]*OverheadStat)}
+		userOverhead.Dbs[e.DbId] = dbOverhead
+	}
+	dbOverhead.add(e)
+	typeStat(dbOverhead.Types, e.Type).add(e)
+}
+
+func ExecuteStatistic(taskInfo *task.GenericTaskInfo) error {
+	statisticTaskParam, err := taskInfo.StatisticTaskParam()
+	if err != nil {
+		return err
+	}
+	users, err := Statistic(statisticTaskParam)
 	if err != nil {
-		log.Errorf("dump rdb error: %v", err)
 		return err
 	}
-	log.Infof("dump rdb success")
+	// 任务结果中保存本次的统计结果, 汇总任务从这里获取分片的结果, 不会读到其他统计任务的结果
+	taskInfo.UpdateResult(func() {
+		taskInfo.TaskResult = users
+	})
+	return nil
+}
+
+// Statistic 执行内存统计, 完成之后替换最近一次的统计结果, 并返回本次每个用户的开销
+func Statistic(statisticTaskParam *task.StatisticTaskParam) (map[string]*UserOverhead, error) {
+	userAndOverheadTemp := make(map[string]*UserOverhead, 16)
+	prefixTreeTemp := NewPrefixTree(statisticTaskParam.TreeDelimiter, statisticTaskParam.TreeDepth, statisticTaskParam.TreeMaxChildren)
+	bigKeyCollector := NewBigKeyCollector(statisticTaskParam.BigKeyTopN)
+	attributor, err := ParseAttributionRules(statisticTaskParam.AttributionRules)
+	if err != nil {
+		return nil, err
+	}
 
-	// 从/data下读取dump.rdb文件
-	rdbReader := reader.NewRDBReader("/data/dump.rdb")
+	rdbReader, err := newStatisticReader(statisticTaskParam)
+	if err != nil {
+		return nil, err
+	}
 	// 从这里接收key和value
 	ch := rdbReader.StartRead()
 	for entry := range ch {
-		key := entry.Key
-		if len(key) == 0 || !strings.ContainsRune(key, ':') || len(strings.Split(key, ":")) < 2 {
-			log.Warnf("key %s is not match *:*, skip", key)
+		if len(entry.Key) == 0 {
+			// 函数库、lua脚本等不属于任何用户
 			continue
 		}
 
-		// userName
-		userName := strings.Split(key, ":")[0]
+		// userName, 没有匹配任何规则的key统计到 UnattributedUser 下
+		userName, _ := attributor.Attribute(entry.Key)
 		if _, ok := userAndOverheadTemp[userName]; !ok {
 			// 为空的话, 初始化一下
 			userAndOverheadTemp[userName] = &UserOverhead{
 				UserName:     userName,
+				Types:        make(map[string]*OverheadStat),
+				Dbs:          make(map[int]*DbOverhead),
 				AnalysisDate: time.Now(),
 			}
 		}
@@ -69,6 +156,15 @@ func Statistic() error {
 		if entry.IsExpireKey {
 			userOverhead.ExpireKeyCount++
 		}
+		userOverhead.addBreakdown(entry)
+		prefixTreeTemp.Add(entry.Key, entry.Overhead)
+		bigKeyCollector.Add(userName, entry)
+	}
+
+	// 读取过程中出错时, 本次的统计结果是不完整的, 不能替换原来的统计结果
+	if err = rdbReader.Err(); err != nil {
+		log.Errorf("read rdb error: %v", err)
+		return nil, err
 	}
 
 	// 计算每个系统的key的rehash的开销
@@ -79,13 +175,48 @@ func Statistic() error {
 
 	log.Infof("memory analysis is done, replace variable userAndOverhead")
 	// 完成以后,替换原来的统计结果
+	bigKeys := bigKeyCollector.Report()
+	reportLocker.Lock()
 	userAndOverhead = userAndOverheadTemp
+	prefixTree = prefixTreeTemp
+	bigKeyReport = bigKeys
+	reportLocker.Unlock()
+	saveSnapshot(userAndOverheadTemp, bigKeys)
+	checkQuotas(userAndOverheadTemp)
+	log.Infof("prefix tree is built, prefix count: %d", prefixTreeTemp.PrefixCount())
 
-	for sys, overhead := range userAndOverhead {
+	for sys, overhead := range userAndOverheadTemp {
 		data, _ := json.Marshal(overhead)
 		log.Infof("sys: %s, overhead: %s", sys, data)
 	}
-	return nil
+	return userAndOverheadTemp, nil
+}
+
+// newStatisticReader 根据统计模式创建reader, 两种模式产生的entry是一致的
+func newStatisticReader(statisticTaskParam *task.StatisticTaskParam) (reader.Reader, error) {
+	if statisticTaskParam.IsScanMode() {
+		return reader.NewScanReader(reader.ScanOptions{
+			Count:    statisticTaskParam.ScanCount,
+			Interval: time.Duration(statisticTaskParam.ScanInterval) * time.Millisecond,
+			Samples:  statisticTaskParam.MemoryUsageSamples,
+		}), nil
+	}
+
+	rdbPath, err := prepareRdb(statisticTaskParam)
+	if err != nil {
+		return nil, err
+	}
+
+	// 按照实例的紧凑编码阈值和版本计算内存开销, rdb文件中的redis-ver辅助字段会覆盖这里选择的内存模型
+	types.SetEncodingConfig(loadEncodingConfig())
+
+	return reader.NewRDBReader(rdbPath, rdb.LoaderOptions{
+		Workers: statisticTaskParam.Workers,
+		Ordered: statisticTaskParam.Ordered,
+		// 分析已经存在的rdb文件时不依赖本地redis的角色
+		SkipRoleCheck: statisticTaskParam.UseExistingRdb(),
+		MemProfile:    loadMemProfile(),
+	})
 }
 
 // keyRehashOverhead 计算key的rehash开销
@@ -128,6 +259,98 @@ func expireKeyRehashOverhead(userAndOverheadTemp map[string]*UserOverhead) {
 	}
 }
 
+// 以下步骤依赖redis, 测试时替换
+var (
+	dumpRdbFunc   = dumpRdb
+	configGetFunc = func(name string) ([]interface{}, error) {
+		return utils.GetRedisClient().ConfigGet(ctx, name).Result()
+	}
+)
+
+// prepareRdb 准备需要分析的rdb文件, 返回文件路径
+// 默认到从节点上执行bgsave, 然后分析/data下的dump.rdb文件; 指定了rdbPath或者skipBgsave时直接分析已经存在的rdb文件
+// rdbPath由http请求传入, 只允许位于 statistic.rdb_dirs 配置的目录下, 避免任意调用方读取主机上的文件
+func prepareRdb(statisticTaskParam *task.StatisticTaskParam) (string, error) {
+	if !statisticTaskParam.UseExistingRdb() {
+		// 到从节点上 dump rdb 文件
+		if err := dumpRdbFunc(); err != nil {
+			log.Errorf("dump rdb error: %v", err)
+			return "", err
+		}
+		log.Infof("dump rdb success")
+		// 从/data下读取dump.rdb文件
+		return "/data/dump.rdb", nil
+	}
+
+	rdbPath := statisticTaskParam.RdbPath
+	var err error
+	if rdbPath == "" {
+		// redis自身配置的路径不需要限制目录
+		if rdbPath, err = configRdbPath(); err != nil {
+			return "", err
+		}
+	} else if rdbPath, err = allowedRdbPath(rdbPath, config.Agent.Statistic.RdbDirs); err != nil {
+		return "", err
+	}
+	fileInfo, err := os.Stat(rdbPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "rdb file %s is not available", rdbPath)
+	}
+	if fileInfo.IsDir() {
+		return "", errors.Errorf("rdb path %s is a directory", rdbPath)
+	}
+	log.Infof("skip bgsave, analyze existing rdb file %s, size: %d, modified at: %s", rdbPath, fileInfo.Size(), fileInfo.ModTime())
+	return rdbPath, nil
+}
+
+// configRdbPath 根据 CONFIG GET dir 和 CONFIG GET dbfilename 得到redis当前的rdb文件路径
+func configRdbPath() (string, error) {
+	configValue := func(name string) (string, error) {
+		result, err := configGetFunc(name)
+		if err != nil {
+			return "", errors.New("config get " + name + " command execute fail: " + err.Error())
+		}
+		if len(result) < 2 {
+			return "", errors.New("config get " + name + " returns nothing")
+		}
+		value, _ := result[1].(string)
+		return value, nil
+	}
+
+	dir, err := configValue("dir")
+	if err != nil {
+		return "", err
+	}
+	dbFilename, err := configValue("dbfilename")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, dbFilename), nil
+}
+
+// allowedRdbPath 解析符号链接之后的rdbPath必须位于allowedDirs中的某个目录下, 返回解析之后的路径
+func allowedRdbPath(rdbPath string, allowedDirs []string) (string, error) {
+	absPath, err := filepath.Abs(rdbPath)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "rdb file %s is not available", rdbPath)
+	}
+	for _, dir := range allowedDirs {
+		realDir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(realDir, realPath)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return realPath, nil
+		}
+	}
+	return "", errors.Errorf("rdb path %s is not under the allowed directories %v", rdbPath, allowedDirs)
+}
+
 // dumpRdb 到从节点上dump rdb文件
 func dumpRdb() error {
 	client := utils.GetRedisClient()
@@ -173,6 +396,95 @@ func dumpRdb() error {
 	return nil
 }
 
+// loadMemProfile 根据 INFO server 中的 redis_version 选择内存模型
+func loadMemProfile() *utils.MemProfile {
+	infoServer, err := utils.GetRedisClient().Info(ctx, "Server").Result()
+	if err != nil {
+		log.Warnf("info Server command execute fail, use default memory profile. error: %v", err)
+		return utils.MemProfileForVersion("")
+	}
+	version := utils.ParseInfoProp(infoServer, "redis_version")
+	profile := utils.MemProfileForVersion(version)
+	log.Infof("redis version: %s, use memory profile %s", version, profile.Name)
+	return profile
+}
+
+// loadEncodingConfig 从实例中读取紧凑编码的阈值配置, 读取失败的配置项使用默认值
+// 7.0之后的 *-max-listpack-* 配置项仍然可以通过 *-max-ziplist-* 的别名读取
+func loadEncodingConfig() types.EncodingConfig {
+	client := utils.GetRedisClient()
+	config := types.DefaultEncodingConfig
+	readConfig := func(name string, apply func(value string) error) {
+		result, err := client.ConfigGet(ctx, name).Result()
+		if err != nil || len(result) < 2 {
+			log.Warnf("config get %s fail, use default value. error: %v", name, err)
+			return
+		}
+		value, _ := result[1].(string)
+		if err = apply(value); err != nil {
+			log.Warnf("config %s has invalid value %s, use default value. error: %v", name, value, err)
+		}
+	}
+	readUint := func(target *uint64) func(value string) error {
+		return func(value string) error {
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err == nil {
+				*target = v
+			}
+			return err
+		}
+	}
+
+	readConfig("hash-max-ziplist-entries", readUint(&config.HashMaxEntries))
+	readConfig("hash-max-ziplist-value", readUint(&config.HashMaxValue))
+	readConfig("zset-max-ziplist-entries", readUint(&config.ZsetMaxEntries))
+	readConfig("zset-max-ziplist-value", readUint(&config.ZsetMaxValue))
+	readConfig("set-max-intset-entries", readUint(&config.SetMaxIntsetEntries))
+	readConfig("list-max-ziplist-size", func(value string) error {
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err == nil {
+			config.ListMaxSize = v
+		}
+		return err
+	})
+	return config
+}
+
 func GetUserAndOverhead() map[string]*UserOverhead {
+	reportLocker.RLock()
+	defer reportLocker.RUnlock()
 	return userAndOverhead
 }
+
+// GetBigKeys 查询最近一次统计的大key, userName为空时返回全局的大key
+func GetBigKeys(userName string) (*BigKeyRank, error) {
+	reportLocker.RLock()
+	report := bigKeyReport
+	reportLocker.RUnlock()
+	if report == nil {
+		return nil, errors.New("no statistic result yet, please execute a statistic task first")
+	}
+	if userName == "" {
+		return report.Overall, nil
+	}
+	rank, ok := report.Users[userName]
+	if !ok {
+		return nil, errors.Errorf("user %s not found", userName)
+	}
+	return rank, nil
+}
+
+// GetPrefixOverhead 查询最近一次统计中前缀及其下一层前缀的开销
+func GetPrefixOverhead(prefix string) (*PrefixOverhead, error) {
+	reportLocker.RLock()
+	tree := prefixTree
+	reportLocker.RUnlock()
+	if tree == nil {
+		return nil, errors.New("no statistic result yet, please execute a statistic task first")
+	}
+	prefixOverhead, ok := tree.Drill(prefix)
+	if !ok {
+		return nil, errors.Errorf("prefix %s not found", prefix)
+	}
+	return prefixOverhead, nil
+}
@@ -0,0 +1,142 @@
+package memanalysis
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/leijianzhong001/redis_agent/internal/config"
+	"github.com/leijianzhong001/redis_agent/internal/entry"
+	"github.com/leijianzhong001/redis_agent/task"
+)
+
+func TestAddBreakdown(t *testing.T) {
+	userOverhead := &UserOverhead{Types: make(map[string]*OverheadStat), Dbs: make(map[int]*DbOverhead)}
+	add := func(dbId int, typeName string, overhead uint64, expire bool) {
+		e := entry.NewEntry()
+		e.DbId = dbId
+		e.Type = typeName
+		e.Overhead = overhead
+		e.IsExpireKey = expire
+		userOverhead.addBreakdown(e)
+	}
+	add(0, "hash", 100, false)
+	add(0, "hash", 200, true)
+	add(3, "zset", 50, false)
+	add(3, "hash", 10, false)
+
+	if hash := userOverhead.Types["hash"]; hash.KeyCount != 3 || hash.Overhead != 310 || hash.ExpireKeyCount != 1 {
+		t.Errorf("hash = %+v", hash)
+	}
+	db3 := userOverhead.Dbs[3]
+	if db3.KeyCount != 2 || db3.Overhead != 60 || db3.Types["zset"].Overhead != 50 || db3.Types["hash"].KeyCount != 1 {
+		t.Errorf("db3 = %+v", db3)
+	}
+	if _, ok := userOverhead.Dbs[0].Types["zset"]; ok {
+		t.Errorf("db0 should not have zset")
+	}
+}
+
+// fakeRdbEnv 替换依赖redis的步骤, dumped记录是否执行了bgsave
+func fakeRdbEnv(dir string) (dumped *bool, restore func()) {
+	dumped = new(bool)
+	oldDump, oldConfigGet, oldDirs := dumpRdbFunc, configGetFunc, config.Agent.Statistic.RdbDirs
+	dumpRdbFunc = func() error {
+		*dumped = true
+		return nil
+	}
+	configGetFunc = func(name string) ([]interface{}, error) {
+		switch name {
+		case "dir":
+			return []interface{}{"dir", dir}, nil
+		case "dbfilename":
+			return []interface{}{"dbfilename", "dump-6379.rdb"}, nil
+		}
+		return nil, errors.New("unexpected config " + name)
+	}
+	config.Agent.Statistic.RdbDirs = []string{dir}
+	return dumped, func() {
+		dumpRdbFunc, configGetFunc, config.Agent.Statistic.RdbDirs = oldDump, oldConfigGet, oldDirs
+	}
+}
+
+func TestPrepareRdb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+	configRdb := filepath.Join(dir, "dump-6379.rdb")
+	backupRdb := filepath.Join(dir, "backup.rdb")
+	for _, file := range []string{configRdb, backupRdb} {
+		if err = ioutil.WriteFile(file, []byte("REDIS0009"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dumped, restore := fakeRdbEnv(dir)
+	defer restore()
+
+	// 默认执行bgsave, 分析/data下的dump.rdb
+	path, err := prepareRdb(&task.StatisticTaskParam{})
+	if err != nil || path != "/data/dump.rdb" || !*dumped {
+		t.Errorf("prepareRdb() = %s, %v, dumped = %v", path, err, *dumped)
+	}
+
+	// skipBgsave时通过 CONFIG GET dir + dbfilename 得到路径
+	*dumped = false
+	path, err = prepareRdb(&task.StatisticTaskParam{SkipBgsave: true})
+	if err != nil || path != configRdb || *dumped {
+		t.Errorf("prepareRdb(skipBgsave) = %s, %v, dumped = %v", path, err, *dumped)
+	}
+
+	// 指定rdbPath时总是跳过bgsave
+	path, err = prepareRdb(&task.StatisticTaskParam{RdbPath: backupRdb})
+	if err != nil || path != backupRdb || *dumped {
+		t.Errorf("prepareRdb(rdbPath) = %s, %v, dumped = %v", path, err, *dumped)
+	}
+
+	invalid := []string{
+		dir,                               // 目录
+		filepath.Join(dir, "missing.rdb"), // 不存在
+		"/etc/passwd",                     // 不在允许的目录下
+	}
+	for _, rdbPath := range invalid {
+		if path, err = prepareRdb(&task.StatisticTaskParam{RdbPath: rdbPath}); err == nil {
+			t.Errorf("prepareRdb(%s) = %s, want error", rdbPath, path)
+		}
+	}
+}
+
+func TestAllowedRdbPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	root, _ = filepath.EvalSymlinks(root)
+	allowed := filepath.Join(root, "data")
+	other := filepath.Join(root, "data2")
+	os.Mkdir(allowed, 0755)
+	os.Mkdir(other, 0755)
+	ioutil.WriteFile(filepath.Join(allowed, "dump.rdb"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(other, "dump.rdb"), nil, 0644)
+	// 允许的目录下指向其他目录的符号链接
+	os.Symlink(filepath.Join(other, "dump.rdb"), filepath.Join(allowed, "link.rdb"))
+
+	if path, err := allowedRdbPath(filepath.Join(allowed, "dump.rdb"), []string{allowed}); err != nil || path != filepath.Join(allowed, "dump.rdb") {
+		t.Errorf("allowedRdbPath() = %s, %v", path, err)
+	}
+	rejected := []string{
+		filepath.Join(other, "dump.rdb"),                  // 前缀相同的其他目录
+		filepath.Join(allowed, "..", "data2", "dump.rdb"), // ..
+		filepath.Join(allowed, "link.rdb"),                // 符号链接
+	}
+	for _, rdbPath := range rejected {
+		if path, err := allowedRdbPath(rdbPath, []string{allowed}); err == nil {
+			t.Errorf("allowedRdbPath(%s) = %s, want error", rdbPath, path)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package memanalysis
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leijianzhong001/redis_agent/internal/rax"
+)
+
+// DefaultTreeDelimiter 前缀树默认的分隔符
+const DefaultTreeDelimiter = ":"
+
+// DefaultTreeDepth 前缀树默认统计的层数, 层数越多不同前缀的数量越多, 占用的内存也越多
+const DefaultTreeDepth = 4
+
+// DefaultTreeMaxChildren 前缀树每个前缀下默认最多统计的下一层前缀数量
+// 如 user1:order:<id>: 这样包含id的前缀, 不限制的话前缀的数量会随着key的数量增长
+const DefaultTreeMaxChildren = 1000
+
+// OtherPrefix 下一层前缀的数量达到上限之后, 新出现的前缀都合并到这个前缀中, 不再向下统计
+const OtherPrefix = "<other>"
+
+// PrefixOverhead 某个前缀下所有key的数量和内存开销
+type PrefixOverhead struct {
+	// 前缀, 以分隔符结尾, 如 user1:order:
+	Prefix string `json:"prefix"`
+	// key数量
+	KeyCount uint64 `json:"keyCount"`
+	// 内存开销, 不包含全局字典rehash的开销
+	Overhead uint64 `json:"overhead"`
+	// 下一层的前缀, 按照内存开销从大到小排序, 只在查询时填充
+	Children []*PrefixOverhead `json:"children,omitempty"`
+	// 下一层前缀的数量, 不包括 OtherPrefix
+	childCount int
+}
+
+// PrefixTree 按照分隔符把key切分成多层前缀, 在每一层前缀上累加key数量和内存开销
+// 如 user1:order:1 会累加到 user1: 和 user1:order: 两个前缀上
+type PrefixTree struct {
+	delimiter   string
+	maxDepth    int
+	maxChildren int
+	// 前缀 => *PrefixOverhead
+	tree *rax.Rax
+	// 根节点, 统计所有key
+	root PrefixOverhead
+	// 内存分析时间
+	AnalysisDate time.Time
+}
+
+// NewPrefixTree delimiter为空或者maxDepth、maxChildren不大于0时使用默认值
+func NewPrefixTree(delimiter string, maxDepth int, maxChildren int) *PrefixTree {
+	if delimiter == "" {
+		delimiter = DefaultTreeDelimiter
+	}
+	if maxDepth <= 0 {
+		maxDepth = DefaultTreeDepth
+	}
+	if maxChildren <= 0 {
+		maxChildren = DefaultTreeMaxChildren
+	}
+	return &PrefixTree{
+		delimiter:    delimiter,
+		maxDepth:     maxDepth,
+		maxChildren:  maxChildren,
+		tree:         rax.New(),
+		AnalysisDate: time.Now(),
+	}
+}
+
+// Add 把key的内存开销累加到它的每一层前缀上, 最多累加maxDepth层
+// 一个前缀下的前缀数量达到maxChildren之后, 新的前缀累加到 OtherPrefix 上, 并且不再向下累加
+func (t *PrefixTree) Add(key string, overhead uint64) {
+	t.root.KeyCount++
+	t.root.Overhead += overhead
+
+	parent := &t.root
+	end := 0
+	for depth := 0; depth < t.maxDepth; depth++ {
+		index := strings.Index(key[end:], t.delimiter)
+		if index < 0 {
+			break
+		}
+		end += index + len(t.delimiter)
+		prefix := key[:end]
+		value, ok := t.tree.Find(prefix)
+		folded := false
+		if !ok {
+			if parent.childCount >= t.maxChildren {
+				prefix = parent.Prefix + OtherPrefix + t.delimiter
+				value, ok = t.tree.Find(prefix)
+				folded = true
+			} else {
+				parent.childCount++
+			}
+			if !ok {
+				value = &PrefixOverhead{Prefix: prefix}
+				t.tree.Insert(prefix, value)
+			}
+		}
+		prefixOverhead := value.(*PrefixOverhead)
+		prefixOverhead.KeyCount++
+		prefixOverhead.Overhead += overhead
+		if folded {
+			break
+		}
+		parent = prefixOverhead
+	}
+}
+
+// Drill 查询前缀的统计结果和它下一层的所有前缀, prefix为空时从根节点开始
+// prefix可以省略末尾的分隔符, 如 user1:order 与 user1:order: 等价
+func (t *PrefixTree) Drill(prefix string) (*PrefixOverhead, bool) {
+	var current PrefixOverhead
+	if prefix == "" {
+		current = t.root
+	} else {
+		value, ok := t.tree.Find(prefix)
+		if !ok && !strings.HasSuffix(prefix, t.delimiter) {
+			prefix += t.delimiter
+			value, ok = t.tree.Find(prefix)
+		}
+		if !ok {
+			return nil, false
+		}
+		current = *value.(*PrefixOverhead)
+	}
+
+	current.Children = make([]*PrefixOverhead, 0)
+	t.tree.WalkPrefix(prefix, func(key string, value interface{}) bool {
+		// 只保留剩余部分恰好以一个分隔符结尾的前缀, 即下一层
+		rest := key[len(prefix):]
+		if rest != "" && strings.Index(rest, t.delimiter) == len(rest)-len(t.delimiter) {
+			child := *value.(*PrefixOverhead)
+			current.Children = append(current.Children, &child)
+		}
+		return true
+	})
+	sort.Slice(current.Children, func(i, j int) bool {
+		return current.Children[i].Overhead > current.Children[j].Overhead
+	})
+	return &current, true
+}
+
+// PrefixCount 不同前缀的数量
+func (t *PrefixTree) PrefixCount() uint64 {
+	return t.tree.Len()
+}
@@ -0,0 +1,82 @@
+package memanalysis
+
+import "testing"
+
+func TestPrefixTree(t *testing.T) {
+	tree := NewPrefixTree(":", 2, 0)
+	tree.Add("user1:order:1", 100)
+	tree.Add("user1:order:2", 100)
+	tree.Add("user1:cart:1", 50)
+	tree.Add("user1:a:b:c:d", 10)
+	tree.Add("user2:x", 1)
+	tree.Add("plain", 7)
+
+	root, ok := tree.Drill("")
+	if !ok || root.KeyCount != 6 || root.Overhead != 268 {
+		t.Fatalf("Drill(\"\") = %+v", root)
+	}
+	if len(root.Children) != 2 || root.Children[0].Prefix != "user1:" || root.Children[0].Overhead != 260 {
+		t.Fatalf("root children = %+v", root.Children)
+	}
+
+	user1, ok := tree.Drill("user1")
+	if !ok || user1.Prefix != "user1:" || user1.KeyCount != 4 {
+		t.Fatalf("Drill(user1) = %+v", user1)
+	}
+	var prefixes []string
+	for _, child := range user1.Children {
+		prefixes = append(prefixes, child.Prefix)
+	}
+	if len(prefixes) != 3 || prefixes[0] != "user1:order:" || prefixes[1] != "user1:cart:" || prefixes[2] != "user1:a:" {
+		t.Errorf("user1 children = %v", prefixes)
+	}
+
+	// 超过深度的前缀不统计
+	if _, ok = tree.Drill("user1:a:b:"); ok {
+		t.Errorf("user1:a:b: exceeds max depth")
+	}
+	if _, ok = tree.Drill("user3:"); ok {
+		t.Errorf("user3: should not exist")
+	}
+	if tree.PrefixCount() != 5 {
+		t.Errorf("PrefixCount() = %d, want 5", tree.PrefixCount())
+	}
+}
+
+func TestPrefixTreeMaxChildren(t *testing.T) {
+	tree := NewPrefixTree(":", 4, 2)
+	tree.Add("user1:order:1:a", 10)
+	tree.Add("user1:order:2:a", 10)
+	tree.Add("user1:order:1:b", 10)
+	// user1:order: 下已经有两个前缀, 新的id合并到 <other> 中, 并且不再向下统计
+	tree.Add("user1:order:3:a", 20)
+	tree.Add("user1:order:4:a", 30)
+	tree.Add("user1:cart:1", 5)
+	tree.Add("user2:x", 1)
+	tree.Add("user3:x", 1)
+
+	order, ok := tree.Drill("user1:order")
+	if !ok || order.KeyCount != 5 || order.Overhead != 80 {
+		t.Fatalf("Drill(user1:order) = %+v", order)
+	}
+	if len(order.Children) != 3 || order.Children[0].Prefix != "user1:order:<other>:" || order.Children[0].KeyCount != 2 || order.Children[0].Overhead != 50 {
+		t.Fatalf("user1:order children = %+v", order.Children)
+	}
+	if _, ok = tree.Drill("user1:order:3:"); ok {
+		t.Errorf("user1:order:3: should be folded into <other>")
+	}
+	if _, ok = tree.Drill("user1:order:<other>:a:"); ok {
+		t.Errorf("<other> should not have children")
+	}
+
+	// 根节点下同样限制, 所有key仍然计入总量
+	root, _ := tree.Drill("")
+	other, ok := tree.Drill(OtherPrefix)
+	if root.KeyCount != 8 || len(root.Children) != 3 || !ok || other.Prefix != "<other>:" || other.KeyCount != 1 {
+		t.Errorf("root = %+v, other = %+v", root, other)
+	}
+	// user1:, user2:, <other>:, user1:order:, user1:cart:, user1:order:1:, user1:order:2:, user1:order:<other>:
+	if tree.PrefixCount() != 8 {
+		t.Errorf("PrefixCount() = %d, want 8", tree.PrefixCount())
+	}
+}
@@ -0,0 +1,150 @@
+package memanalysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/leijianzhong001/redis_agent/internal/config"
+	"github.com/leijianzhong001/redis_agent/internal/utils"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// 配额的类型
+const (
+	QuotaBytes     = "bytes"
+	QuotaKeys      = "keys"
+	QuotaMaxMemory = "maxmemory"
+)
+
+// DefaultQuotaUser 对没有单独配置配额的用户生效的配额, 不包括 UnattributedUser
+const DefaultQuotaUser = "*"
+
+// QuotaViolation 用户超出配额的记录
+type QuotaViolation struct {
+	UserName string `json:"userName"`
+	// 超出的配额类型 bytes/keys/maxmemory
+	Kind string `json:"kind"`
+	// 配额, maxmemory类型为按照比例换算之后的字节数
+	Limit uint64 `json:"limit"`
+	// 实际值
+	Actual uint64 `json:"actual"`
+}
+
+// QuotaReport 最近一次配额检查的结果
+type QuotaReport struct {
+	Violations  []*QuotaViolation `json:"violations"`
+	EvaluatedAt time.Time         `json:"evaluatedAt"`
+}
+
+var quotaReport *QuotaReport
+
+var webhookHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+// EvaluateQuotas 检查每个用户是否超出配额, maxmemory为0时不检查maxmemory比例
+func EvaluateQuotas(users map[string]*UserOverhead, quotas []config.TenantQuota, maxmemory uint64) []*QuotaViolation {
+	quotaOfUser := make(map[string]config.TenantQuota, len(quotas))
+	for _, quota := range quotas {
+		quotaOfUser[quota.UserName] = quota
+	}
+	defaultQuota, hasDefault := quotaOfUser[DefaultQuotaUser]
+
+	violations := make([]*QuotaViolation, 0)
+	for userName, userOverhead := range users {
+		quota, ok := quotaOfUser[userName]
+		if !ok {
+			// 未归属的key来自多个用户, 默认配额是针对单个用户的, 只检查为它单独配置的配额
+			if !hasDefault || userName == UnattributedUser {
+				continue
+			}
+			quota = defaultQuota
+		}
+		if quota.MaxBytes > 0 && userOverhead.Overhead > quota.MaxBytes {
+			violations = append(violations, &QuotaViolation{UserName: userName, Kind: QuotaBytes, Limit: quota.MaxBytes, Actual: userOverhead.Overhead})
+		}
+		if quota.MaxKeys > 0 && userOverhead.KeyCount > quota.MaxKeys {
+			violations = append(violations, &QuotaViolation{UserName: userName, Kind: QuotaKeys, Limit: quota.MaxKeys, Actual: userOverhead.KeyCount})
+		}
+		if quota.MaxMemoryRatio > 0 && maxmemory > 0 {
+			limit := uint64(float64(maxmemory) * quota.MaxMemoryRatio)
+			if userOverhead.Overhead > limit {
+				violations = append(violations, &QuotaViolation{UserName: userName, Kind: QuotaMaxMemory, Limit: limit, Actual: userOverhead.Overhead})
+			}
+		}
+	}
+	sort.Slice(violations, func(i, j int) bool {
+		if violations[i].UserName != violations[j].UserName {
+			return violations[i].UserName < violations[j].UserName
+		}
+		return violations[i].Kind < violations[j].Kind
+	})
+	return violations
+}
+
+// checkQuotas 每次统计完成之后检查配额, 有用户超出配额并且配置了webhook时发送通知
+func checkQuotas(users map[string]*UserOverhead) {
+	quotaConfig := config.Agent.Quota
+	if len(quotaConfig.Tenants) == 0 {
+		return
+	}
+
+	report := &QuotaReport{
+		Violations:  EvaluateQuotas(users, quotaConfig.Tenants, loadMaxmemory()),
+		EvaluatedAt: time.Now(),
+	}
+	reportLocker.Lock()
+	quotaReport = report
+	reportLocker.Unlock()
+	log.Infof("quota evaluation is done, violation count: %d", len(report.Violations))
+
+	if len(report.Violations) == 0 || quotaConfig.Webhook == "" {
+		return
+	}
+	if err := notifyWebhook(quotaConfig.Webhook, report); err != nil {
+		log.Errorf("notify quota violations to %s error: %v", quotaConfig.Webhook, err)
+	}
+}
+
+// loadMaxmemory 读取实例的maxmemory, 读取失败时返回0
+func loadMaxmemory() uint64 {
+	result, err := utils.GetRedisClient().ConfigGet(ctx, "maxmemory").Result()
+	if err != nil || len(result) < 2 {
+		log.Warnf("config get maxmemory fail, skip maxmemory quotas. error: %v", err)
+		return 0
+	}
+	value, _ := result[1].(string)
+	maxmemory, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		log.Warnf("maxmemory has invalid value %s, skip maxmemory quotas", value)
+		return 0
+	}
+	return maxmemory
+}
+
+// notifyWebhook 以json格式POST配额检查的结果
+func notifyWebhook(webhook string, report *QuotaReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookHttpClient.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("webhook returns http status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// GetQuotaReport 最近一次配额检查的结果, 没有配置配额或者还没有统计时返回nil
+func GetQuotaReport() *QuotaReport {
+	reportLocker.RLock()
+	defer reportLocker.RUnlock()
+	return quotaReport
+}
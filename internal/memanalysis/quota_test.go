@@ -0,0 +1,68 @@
+package memanalysis
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/leijianzhong001/redis_agent/internal/config"
+)
+
+func TestEvaluateQuotas(t *testing.T) {
+	users := map[string]*UserOverhead{
+		"user1": {UserName: "user1", KeyCount: 10, Overhead: 500},
+		"user2": {UserName: "user2", KeyCount: 200, Overhead: 100},
+		"user3": {UserName: "user3", KeyCount: 1, Overhead: 50},
+	}
+	quotas := []config.TenantQuota{
+		{UserName: "user1", MaxBytes: 400, MaxMemoryRatio: 0.4},
+		{UserName: DefaultQuotaUser, MaxKeys: 100},
+	}
+
+	violations := EvaluateQuotas(users, quotas, 1000)
+	if len(violations) != 3 {
+		t.Fatalf("EvaluateQuotas() = %d violations", len(violations))
+	}
+	want := []QuotaViolation{
+		{UserName: "user1", Kind: QuotaBytes, Limit: 400, Actual: 500},
+		{UserName: "user1", Kind: QuotaMaxMemory, Limit: 400, Actual: 500},
+		{UserName: "user2", Kind: QuotaKeys, Limit: 100, Actual: 200},
+	}
+	for i := range want {
+		if *violations[i] != want[i] {
+			t.Errorf("violation %d = %+v, want %+v", i, *violations[i], want[i])
+		}
+	}
+
+	// 默认配额不检查未归属的key, 单独配置的配额仍然检查
+	unattributed := map[string]*UserOverhead{UnattributedUser: {UserName: UnattributedUser, KeyCount: 1000, Overhead: 5000}}
+	if violations := EvaluateQuotas(unattributed, quotas, 1000); len(violations) != 0 {
+		t.Errorf("EvaluateQuotas() of unattributed keys with default quota = %+v", violations)
+	}
+	withUnattributed := append(quotas, config.TenantQuota{UserName: UnattributedUser, MaxBytes: 4000})
+	if violations := EvaluateQuotas(unattributed, withUnattributed, 1000); len(violations) != 1 || violations[0].Kind != QuotaBytes {
+		t.Errorf("EvaluateQuotas() of unattributed keys with explicit quota = %+v", violations)
+	}
+
+	// 没有maxmemory时不检查比例
+	if violations = EvaluateQuotas(users, quotas[:1], 0); len(violations) != 1 {
+		t.Errorf("EvaluateQuotas() without maxmemory = %d violations", len(violations))
+	}
+}
+
+func TestNotifyWebhook(t *testing.T) {
+	var received QuotaReport
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewDecoder(req.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	report := &QuotaReport{Violations: []*QuotaViolation{{UserName: "user1", Kind: QuotaKeys, Limit: 1, Actual: 2}}}
+	if err := notifyWebhook(server.URL, report); err != nil {
+		t.Fatalf("notifyWebhook() error: %v", err)
+	}
+	if len(received.Violations) != 1 || received.Violations[0].UserName != "user1" {
+		t.Errorf("received = %+v", received)
+	}
+}
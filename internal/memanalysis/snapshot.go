@@ -0,0 +1,336 @@
+package memanalysis
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	snapshotFilePrefix = "snapshot-"
+	snapshotFileSuffix = ".json"
+)
+
+// snapshotStore 为空时不保存快照
+var snapshotStore *SnapshotStore
+
+// Snapshot 一次完成的内存分析结果
+type Snapshot struct {
+	// 快照id, 为分析完成时的毫秒时间戳
+	Id           string                   `json:"id"`
+	AnalysisDate time.Time                `json:"analysisDate"`
+	Users        map[string]*UserOverhead `json:"users"`
+	BigKeys      *BigKeyReport            `json:"bigKeys,omitempty"`
+}
+
+// SnapshotSummary 快照列表中展示的汇总信息
+type SnapshotSummary struct {
+	Id           string    `json:"id"`
+	AnalysisDate time.Time `json:"analysisDate"`
+	UserCount    int       `json:"userCount"`
+	KeyCount     uint64    `json:"keyCount"`
+	Overhead     uint64    `json:"overhead"`
+}
+
+// UserTrend 用户在两个快照之间的变化
+type UserTrend struct {
+	UserName     string `json:"userName"`
+	FromKeyCount uint64 `json:"fromKeyCount"`
+	ToKeyCount   uint64 `json:"toKeyCount"`
+	FromOverhead uint64 `json:"fromOverhead"`
+	ToOverhead   uint64 `json:"toOverhead"`
+	// 内存开销的增量, 可能为负数
+	OverheadDelta int64 `json:"overheadDelta"`
+	// 内存开销的增长率, 旧快照中不存在该用户时为0
+	GrowthRate float64 `json:"growthRate"`
+}
+
+// Trend 两个快照之间每个用户的变化, 按照增量从大到小排序
+type Trend struct {
+	From     string       `json:"from"`
+	To       string       `json:"to"`
+	FromDate time.Time    `json:"fromDate"`
+	ToDate   time.Time    `json:"toDate"`
+	Users    []*UserTrend `json:"users"`
+}
+
+// SnapshotStore 以json文件的形式把快照保存在本地目录中, 每个快照一个文件
+type SnapshotStore struct {
+	dir       string
+	retention int
+	mu        sync.Mutex
+}
+
+// NewSnapshotStore retention为0时不删除旧的快照
+func NewSnapshotStore(dir string, retention int) (*SnapshotStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.Wrapf(err, "create snapshot dir %s fail", dir)
+	}
+	return &SnapshotStore{dir: dir, retention: retention}, nil
+}
+
+func (store *SnapshotStore) path(id string) string {
+	return filepath.Join(store.dir, snapshotFilePrefix+id+snapshotFileSuffix)
+}
+
+// Save 先写临时文件再重命名, 防止进程退出时留下不完整的快照
+func (store *SnapshotStore) Save(snapshot *Snapshot) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmpPath := store.path(snapshot.Id) + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, store.path(snapshot.Id)); err != nil {
+		return err
+	}
+	return store.prune()
+}
+
+// prune 删除超出保留数量的最早的快照
+func (store *SnapshotStore) prune() error {
+	if store.retention <= 0 {
+		return nil
+	}
+	ids, err := store.ids()
+	if err != nil {
+		return err
+	}
+	for len(ids) > store.retention {
+		if err = os.Remove(store.path(ids[0])); err != nil {
+			return err
+		}
+		log.Infof("remove expired snapshot %s", ids[0])
+		ids = ids[1:]
+	}
+	return nil
+}
+
+// ids 所有快照的id, 从旧到新排列
+func (store *SnapshotStore) ids() ([]string, error) {
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(files))
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, snapshotFilePrefix) || !strings.HasSuffix(name, snapshotFileSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(name, snapshotFilePrefix), snapshotFileSuffix)
+		if validSnapshotId(id) {
+			ids = append(ids, id)
+		}
+	}
+	// 毫秒时间戳的位数相同, 按照字符串排序即为时间顺序
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Load 读取指定的快照
+func (store *SnapshotStore) Load(id string) (*Snapshot, error) {
+	if !validSnapshotId(id) {
+		return nil, errors.Errorf("invalid snapshot id %s", id)
+	}
+	data, err := ioutil.ReadFile(store.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("snapshot %s not found", id)
+		}
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return nil, errors.Wrapf(err, "decode snapshot %s fail", id)
+	}
+	return &snapshot, nil
+}
+
+// List 所有快照的汇总信息, 从旧到新排列
+func (store *SnapshotStore) List() ([]*SnapshotSummary, error) {
+	ids, err := store.ids()
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]*SnapshotSummary, 0, len(ids))
+	for _, id := range ids {
+		snapshot, err := store.Load(id)
+		if err != nil {
+			log.Warnf("skip broken snapshot %s: %v", id, err)
+			continue
+		}
+		summary := &SnapshotSummary{Id: id, AnalysisDate: snapshot.AnalysisDate, UserCount: len(snapshot.Users)}
+		for _, userOverhead := range snapshot.Users {
+			summary.KeyCount += userOverhead.KeyCount
+			summary.Overhead += userOverhead.Overhead
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// Trend 计算两个快照之间每个用户的变化
+// to为空时使用最新的快照, from为空时使用to之前的一个快照
+func (store *SnapshotStore) Trend(from, to string) (*Trend, error) {
+	ids, err := store.ids()
+	if err != nil {
+		return nil, err
+	}
+	if to == "" {
+		if len(ids) == 0 {
+			return nil, errors.New("no snapshot yet")
+		}
+		to = ids[len(ids)-1]
+	}
+	if from == "" {
+		index := sort.SearchStrings(ids, to)
+		if index == 0 {
+			return nil, errors.Errorf("no snapshot before %s", to)
+		}
+		from = ids[index-1]
+	}
+
+	fromSnapshot, err := store.Load(from)
+	if err != nil {
+		return nil, err
+	}
+	toSnapshot, err := store.Load(to)
+	if err != nil {
+		return nil, err
+	}
+	return CompareSnapshots(fromSnapshot, toSnapshot), nil
+}
+
+// CompareSnapshots 比较两个快照, 只在其中一个快照中出现的用户也会列出
+func CompareSnapshots(from, to *Snapshot) *Trend {
+	trend := &Trend{From: from.Id, To: to.Id, FromDate: from.AnalysisDate, ToDate: to.AnalysisDate}
+	userTrends := make(map[string]*UserTrend, len(to.Users))
+	userTrend := func(userName string) *UserTrend {
+		if _, ok := userTrends[userName]; !ok {
+			userTrends[userName] = &UserTrend{UserName: userName}
+		}
+		return userTrends[userName]
+	}
+	for userName, userOverhead := range from.Users {
+		t := userTrend(userName)
+		t.FromKeyCount = userOverhead.KeyCount
+		t.FromOverhead = userOverhead.Overhead
+	}
+	for userName, userOverhead := range to.Users {
+		t := userTrend(userName)
+		t.ToKeyCount = userOverhead.KeyCount
+		t.ToOverhead = userOverhead.Overhead
+	}
+
+	trend.Users = make([]*UserTrend, 0, len(userTrends))
+	for _, t := range userTrends {
+		t.OverheadDelta = int64(t.ToOverhead) - int64(t.FromOverhead)
+		if t.FromOverhead > 0 {
+			t.GrowthRate = float64(t.OverheadDelta) / float64(t.FromOverhead)
+		}
+		trend.Users = append(trend.Users, t)
+	}
+	sort.Slice(trend.Users, func(i, j int) bool {
+		if trend.Users[i].OverheadDelta != trend.Users[j].OverheadDelta {
+			return trend.Users[i].OverheadDelta > trend.Users[j].OverheadDelta
+		}
+		return trend.Users[i].UserName < trend.Users[j].UserName
+	})
+	return trend
+}
+
+func validSnapshotId(id string) bool {
+	_, err := strconv.ParseUint(id, 10, 64)
+	return err == nil
+}
+
+func newSnapshotId(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// InitSnapshotStore 初始化快照目录, 并从最新的快照中恢复分析结果, 使重启之后仍然可以查询
+func InitSnapshotStore(dir string, retention int) error {
+	store, err := NewSnapshotStore(dir, retention)
+	if err != nil {
+		return err
+	}
+	snapshotStore = store
+
+	ids, err := store.ids()
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	latest, err := store.Load(ids[len(ids)-1])
+	if err != nil {
+		return err
+	}
+	reportLocker.Lock()
+	userAndOverhead = latest.Users
+	bigKeyReport = latest.BigKeys
+	reportLocker.Unlock()
+	log.Infof("restore analysis result from snapshot %s, analysis date: %s", latest.Id, latest.AnalysisDate)
+	return nil
+}
+
+// saveSnapshot 保存本次的分析结果, 保存失败不影响分析结果
+func saveSnapshot(users map[string]*UserOverhead, bigKeys *BigKeyReport) {
+	if snapshotStore == nil {
+		return
+	}
+	now := time.Now()
+	snapshot := &Snapshot{Id: newSnapshotId(now), AnalysisDate: now, Users: users, BigKeys: bigKeys}
+	if err := snapshotStore.Save(snapshot); err != nil {
+		log.Errorf("save snapshot %s error: %v", snapshot.Id, err)
+		return
+	}
+	log.Infof("save snapshot %s success", snapshot.Id)
+}
+
+func getSnapshotStore() (*SnapshotStore, error) {
+	if snapshotStore == nil {
+		return nil, errors.New("snapshot store is not configured")
+	}
+	return snapshotStore, nil
+}
+
+// ListSnapshots 所有快照的汇总信息
+func ListSnapshots() ([]*SnapshotSummary, error) {
+	store, err := getSnapshotStore()
+	if err != nil {
+		return nil, err
+	}
+	return store.List()
+}
+
+// GetSnapshot 查询指定的历史快照
+func GetSnapshot(id string) (*Snapshot, error) {
+	store, err := getSnapshotStore()
+	if err != nil {
+		return nil, err
+	}
+	return store.Load(id)
+}
+
+// GetTrend 计算两个快照之间每个用户的变化
+func GetTrend(from, to string) (*Trend, error) {
+	store, err := getSnapshotStore()
+	if err != nil {
+		return nil, err
+	}
+	return store.Trend(from, to)
+}
@@ -0,0 +1,110 @@
+package memanalysis
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotStore(t *testing.T) {
+	store, err := NewSnapshotStore(t.TempDir(), 2)
+	if err != nil {
+		t.Fatalf("NewSnapshotStore() error: %v", err)
+	}
+	users := func(overheads map[string]uint64) map[string]*UserOverhead {
+		result := make(map[string]*UserOverhead)
+		for userName, overhead := range overheads {
+			result[userName] = &UserOverhead{UserName: userName, KeyCount: 1, Overhead: overhead}
+		}
+		return result
+	}
+	base := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	for i, overheads := range []map[string]uint64{
+		{"user1": 1},
+		{"user1": 100, "user2": 50},
+		{"user1": 150, "user3": 10},
+	} {
+		date := base.AddDate(0, 0, 7*i)
+		if err = store.Save(&Snapshot{Id: newSnapshotId(date), AnalysisDate: date, Users: users(overheads)}); err != nil {
+			t.Fatalf("Save() error: %v", err)
+		}
+	}
+
+	// 超出保留数量的最早的快照被删除
+	summaries, err := store.List()
+	if err != nil || len(summaries) != 2 {
+		t.Fatalf("List() = %v, %v", summaries, err)
+	}
+	if summaries[1].Overhead != 160 || summaries[1].UserCount != 2 {
+		t.Errorf("latest summary = %+v", summaries[1])
+	}
+	if _, err = store.Load(newSnapshotId(base)); err == nil {
+		t.Errorf("oldest snapshot should be pruned")
+	}
+	if _, err = store.Load("../etc/passwd"); err == nil {
+		t.Errorf("Load() should reject invalid id")
+	}
+
+	trend, err := store.Trend("", "")
+	if err != nil {
+		t.Fatalf("Trend() error: %v", err)
+	}
+	if trend.From != summaries[0].Id || trend.To != summaries[1].Id || len(trend.Users) != 3 {
+		t.Fatalf("Trend() = %+v", trend)
+	}
+	user1, user3, user2 := trend.Users[0], trend.Users[1], trend.Users[2]
+	if user1.UserName != "user1" || user1.OverheadDelta != 50 || user1.GrowthRate != 0.5 {
+		t.Errorf("user1 trend = %+v", user1)
+	}
+	if user3.UserName != "user3" || user3.FromOverhead != 0 || user3.GrowthRate != 0 {
+		t.Errorf("user3 trend = %+v", user3)
+	}
+	if user2.UserName != "user2" || user2.OverheadDelta != -50 || user2.GrowthRate != -1 {
+		t.Errorf("user2 trend = %+v", user2)
+	}
+	if _, err = store.Trend("", summaries[0].Id); err == nil {
+		t.Errorf("Trend() before the oldest snapshot should fail")
+	}
+
+	// 临时文件不会被当作快照
+	_ = os.WriteFile(filepath.Join(store.dir, snapshotFilePrefix+"1"+snapshotFileSuffix+".tmp"), []byte("{"), 0644)
+	if ids, _ := store.ids(); len(ids) != 2 {
+		t.Errorf("ids() = %v", ids)
+	}
+}
+
+func TestRestoreSnapshotWhileReading(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewSnapshotStore(dir, 2)
+	if err != nil {
+		t.Fatalf("NewSnapshotStore() error: %v", err)
+	}
+	users := map[string]*UserOverhead{"user1": {UserName: "user1", KeyCount: 1, Overhead: 10}}
+	if err = store.Save(&Snapshot{Id: newSnapshotId(time.Now()), AnalysisDate: time.Now(), Users: users, BigKeys: &BigKeyReport{}}); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+	defer func() { snapshotStore = nil }()
+
+	// 恢复结果的同时查询, 使用 -race 运行时不应该报告数据竞争
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			GetUserAndOverhead()
+			_, _ = GetBigKeys("")
+			GetQuotaReport()
+			GetCalibrationReport()
+			GetClusterAnalysis()
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err = InitSnapshotStore(dir, 2); err != nil {
+			t.Fatalf("InitSnapshotStore() error: %v", err)
+		}
+	}
+	<-done
+	if GetUserAndOverhead()["user1"].Overhead != 10 {
+		t.Errorf("restored users = %v", GetUserAndOverhead())
+	}
+}
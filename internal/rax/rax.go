@@ -1,17 +1,224 @@
+// Package rax 基数树(radix tree)的实现, 参考redis的rax.c
+// 与rax.c一样, 只有一个子节点的节点会把整段路径压缩在一条边上, 所以节点数量与key的数量成正比, 而不是与key的长度成正比
 package rax
 
+import (
+	"sort"
+	"strings"
+)
+
 type Rax struct {
 	head     *RaxNode
-	numele   uint64
-	numnodes uint64
+	numele   uint64 // key的数量
+	numnodes uint64 // 节点的数量, 包含头节点
 }
 
 type RaxNode struct {
-	isKey         bool
-	isnull        bool
-	iscompr       bool
-	size          int32
+	isKey   bool // 当前节点是否对应一个key
+	isnull  bool // 当前节点对应的key的value是否为nil
+	iscompr bool // 是否为压缩节点, 即只有一个子节点且边上有多个字符
+	size    int32
+	// routeKey 到每个子节点的边, 按照首字节排序, 不同的边首字节一定不同
 	routeKey      []string
 	childPointers []*RaxNode
 	value         interface{}
 }
+
+func New() *Rax {
+	return &Rax{head: &RaxNode{}, numnodes: 1}
+}
+
+// Len key的数量
+func (r *Rax) Len() uint64 {
+	return r.numele
+}
+
+// NumNodes 节点的数量
+func (r *Rax) NumNodes() uint64 {
+	return r.numnodes
+}
+
+// Insert 插入key, key已经存在时更新value并返回旧的value和true
+func (r *Rax) Insert(key string, value interface{}) (interface{}, bool) {
+	node := r.head
+	for len(key) > 0 {
+		index, found := node.findChild(key[0])
+		if !found {
+			// 没有首字节相同的边, 剩余部分整体作为一个新的叶子节点
+			leaf := &RaxNode{}
+			node.addChild(index, key, leaf)
+			r.numnodes++
+			node = leaf
+			break
+		}
+
+		label := node.routeKey[index]
+		common := commonPrefixLen(label, key)
+		if common < len(label) {
+			// 边只匹配了一部分, 从公共前缀处拆分出一个中间节点
+			middle := &RaxNode{}
+			middle.addChild(0, label[common:], node.childPointers[index])
+			node.routeKey[index] = label[:common]
+			node.childPointers[index] = middle
+			node.updateFlags()
+			r.numnodes++
+		}
+		node = node.childPointers[index]
+		key = key[common:]
+	}
+
+	old, updated := node.value, node.isKey
+	if !node.isKey {
+		r.numele++
+	}
+	node.isKey = true
+	node.isnull = value == nil
+	node.value = value
+	return old, updated
+}
+
+// Find 查找key对应的value
+func (r *Rax) Find(key string) (interface{}, bool) {
+	node := r.head
+	for len(key) > 0 {
+		index, found := node.findChild(key[0])
+		if !found || !strings.HasPrefix(key, node.routeKey[index]) {
+			return nil, false
+		}
+		key = key[len(node.routeKey[index]):]
+		node = node.childPointers[index]
+	}
+	if !node.isKey {
+		return nil, false
+	}
+	return node.value, true
+}
+
+// Remove 删除key, 返回被删除的value。删除后会合并只剩一个子节点的节点, 保持树的压缩状态
+func (r *Rax) Remove(key string) (interface{}, bool) {
+	// 记录从头节点到目标节点的路径, 用于删除后向上合并
+	parents := make([]*RaxNode, 0, 8)
+	indexes := make([]int, 0, 8)
+	node := r.head
+	for len(key) > 0 {
+		index, found := node.findChild(key[0])
+		if !found || !strings.HasPrefix(key, node.routeKey[index]) {
+			return nil, false
+		}
+		parents = append(parents, node)
+		indexes = append(indexes, index)
+		key = key[len(node.routeKey[index]):]
+		node = node.childPointers[index]
+	}
+	if !node.isKey {
+		return nil, false
+	}
+
+	value := node.value
+	node.isKey = false
+	node.isnull = false
+	node.value = nil
+	r.numele--
+
+	if len(parents) == 0 {
+		// 头节点不删除也不合并
+		return value, true
+	}
+	parent := parents[len(parents)-1]
+	index := indexes[len(indexes)-1]
+	if node.size == 0 {
+		parent.removeChild(index)
+		r.numnodes--
+		if len(parents) == 1 {
+			return value, true
+		}
+		// 父节点可能只剩一个子节点, 尝试与它合并
+		node = parent
+		parent = parents[len(parents)-2]
+		index = indexes[len(indexes)-2]
+	}
+	if !node.isKey && node.size == 1 {
+		parent.routeKey[index] += node.routeKey[0]
+		parent.childPointers[index] = node.childPointers[0]
+		parent.updateFlags()
+		r.numnodes--
+	}
+	return value, true
+}
+
+// WalkPrefix 按照字典序遍历所有以prefix开头的key, fn返回false时停止遍历
+func (r *Rax) WalkPrefix(prefix string, fn func(key string, value interface{}) bool) {
+	node := r.head
+	path := ""
+	rest := prefix
+	for len(rest) > 0 {
+		index, found := node.findChild(rest[0])
+		if !found {
+			return
+		}
+		label := node.routeKey[index]
+		if strings.HasPrefix(rest, label) {
+			rest = rest[len(label):]
+		} else if strings.HasPrefix(label, rest) {
+			// prefix在边的中间结束, 这条边下的所有key都以prefix开头
+			rest = ""
+		} else {
+			return
+		}
+		path += label
+		node = node.childPointers[index]
+	}
+	node.walk(path, fn)
+}
+
+// Walk 按照字典序遍历所有key
+func (r *Rax) Walk(fn func(key string, value interface{}) bool) {
+	r.head.walk("", fn)
+}
+
+func (n *RaxNode) walk(path string, fn func(key string, value interface{}) bool) bool {
+	if n.isKey && !fn(path, n.value) {
+		return false
+	}
+	for i, child := range n.childPointers {
+		if !child.walk(path+n.routeKey[i], fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// findChild 二分查找首字节为c的边, 没有找到时返回应当插入的位置
+func (n *RaxNode) findChild(c byte) (int, bool) {
+	index := sort.Search(len(n.routeKey), func(i int) bool { return n.routeKey[i][0] >= c })
+	return index, index < len(n.routeKey) && n.routeKey[index][0] == c
+}
+
+func (n *RaxNode) addChild(index int, label string, child *RaxNode) {
+	n.routeKey = append(n.routeKey, "")
+	copy(n.routeKey[index+1:], n.routeKey[index:])
+	n.routeKey[index] = label
+	n.childPointers = append(n.childPointers, nil)
+	copy(n.childPointers[index+1:], n.childPointers[index:])
+	n.childPointers[index] = child
+	n.updateFlags()
+}
+
+func (n *RaxNode) removeChild(index int) {
+	n.routeKey = append(n.routeKey[:index], n.routeKey[index+1:]...)
+	n.childPointers = append(n.childPointers[:index], n.childPointers[index+1:]...)
+	n.updateFlags()
+}
+
+func (n *RaxNode) updateFlags() {
+	n.size = int32(len(n.childPointers))
+	n.iscompr = n.size == 1 && len(n.routeKey[0]) > 1
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
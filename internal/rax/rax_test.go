@@ -0,0 +1,102 @@
+package rax
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRaxInsertFindRemove(t *testing.T) {
+	r := New()
+	for _, key := range []string{"romane", "romanus", "romulus", "rubens", "ruber", "rubicon", "rubicundus", "rom"} {
+		if _, updated := r.Insert(key, key); updated {
+			t.Fatalf("Insert(%s) updated a missing key", key)
+		}
+	}
+	if old, updated := r.Insert("rom", 1); !updated || old != "rom" {
+		t.Fatalf("Insert(rom) = %v, %t", old, updated)
+	}
+	if r.Len() != 8 {
+		t.Fatalf("Len() = %d, want 8", r.Len())
+	}
+	if v, ok := r.Find("rom"); !ok || v != 1 {
+		t.Errorf("Find(rom) = %v, %t", v, ok)
+	}
+	for _, missing := range []string{"r", "ro", "roma", "rubiconx", ""} {
+		if _, ok := r.Find(missing); ok {
+			t.Errorf("Find(%q) should miss", missing)
+		}
+	}
+
+	var keys []string
+	r.WalkPrefix("rub", func(key string, value interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if strings.Join(keys, ",") != "rubens,ruber,rubicon,rubicundus" {
+		t.Errorf("WalkPrefix(rub) = %v", keys)
+	}
+	keys = keys[:0]
+	r.WalkPrefix("roma", func(key string, value interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if strings.Join(keys, ",") != "romane,romanus" {
+		t.Errorf("WalkPrefix(roma) = %v", keys)
+	}
+
+	nodes := r.NumNodes()
+	if v, ok := r.Remove("rubicon"); !ok || v != "rubicon" {
+		t.Fatalf("Remove(rubicon) = %v, %t", v, ok)
+	}
+	if _, ok := r.Remove("rubicon"); ok {
+		t.Errorf("Remove(rubicon) twice should fail")
+	}
+	if _, ok := r.Find("rubicundus"); !ok || r.NumNodes() >= nodes {
+		t.Errorf("after Remove: nodes %d -> %d", nodes, r.NumNodes())
+	}
+}
+
+// TestRaxRandom 与map对比随机插入和删除的结果
+func TestRaxRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	r := New()
+	expected := make(map[string]int)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("user%d:%d:%d", rng.Intn(10), rng.Intn(20), rng.Intn(30))
+		if rng.Intn(3) == 0 {
+			_, ok := r.Remove(key)
+			if _, want := expected[key]; ok != want {
+				t.Fatalf("Remove(%s) = %t, want %t", key, ok, want)
+			}
+			delete(expected, key)
+		} else {
+			r.Insert(key, i)
+			expected[key] = i
+		}
+	}
+	if r.Len() != uint64(len(expected)) {
+		t.Fatalf("Len() = %d, want %d", r.Len(), len(expected))
+	}
+
+	var walked []string
+	r.Walk(func(key string, value interface{}) bool {
+		if expected[key] != value {
+			t.Errorf("value of %s = %v, want %d", key, value, expected[key])
+		}
+		walked = append(walked, key)
+		return true
+	})
+	if !sort.StringsAreSorted(walked) || len(walked) != len(expected) {
+		t.Errorf("Walk() returned %d keys, sorted=%t", len(walked), sort.StringsAreSorted(walked))
+	}
+	// 删除所有key之后只剩头节点
+	for key := range expected {
+		r.Remove(key)
+	}
+	if r.Len() != 0 || r.NumNodes() != 1 {
+		t.Errorf("after removing all keys: Len()=%d, NumNodes()=%d", r.Len(), r.NumNodes())
+	}
+}
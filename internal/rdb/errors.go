@@ -0,0 +1,53 @@
+package rdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrCorruptRDB rdb文件末尾的CRC64校验和与文件内容不一致
+var ErrCorruptRDB = errors.New("corrupt RDB")
+
+// ErrRoleChanged 解析过程中当前节点切换为主节点, 解析被中止, 已经得到的结果是不完整的
+var ErrRoleChanged = errors.New("node became master during rdb read")
+
+// ParseError rdb文件解析失败时返回的错误, 携带出错位置的字节偏移量以及正在解析的key
+// 具体的错误原因可以通过 errors.Is 与 structure.ErrTruncated、structure.ErrBadEncoding、types.ErrUnknownType 比较
+type ParseError struct {
+	Offset int64  // 出错时已经读取的字节数
+	Key    string // 出错时正在解析的key, 解析元数据时为空
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("parse rdb failed. offset=[%d], error=[%v]", e.Offset, e.Err)
+	}
+	return fmt.Sprintf("parse rdb failed. offset=[%d], key=[%s], error=[%v]", e.Offset, e.Key, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// checksum utils.NewDigest() 返回的CRC64摘要
+type checksum interface {
+	io.Writer
+	Sum64() uint64
+}
+
+// offsetReader 记录已经读取的字节数, 用于在解析出错时定位错误位置
+// 同时对读取到的所有字节计算CRC64, 用于和rdb文件末尾的校验和进行比较
+type offsetReader struct {
+	rd     io.Reader
+	offset int64
+	digest checksum
+}
+
+func (r *offsetReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.offset += int64(n)
+	_, _ = r.digest.Write(p[:n])
+	return n, err
+}
@@ -0,0 +1,183 @@
+package rdb
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/leijianzhong001/redis_agent/internal/entry"
+	"github.com/leijianzhong001/redis_agent/internal/rdb/types"
+	"github.com/leijianzhong001/redis_agent/internal/statistics"
+	"github.com/leijianzhong001/redis_agent/internal/utils"
+)
+
+// LoaderOptions Loader的可选配置
+type LoaderOptions struct {
+	// Workers 解析value和计算内存开销的goroutine数量, 小于等于1时在读取rdb文件的goroutine中顺序解析
+	Workers int
+	// Ordered 为true时按照key在rdb文件中的顺序发送entry, 否则按照解析完成的顺序发送
+	Ordered bool
+	// SkipRoleCheck 为true时解析过程中不检查本地redis是否变为主节点, 用于分析归档的rdb文件
+	SkipRoleCheck bool
+	// MemProfile rdb文件中没有redis-ver辅助字段时使用的内存模型, 为nil时使用 utils.DefaultMemProfile
+	MemProfile *utils.MemProfile
+}
+
+// maxInflightPerWorker 每个worker最多同时持有的未发送的key数量, 限制按顺序发送时等待重排的内存占用
+const maxInflightPerWorker = 256
+
+// decodeJob 读取rdb文件的goroutine切分出的一个key
+type decodeJob struct {
+	seq      uint64
+	offset   int64  // value在rdb文件中的起始偏移量
+	typeByte byte   // value的类型
+	payload  []byte // value的原始字节, object不为空时为nil
+	size     uint64 // value在rdb文件中占用的字节数
+	// object 无法跳过的类型(stream、module)在读取时已经解析
+	object types.RedisObject
+	// profile 计算内存开销时使用的内存模型
+	profile *utils.MemProfile
+	// e key的元信息, 解析完成后填充类型、编码和内存开销。payload和object都为空时说明e不需要解析(如函数库)
+	e *entry.Entry
+}
+
+// decodePipeline 由读取rdb文件的goroutine顺序切分value, 多个worker并行解析value和计算内存开销
+type decodePipeline struct {
+	jobs     chan *decodeJob
+	results  chan *decodeJob // 按顺序发送时, worker的解析结果先发送到这里重排
+	out      chan *entry.Entry
+	inflight chan struct{}
+	ordered  bool
+	seq      uint64
+
+	workerWg sync.WaitGroup
+	doneWg   sync.WaitGroup
+
+	errOnce sync.Once
+	err     error
+	failed  chan struct{}
+}
+
+func newDecodePipeline(options LoaderOptions, out chan *entry.Entry) *decodePipeline {
+	p := &decodePipeline{
+		jobs:     make(chan *decodeJob, options.Workers*2),
+		out:      out,
+		inflight: make(chan struct{}, options.Workers*maxInflightPerWorker),
+		ordered:  options.Ordered,
+		failed:   make(chan struct{}),
+	}
+	if p.ordered {
+		p.results = make(chan *decodeJob, options.Workers*2)
+		p.doneWg.Add(1)
+		go p.resequence()
+	}
+	p.workerWg.Add(options.Workers)
+	for i := 0; i < options.Workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// submit 提交一个key, 解析已经失败时返回解析错误
+func (p *decodePipeline) submit(job *decodeJob) error {
+	select {
+	case p.inflight <- struct{}{}:
+	case <-p.failed:
+		return p.err
+	}
+	job.seq = p.seq
+	p.seq++
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-p.failed:
+		return p.err
+	}
+}
+
+// close 等待所有已提交的key解析并发送完成, 返回第一个解析错误
+func (p *decodePipeline) close() error {
+	close(p.jobs)
+	p.workerWg.Wait()
+	if p.ordered {
+		close(p.results)
+	}
+	p.doneWg.Wait()
+	select {
+	case <-p.failed:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+func (p *decodePipeline) fail(err error) {
+	p.errOnce.Do(func() {
+		p.err = err
+		close(p.failed)
+	})
+}
+
+func (p *decodePipeline) work() {
+	defer p.workerWg.Done()
+	for job := range p.jobs {
+		select {
+		case <-p.failed:
+			// 已经失败, 丢弃剩余的key
+			<-p.inflight
+			continue
+		default:
+		}
+		if err := decode(job); err != nil {
+			p.fail(&ParseError{Offset: job.offset, Key: job.e.Key, Err: err})
+			<-p.inflight
+			continue
+		}
+		if p.ordered {
+			p.results <- job
+		} else {
+			p.emit(job)
+		}
+	}
+}
+
+// resequence 按照seq的顺序发送解析结果
+func (p *decodePipeline) resequence() {
+	defer p.doneWg.Done()
+	pending := make(map[uint64]*decodeJob)
+	next := uint64(0)
+	for job := range p.results {
+		pending[job.seq] = job
+		for {
+			ready, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			p.emit(ready)
+		}
+	}
+}
+
+func (p *decodePipeline) emit(job *decodeJob) {
+	p.out <- job.e
+	<-p.inflight
+}
+
+// decode 解析value并填充entry的类型、编码和内存开销
+func decode(job *decodeJob) error {
+	o := job.object
+	if o == nil {
+		if job.payload == nil {
+			return nil
+		}
+		var err error
+		o, err = types.ParseObject(bytes.NewReader(job.payload), job.typeByte, job.e.Key, job.profile)
+		if err != nil {
+			return err
+		}
+	}
+	fillEntry(job.e, o)
+	statistics.AddDecodedKey(job.size)
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"fmt"
 	"github.com/leijianzhong001/redis_agent/internal/entry"
 	"github.com/leijianzhong001/redis_agent/internal/log"
 	"github.com/leijianzhong001/redis_agent/internal/rdb/structure"
@@ -29,180 +30,398 @@ const (
 	kFlagExpire    = 0xfd // Old expire time in seconds.
 	kFlagSelect    = 0xfe // DB number of the following keys.
 	kEOF           = 0xff // End of the RDB file.
+
+	checksumMinVersion = 5 // RDB_VERSION 5 开始在文件末尾写入8个字节的CRC64校验和
 )
 
 type Loader struct {
 	replStreamDbId int // https://github.com/alibaba/RedisShake/pull/430#issuecomment-1099014464
 
 	nowDBId  int
-	expireMs int64
-	idle     int64
-	freq     int64
+	expireAt int64 // 下一个key的过期时间, unix毫秒时间戳, 0表示没有过期时间
+	idle     int64 // 下一个key的LRU空闲时间, -1表示没有
+	freq     int64 // 下一个key的LFU访问频率, -1表示没有
 
 	filPath string
 	fp      *os.File
+	rd      *offsetReader
+	version int
 
 	ch         chan *entry.Entry
 	dumpBuffer bytes.Buffer
+
+	options  LoaderOptions
+	profile  *utils.MemProfile // 当前rdb文件的内存模型, 读取到redis-ver辅助字段时按照版本选择
+	pipeline *decodePipeline   // options.Workers大于1时由多个worker并行解析value
 }
 
 func NewLoader(filPath string, ch chan *entry.Entry) *Loader {
+	return NewLoaderWithOptions(filPath, ch, LoaderOptions{})
+}
+
+func NewLoaderWithOptions(filPath string, ch chan *entry.Entry, options LoaderOptions) *Loader {
 	ld := new(Loader)
 	ld.ch = ch
 	ld.filPath = filPath
+	ld.options = options
+	ld.profile = options.MemProfile
+	ld.resetKeyMeta()
 	return ld
 }
 
-func (ld *Loader) ParseRDB() int {
-	var err error
+// ParseRDB 解析rdb文件并将解析到的key发送到ch中, 文件格式错误时返回 *ParseError
+func (ld *Loader) ParseRDB() (replStreamDbId int, err error) {
 	ld.fp, err = os.OpenFile(ld.filPath, os.O_RDONLY, 0666)
 	if err != nil {
-		log.Panicf("open file failed. file_path=[%s], error=[%s]", ld.filPath, err)
+		return 0, fmt.Errorf("open file failed. file_path=[%s], error=[%w]", ld.filPath, err)
 	}
 	defer func() {
-		err = ld.fp.Close()
-		if err != nil {
-			log.Panicf("close file failed. file_path=[%s], error=[%s]", ld.filPath, err)
+		if closeErr := ld.fp.Close(); closeErr != nil {
+			log.Warnf("close file failed. file_path=[%s], error=[%s]", ld.filPath, closeErr)
 		}
 	}()
 	// bufio分段读取，不会将整个文件加载到内存中
-	rd := bufio.NewReader(ld.fp)
+	ld.rd = &offsetReader{rd: bufio.NewReader(ld.fp), digest: utils.NewDigest()}
 	//magic + version 即REDIS + 0006
-	buf := make([]byte, 9)
-	_, err = io.ReadFull(rd, buf)
+	buf, err := structure.ReadBytes(ld.rd, 9)
 	if err != nil {
-		log.PanicError(err)
+		return 0, ld.parseError(err, "")
 	}
 	// 校验REDIS魔数
 	if !bytes.Equal(buf[:5], []byte("REDIS")) {
-		log.Panicf("verify magic string, invalid file format. bytes=[%v]", buf[:5])
+		return 0, ld.parseError(structure.BadEncoding("verify magic string, invalid file format. bytes=[%v]", buf[:5]), "")
 	}
 	// 获取redis版本 0009
-	version, err := strconv.Atoi(string(buf[5:]))
+	ld.version, err = strconv.Atoi(string(buf[5:]))
 	if err != nil {
-		log.PanicError(err)
+		return 0, ld.parseError(structure.BadEncoding("invalid rdb version. bytes=[%v]", buf[5:]), "")
 	}
-	log.Infof("RDB version: %d", version)
+	log.Infof("RDB version: %d", ld.version)
 
 	// read entries
-	ld.parseRDBEntry(rd)
+	statistics.SetDecodeWorkers(ld.options.Workers)
+	if ld.options.Workers > 1 {
+		log.Infof("parse RDB with %d workers, ordered=[%t]", ld.options.Workers, ld.options.Ordered)
+		ld.pipeline = newDecodePipeline(ld.options, ld.ch)
+	}
+	err = ld.parseRDBEntry(ld.rd)
+	if ld.pipeline != nil {
+		// 读取出错时也需要等待worker退出, 保证ParseRDB返回之后不会再向ch发送entry
+		if pipelineErr := ld.pipeline.close(); err == nil {
+			err = pipelineErr
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
 
 	// force update rdb_sent_size for issue: https://github.com/alibaba/RedisShake/issues/485
 	fi, err := os.Stat(ld.filPath)
 	if err != nil {
-		log.Panicf("NewRDBReader: os.Stat error: %s", err.Error())
+		return 0, fmt.Errorf("stat file failed. file_path=[%s], error=[%w]", ld.filPath, err)
 	}
 	statistics.Metrics.RdbSendSize = uint64(fi.Size())
-	return ld.replStreamDbId
+	return ld.replStreamDbId, nil
 }
 
-func (ld *Loader) parseRDBEntry(rd *bufio.Reader) {
+// parseError 将解析过程中的错误包装为 *ParseError
+func (ld *Loader) parseError(err error, key string) error {
+	return &ParseError{Offset: ld.rd.offset, Key: key, Err: err}
+}
+
+func (ld *Loader) parseRDBEntry(rd io.Reader) error {
 	// for stat
 	UpdateRDBSentSize := func() {
-		offset, err := ld.fp.Seek(0, io.SeekCurrent)
-		if err != nil {
-			log.PanicError(err)
-		}
-		statistics.UpdateRDBSentSize(uint64(offset))
+		statistics.UpdateRDBSentSize(uint64(ld.rd.offset))
+		statistics.UpdateDecodeThroughput()
 	}
 	defer UpdateRDBSentSize()
 	// read one entry 一秒给tick通道发送一个时间戳
 	tick := time.Tick(time.Second * 1)
 	for true {
-		typeByte := structure.ReadByte(rd)
+		typeByte, err := structure.ReadByte(rd)
+		if err != nil {
+			return ld.parseError(err, "")
+		}
 		switch typeByte {
 		case kFlagIdle:
 			// 0xF8 LRU redis key的LRU时间戳
-			ld.idle = int64(structure.ReadLength(rd))
+			idle, err := structure.ReadLength(rd)
+			if err != nil {
+				return ld.parseError(err, "")
+			}
+			ld.idle = int64(idle)
 		case kFlagFreq:
 			// 0xF9 LFU LFU频率
-			ld.freq = int64(structure.ReadByte(rd))
+			freq, err := structure.ReadByte(rd)
+			if err != nil {
+				return ld.parseError(err, "")
+			}
+			ld.freq = int64(freq)
 		case kFlagAUX:
 			// redis元属性 0xfa
 			// structure.ReadString的含义因该是按照rdb的字符串编码方式，读取一个字符串
-			key := structure.ReadString(rd)
-			value := structure.ReadString(rd)
+			key, err := structure.ReadString(rd)
+			if err != nil {
+				return ld.parseError(err, "")
+			}
+			value, err := structure.ReadString(rd)
+			if err != nil {
+				return ld.parseError(err, "")
+			}
 			if key == "repl-stream-db" {
-				var err error
 				ld.replStreamDbId, err = strconv.Atoi(value)
 				if err != nil {
-					log.PanicError(err)
+					return ld.parseError(structure.BadEncoding("invalid repl-stream-db [%s]", value), "")
 				}
 				log.Infof("RDB repl-stream-db: %d", ld.replStreamDbId)
+			} else if key == "redis-ver" {
+				// 按照生成rdb文件的redis版本选择内存模型
+				ld.profile = utils.MemProfileForVersion(value)
+				log.Infof("RDB redis-ver: %s, use memory profile %s", value, ld.profile.Name)
 			} else if key == "lua" {
 				// redis 7 ?
 				e := entry.NewEntry()
 				e.Argv = []string{"script", "load", value}
 				e.IsBase = true
-				ld.ch <- e
+				if err = ld.send(e); err != nil {
+					return err
+				}
 				log.Infof("LUA script: [%s]", value)
 			} else {
 				log.Infof("RDB AUX fields. key=[%s], value=[%s]", key, value)
 			}
+		case kFlagModuleAux:
+			// 0xF7 MODULE_AUX 模块的辅助数据, 不需要加载模块即可按照opcode注解跳过
+			moduleName, err := types.ReadModuleAux(rd)
+			if err != nil {
+				return ld.parseError(err, "")
+			}
+			log.Infof("RDB module aux skipped. module_name=[%s]", moduleName)
+		case kFlagFunction2:
+			// 0xF5 FUNCTION2 redis 7 的函数库, 只保存了库的源码
+			code, err := structure.ReadString(rd)
+			if err != nil {
+				return ld.parseError(err, "")
+			}
+			e := entry.NewEntry()
+			e.Argv = []string{"function", "load", code}
+			e.IsBase = true
+			if err = ld.send(e); err != nil {
+				return err
+			}
+			log.Infof("function library: [%s]", code)
+		case kFlagFunction:
+			// 0xF6 FUNCTION redis 7.0 rc1/rc2 的函数库格式: <name> <engine_name> <has_desc> [desc] <code>
+			argv, err := readPreGAFunction(rd)
+			if err != nil {
+				return ld.parseError(err, "")
+			}
+			e := entry.NewEntry()
+			e.Argv = argv
+			e.IsBase = true
+			if err = ld.send(e); err != nil {
+				return err
+			}
+			log.Infof("function library (pre-GA): [%s]", argv[len(argv)-1])
 		case kFlagResizeDB:
 			// 0xFB RESIZEDB  描述 key 数目和设置了过期时间 key 数目
-			dbSize := structure.ReadLength(rd)
-			expireSize := structure.ReadLength(rd)
+			dbSize, err := structure.ReadLength(rd)
+			if err != nil {
+				return ld.parseError(err, "")
+			}
+			expireSize, err := structure.ReadLength(rd)
+			if err != nil {
+				return ld.parseError(err, "")
+			}
 			log.Infof("RDB resize db. db_size=[%d], expire_size=[%d]", dbSize, expireSize)
 		case kFlagExpireMs:
 			// 0xFC EXPIRETIMEMS key过期时间，使用毫秒表示。
-			ld.expireMs = int64(structure.ReadUint64(rd)) - time.Now().UnixMilli()
-			if ld.expireMs < 0 {
-				ld.expireMs = 1
+			expireMs, err := structure.ReadUint64(rd)
+			if err != nil {
+				return ld.parseError(err, "")
 			}
+			ld.expireAt = int64(expireMs)
 		case kFlagExpire:
 			// 0xFD EXPIRETIME  key-过期时间，使用秒表示。
-			ld.expireMs = int64(structure.ReadUint32(rd))*1000 - time.Now().UnixMilli()
-			if ld.expireMs < 0 {
-				ld.expireMs = 1
+			expire, err := structure.ReadUint32(rd)
+			if err != nil {
+				return ld.parseError(err, "")
 			}
+			ld.expireAt = int64(expire) * 1000
 		case kFlagSelect:
 			// 0xFE SELECTDB 选库标识，后面紧跟数据库编号
-			ld.nowDBId = int(structure.ReadLength(rd))
+			dbId, err := structure.ReadLength(rd)
+			if err != nil {
+				return ld.parseError(err, "")
+			}
+			ld.nowDBId = int(dbId)
 		case kEOF:
 			// 0xFF EOF rdb文件结束符
-			return
+			return ld.verifyChecksum(rd)
 		default:
 			// value的类型标识 OBJECT_TYPE 已经在前面被读取到 typeByte 中了
 			// 读取一个key
-			key := structure.ReadString(rd)
-			var value bytes.Buffer
-			// io.TeeReader返回一个Reader，它将从reader(rd)中读取的内容写入writer(&value)。
-			// 通过它执行的所有从reader(rd)中读取的操作都与相应的对writer(&value)的写入操作相匹配。没有内部缓冲——写入操作必须在读取操作完成之前完成。 写入时遇到的任何错误都将报告为读错误。
-			anotherReader := io.TeeReader(rd, &value)
-			o := types.ParseObject(anotherReader, typeByte, key)
-
-			// 计算当前key的内存开销
+			key, err := structure.ReadString(rd)
+			if err != nil {
+				return ld.parseError(err, "")
+			}
 			e := entry.NewEntry()
 			e.IsBase = true
 			e.DbId = ld.nowDBId
 			e.Key = key
-			overhead := o.MemOverhead()
-			if ld.expireMs != 0 {
-				// 有过期时间,加上过期时间占用.过期字典中一个key的总占用为24
-				overhead += 24
+			e.Idle = ld.idle
+			e.Freq = ld.freq
+			if ld.expireAt != 0 {
 				e.IsExpireKey = true
+				e.ExpireAt = ld.expireAt
+			}
+			if ld.pipeline != nil {
+				err = ld.submitValue(rd, typeByte, e)
+			} else {
+				err = ld.decodeValue(rd, typeByte, e)
+			}
+			if err != nil {
+				return err
 			}
-			e.Overhead = overhead
-			ld.ch <- e
 
 			// 发送到channel之后复位
-			ld.expireMs = 0
-			ld.idle = 0
-			ld.freq = 0
+			ld.resetKeyMeta()
 		}
 		select {
 		case <-tick:
 			UpdateRDBSentSize()
+			if ld.options.SkipRoleCheck {
+				break
+			}
 			// 检查是否为主节点（因为可能发生主从切换）。
 			infoReplication, _ := utils.GetRedisClient().Info(context.Background(), "Replication").Result()
 			if utils.ParseInfoProp(infoReplication, "role") == "master" {
 				log.Warnf("current node is master, can't execute data analysis, terminal rdb read.")
-				return
+				return ld.parseError(ErrRoleChanged, "")
 			}
 		default:
 		}
 	}
+	return nil
+}
+
+// decodeValue 在当前goroutine中解析value并发送entry
+func (ld *Loader) decodeValue(rd io.Reader, typeByte byte, e *entry.Entry) error {
+	offset := ld.rd.offset
+	o, err := types.ParseObject(rd, typeByte, e.Key, ld.profile)
+	if err != nil {
+		return ld.parseError(err, e.Key)
+	}
+	// 计算当前key的内存开销
+	fillEntry(e, o)
+	statistics.AddDecodedKey(uint64(ld.rd.offset - offset))
+	ld.ch <- e
+	return nil
+}
+
+// submitValue 只切分出value的原始字节, 交给worker解析。无法跳过的类型在这里直接解析
+func (ld *Loader) submitValue(rd io.Reader, typeByte byte, e *entry.Entry) error {
+	job := &decodeJob{offset: ld.rd.offset, typeByte: typeByte, e: e, profile: ld.profile}
+	if types.CanSkip(typeByte) {
+		var value bytes.Buffer
+		// io.TeeReader返回一个Reader，它将从reader(rd)中读取的内容写入writer(&value)。
+		// 通过它执行的所有从reader(rd)中读取的操作都与相应的对writer(&value)的写入操作相匹配。没有内部缓冲——写入操作必须在读取操作完成之前完成。 写入时遇到的任何错误都将报告为读错误。
+		if err := types.SkipObject(io.TeeReader(rd, &value), typeByte); err != nil {
+			return ld.parseError(err, e.Key)
+		}
+		job.payload = value.Bytes()
+	} else {
+		o, err := types.ParseObject(rd, typeByte, e.Key, ld.profile)
+		if err != nil {
+			return ld.parseError(err, e.Key)
+		}
+		job.object = o
+	}
+	job.size = uint64(ld.rd.offset - job.offset)
+	return ld.pipeline.submit(job)
+}
+
+// send 发送不需要解析的entry(如函数库), 并行解析时经过worker发送以保证顺序
+func (ld *Loader) send(e *entry.Entry) error {
+	if ld.pipeline == nil {
+		ld.ch <- e
+		return nil
+	}
+	return ld.pipeline.submit(&decodeJob{offset: ld.rd.offset, e: e})
+}
+
+// fillEntry 填充entry的类型、编码和内存开销
+func fillEntry(e *entry.Entry, o types.RedisObject) {
+	e.Type = o.Type()
+	e.Encoding = o.Encoding()
+	e.Length = o.Len()
+	overhead := o.MemOverhead()
+	if e.IsExpireKey {
+		// 有过期时间,加上过期时间占用.过期字典中一个key的总占用为24
+		overhead += 24
+	}
+	e.Overhead = overhead
+}
+
+// resetKeyMeta 复位只对下一个key生效的过期时间、LRU和LFU信息
+func (ld *Loader) resetKeyMeta() {
+	ld.expireAt = 0
+	ld.idle = -1
+	ld.freq = -1
+}
+
+// readPreGAFunction 读取redis 7.0 rc1/rc2 格式的函数库, 转换为对应版本的 FUNCTION CREATE 命令
+// FUNCTION CREATE <engine> <name> [DESC <desc>] <code>
+func readPreGAFunction(rd io.Reader) ([]string, error) {
+	name, err := structure.ReadString(rd)
+	if err != nil {
+		return nil, err
+	}
+	engineName, err := structure.ReadString(rd)
+	if err != nil {
+		return nil, err
+	}
+	hasDesc, err := structure.ReadLength(rd)
+	if err != nil {
+		return nil, err
+	}
+	argv := []string{"function", "create", engineName, name}
+	if hasDesc != 0 {
+		desc, err := structure.ReadString(rd)
+		if err != nil {
+			return nil, err
+		}
+		argv = append(argv, "desc", desc)
+	}
+	code, err := structure.ReadString(rd)
+	if err != nil {
+		return nil, err
+	}
+	return append(argv, code), nil
+}
+
+// verifyChecksum 校验rdb文件末尾的CRC64校验和。校验和覆盖从魔数开始到EOF标识(含)为止的所有字节
+// 当redis配置了 rdbchecksum no 时, 写入的校验和为0, 此时跳过校验
+func (ld *Loader) verifyChecksum(rd io.Reader) error {
+	if ld.version < checksumMinVersion {
+		return nil
+	}
+	// 读取校验和之前记录当前的CRC64, 校验和本身不参与计算
+	expected := ld.rd.digest.Sum64()
+	actual, err := structure.ReadUint64(rd)
+	if err != nil {
+		return ld.parseError(err, "")
+	}
+	if actual == 0 {
+		log.Infof("RDB checksum is disabled, skip verification")
+		return nil
+	}
+	if actual != expected {
+		return ld.parseError(fmt.Errorf("%w: checksum mismatch. expected=[%x], actual=[%x]", ErrCorruptRDB, expected, actual), "")
+	}
+	log.Infof("RDB checksum verified. checksum=[%x]", actual)
+	return nil
 }
 
 // createValueDump创建value的dump字符串 以便restore到redis中
@@ -0,0 +1,293 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/leijianzhong001/redis_agent/internal/entry"
+	"github.com/leijianzhong001/redis_agent/internal/rdb/structure"
+	"github.com/leijianzhong001/redis_agent/internal/rdb/types"
+	"github.com/leijianzhong001/redis_agent/internal/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// parseBytes 将data写入临时文件并解析, 返回解析到的entry和错误
+func parseBytes(t *testing.T, data []byte) ([]*entry.Entry, error) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan *entry.Entry, 16)
+	_, err := NewLoader(path, ch).ParseRDB()
+	close(ch)
+	var entries []*entry.Entry
+	for e := range ch {
+		entries = append(entries, e)
+	}
+	return entries, err
+}
+
+func TestParseRDBTruncatedValue(t *testing.T) {
+	// SELECTDB 0, string类型的key "k1", value声明长度为5, 但文件只剩3个字节
+	data := []byte("REDIS0009")
+	data = append(data, kFlagSelect, 0x00)
+	data = append(data, 0x00, 0x02, 'k', '1', 0x05, 'a', 'b', 'c')
+	_, err := parseBytes(t, data)
+
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("ParseRDB() error = %v, want *ParseError", err)
+	}
+	if parseErr.Key != "k1" || parseErr.Offset != int64(len(data)) {
+		t.Errorf("ParseError key=[%s], offset=[%d], want key=[k1], offset=[%d]", parseErr.Key, parseErr.Offset, len(data))
+	}
+	if !errors.Is(err, structure.ErrTruncated) {
+		t.Errorf("ParseRDB() error = %v, want ErrTruncated", err)
+	}
+}
+
+func TestParseRDBHugeLength(t *testing.T) {
+	// string类型的key "k1", value声明长度为 2^40, 不能在读取之前按照声明的长度分配内存
+	data := []byte("REDIS0009")
+	data = append(data, kFlagSelect, 0x00)
+	data = append(data, 0x00, 0x02, 'k', '1', 0x81, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 'a', 'b', 'c')
+	_, err := parseBytes(t, data)
+
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || !errors.Is(err, structure.ErrTruncated) {
+		t.Fatalf("ParseRDB() error = %v, want *ParseError with ErrTruncated", err)
+	}
+	if parseErr.Key != "k1" || parseErr.Offset != int64(len(data)) {
+		t.Errorf("ParseError key=[%s], offset=[%d], want key=[k1], offset=[%d]", parseErr.Key, parseErr.Offset, len(data))
+	}
+}
+
+func TestParseRDBUnknownType(t *testing.T) {
+	data := []byte("REDIS0009")
+	data = append(data, 0x64, 0x02, 'k', '1', 0x00)
+	_, err := parseBytes(t, data)
+	if !errors.Is(err, types.ErrUnknownType) {
+		t.Fatalf("ParseRDB() error = %v, want ErrUnknownType", err)
+	}
+}
+
+func TestParseRDBBadMagic(t *testing.T) {
+	_, err := parseBytes(t, []byte("RDBXX0009\xff"))
+	if !errors.Is(err, structure.ErrBadEncoding) {
+		t.Fatalf("ParseRDB() error = %v, want ErrBadEncoding", err)
+	}
+}
+
+// withChecksum 在data末尾追加8个字节小端序的CRC64校验和
+func withChecksum(data []byte, sum uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, sum)
+	return append(data, buf...)
+}
+
+// simpleRDB 只包含一个string类型的key "k1"的rdb文件内容, 不含校验和
+func simpleRDB() []byte {
+	data := []byte("REDIS0009")
+	data = append(data, kFlagSelect, 0x00)
+	data = append(data, 0x00, 0x02, 'k', '1', 0x02, 'v', '1')
+	return append(data, kEOF)
+}
+
+func TestParseRDB(t *testing.T) {
+	data := simpleRDB()
+	entries, err := parseBytes(t, withChecksum(data, utils.CalcCRC64(data)))
+	if err != nil {
+		t.Fatalf("ParseRDB() error: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Key != "k1" || entries[0].Overhead == 0 {
+		t.Fatalf("ParseRDB() entries = %v", entries)
+	}
+}
+
+func TestParseRDBChecksumMismatch(t *testing.T) {
+	data := simpleRDB()
+	_, err := parseBytes(t, withChecksum(data, utils.CalcCRC64(data)+1))
+	if !errors.Is(err, ErrCorruptRDB) {
+		t.Fatalf("ParseRDB() error = %v, want ErrCorruptRDB", err)
+	}
+}
+
+func TestParseRDBChecksumDisabled(t *testing.T) {
+	// rdbchecksum no 时写入的校验和为0
+	if _, err := parseBytes(t, withChecksum(simpleRDB(), 0)); err != nil {
+		t.Fatalf("ParseRDB() error: %v", err)
+	}
+}
+
+func TestParseRDBModuleAuxAndFunction(t *testing.T) {
+	code := "#!lua name=mylib\nredis.register_function('f', function() return 1 end)"
+	data := []byte("REDIS0010")
+	// MODULE_AUX: moduleid=0, when_opcode=UINT, when=2, 数据为 UINT(5) STRING("ab") EOF
+	data = append(data, kFlagModuleAux, 0x00, 0x02, 0x02, 0x02, 0x05, 0x05, 0x02, 'a', 'b', 0x00)
+	// FUNCTION2: 函数库源码
+	data = append(data, kFlagFunction2, 0x40, byte(len(code)))
+	data = append(data, code...)
+	data = append(data, kFlagSelect, 0x00)
+	data = append(data, 0x00, 0x02, 'k', '1', 0x02, 'v', '1')
+	data = append(data, kEOF)
+
+	entries, err := parseBytes(t, withChecksum(data, utils.CalcCRC64(data)))
+	if err != nil {
+		t.Fatalf("ParseRDB() error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("ParseRDB() returned %d entries, want 2", len(entries))
+	}
+	if argv := entries[0].Argv; len(argv) != 3 || argv[0] != "function" || argv[2] != code {
+		t.Errorf("function entry argv = %v", argv)
+	}
+	if entries[1].Key != "k1" {
+		t.Errorf("key entry = %s, want k1", entries[1].Key)
+	}
+}
+
+func TestParseRDBKeyMeta(t *testing.T) {
+	expireAt := make([]byte, 8)
+	binary.LittleEndian.PutUint64(expireAt, 1700000000000)
+	data := []byte("REDIS0009")
+	data = append(data, kFlagSelect, 0x03)
+	data = append(data, kFlagExpireMs)
+	data = append(data, expireAt...)
+	data = append(data, kFlagIdle, 0x0a)
+	data = append(data, 0x00, 0x02, 'k', '1', 0x02, '1', '2')
+	data = append(data, 0x00, 0x02, 'k', '2', 0x02, 'v', '2')
+	entries, err := parseBytes(t, withChecksum(append(data, kEOF), 0))
+	if err != nil {
+		t.Fatalf("ParseRDB() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("ParseRDB() entries = %d, want 2", len(entries))
+	}
+
+	k1 := entries[0]
+	if !k1.IsExpireKey || k1.ExpireAt != 1700000000000 || k1.Idle != 10 || k1.Freq != -1 || k1.DbId != 3 {
+		t.Errorf("unexpected k1 %+v", k1)
+	}
+	if k1.Type != types.StringType || k1.Encoding != types.EncodingInt || k1.Length != 2 {
+		t.Errorf("k1 type=[%s], encoding=[%s], length=[%d]", k1.Type, k1.Encoding, k1.Length)
+	}
+	// 过期时间和LRU只对紧随其后的key生效
+	k2 := entries[1]
+	if k2.IsExpireKey || k2.ExpireAt != 0 || k2.Idle != -1 || k2.Encoding != types.EncodingEmbstr {
+		t.Errorf("unexpected k2 %+v", k2)
+	}
+}
+
+// rdbStr 6bit长度前缀的rdb字符串
+func rdbStr(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+// multiTypeRDB 包含string、hash、set、zset2、函数库以及一个会在worker中解析失败的key(可选)的rdb文件内容
+func multiTypeRDB(keys int, broken bool) []byte {
+	data := []byte("REDIS0010")
+	data = append(data, kFlagSelect, 0x00)
+	data = append(data, kFlagFunction2)
+	data = append(data, rdbStr("#!lua name=lib")...)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("user%d:key%d", i%3, i)
+		switch i % 4 {
+		case 0:
+			data = append(data, 0x00)
+			data = append(data, rdbStr(key)...)
+			data = append(data, rdbStr(strings.Repeat("v", i%50))...)
+		case 1:
+			data = append(data, 0x04)
+			data = append(data, rdbStr(key)...)
+			data = append(data, 0x02)
+			data = append(data, rdbStr("f1")...)
+			data = append(data, rdbStr("v1")...)
+			data = append(data, rdbStr("f2")...)
+			data = append(data, rdbStr(strings.Repeat("x", 60))...)
+		case 2:
+			data = append(data, 0x02)
+			data = append(data, rdbStr(key)...)
+			data = append(data, 0x03)
+			data = append(data, rdbStr("1")...)
+			data = append(data, rdbStr("2")...)
+			data = append(data, rdbStr("a")...)
+		case 3:
+			data = append(data, 0x05)
+			data = append(data, rdbStr(key)...)
+			data = append(data, 0x01)
+			data = append(data, rdbStr("m")...)
+			data = append(data, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f) // 1.0
+		}
+	}
+	if broken {
+		// listpack编码的hash, 字符串长度正确但是listpack内容无法解析
+		data = append(data, 0x10)
+		data = append(data, rdbStr("user0:broken")...)
+		data = append(data, rdbStr("\x07\x00\x00\x00\x00\x00\x00")...)
+	}
+	return withChecksum(append(data, kEOF), 0)
+}
+
+func parseBytesWithOptions(t *testing.T, data []byte, options LoaderOptions) ([]*entry.Entry, error) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan *entry.Entry, 16)
+	var entries []*entry.Entry
+	done := make(chan struct{})
+	go func() {
+		for e := range ch {
+			entries = append(entries, e)
+		}
+		close(done)
+	}()
+	_, err := NewLoaderWithOptions(path, ch, options).ParseRDB()
+	close(ch)
+	<-done
+	return entries, err
+}
+
+func TestParseRDBParallel(t *testing.T) {
+	data := multiTypeRDB(200, false)
+	sequential, err := parseBytesWithOptions(t, data, LoaderOptions{})
+	if err != nil {
+		t.Fatalf("sequential ParseRDB() error = %v", err)
+	}
+	ordered, err := parseBytesWithOptions(t, data, LoaderOptions{Workers: 4, Ordered: true})
+	if err != nil {
+		t.Fatalf("parallel ParseRDB() error = %v", err)
+	}
+	if len(ordered) != len(sequential) || len(sequential) != 201 {
+		t.Fatalf("entries sequential=%d, ordered=%d", len(sequential), len(ordered))
+	}
+	for i := range sequential {
+		s, o := sequential[i], ordered[i]
+		if s.Key != o.Key || s.Type != o.Type || s.Encoding != o.Encoding || strings.Join(s.Argv, " ") != strings.Join(o.Argv, " ") {
+			t.Fatalf("entry %d differs: sequential=%+v, ordered=%+v", i, s, o)
+		}
+		// zset的跳表层数是随机的, 其余类型的开销应当完全一致
+		if s.Type != types.ZSetType && s.Overhead != o.Overhead {
+			t.Errorf("entry %d overhead sequential=%d, ordered=%d", i, s.Overhead, o.Overhead)
+		}
+	}
+
+	unordered, err := parseBytesWithOptions(t, data, LoaderOptions{Workers: 4})
+	if err != nil {
+		t.Fatalf("unordered ParseRDB() error = %v", err)
+	}
+	if len(unordered) != len(sequential) {
+		t.Errorf("unordered entries = %d, want %d", len(unordered), len(sequential))
+	}
+}
+
+func TestParseRDBParallelWorkerError(t *testing.T) {
+	_, err := parseBytesWithOptions(t, multiTypeRDB(50, true), LoaderOptions{Workers: 4, Ordered: true})
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Key != "user0:broken" {
+		t.Fatalf("ParseRDB() error = %v, want *ParseError of user0:broken", err)
+	}
+}
@@ -1,20 +1,37 @@
 package structure
 
 import (
-	"github.com/leijianzhong001/redis_agent/internal/log"
+	"bytes"
 	"io"
 )
 
-func ReadByte(rd io.Reader) byte {
-	b := ReadBytes(rd, 1)[0]
-	return b
-}
+// readChunkSize 长度超过该值时分块读取, 损坏的长度不会在读取之前就分配大量内存
+const readChunkSize = 64 * 1024
 
-func ReadBytes(rd io.Reader, n int) []byte {
-	buf := make([]byte, n)
-	_, err := io.ReadFull(rd, buf)
+func ReadByte(rd io.Reader) (byte, error) {
+	buf, err := ReadBytes(rd, 1)
 	if err != nil {
-		log.PanicError(err)
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+func ReadBytes(rd io.Reader, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, BadEncoding("negative length %d", n)
+	}
+	if n <= readChunkSize {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, readError(err, n)
+		}
+		return buf, nil
+	}
+	// 内存随着实际读到的数据增长, 文件在读完之前结束时返回ErrTruncated
+	var buf bytes.Buffer
+	buf.Grow(readChunkSize)
+	if _, err := io.CopyN(&buf, rd, int64(n)); err != nil {
+		return nil, readError(err, n)
 	}
-	return buf
+	return buf.Bytes(), nil
 }
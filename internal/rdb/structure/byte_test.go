@@ -0,0 +1,34 @@
+package structure
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReadBytes(t *testing.T) {
+	data := bytes.Repeat([]byte{'a'}, readChunkSize*2+1)
+	buf, err := ReadBytes(bytes.NewReader(data), len(data))
+	if err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("ReadBytes() = %d bytes, %v", len(buf), err)
+	}
+
+	// 声明的长度远大于实际数据时返回ErrTruncated, 而不是先按照声明的长度分配内存
+	if _, err = ReadBytes(bytes.NewReader(data), 1<<40); !errors.Is(err, ErrTruncated) {
+		t.Errorf("ReadBytes(1<<40) error = %v, want ErrTruncated", err)
+	}
+	if _, err = ReadBytes(bytes.NewReader(data[:3]), 5); !errors.Is(err, ErrTruncated) {
+		t.Errorf("ReadBytes(5) error = %v, want ErrTruncated", err)
+	}
+	if _, err = ReadBytes(bytes.NewReader(data), -1); !errors.Is(err, ErrBadEncoding) {
+		t.Errorf("ReadBytes(-1) error = %v, want ErrBadEncoding", err)
+	}
+}
+
+func TestReadStringHugeLzfLength(t *testing.T) {
+	// LZF压缩字符串, 压缩后长度为2, 声明压缩前长度为 2^30
+	data := []byte{0xc3, 0x02, 0x80, 0x40, 0x00, 0x00, 0x00, 0x01, 'a'}
+	if _, err := ReadString(bytes.NewReader(data)); !errors.Is(err, ErrBadEncoding) {
+		t.Errorf("ReadString() error = %v, want ErrBadEncoding", err)
+	}
+}
@@ -0,0 +1,27 @@
+package structure
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrTruncated rdb数据在读取完整之前就已经结束
+	ErrTruncated = errors.New("truncated rdb")
+	// ErrBadEncoding rdb数据中存在无法识别的编码
+	ErrBadEncoding = errors.New("bad encoding")
+)
+
+// BadEncoding 返回一个可以通过 errors.Is(err, ErrBadEncoding) 判断的错误
+func BadEncoding(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrBadEncoding, fmt.Sprintf(format, args...))
+}
+
+// readError 将io.ReadFull返回的EOF类错误转换为ErrTruncated
+func readError(err error, n int) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: expect %d bytes", ErrTruncated, n)
+	}
+	return err
+}
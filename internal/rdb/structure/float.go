@@ -2,43 +2,52 @@ package structure
 
 import (
 	"encoding/binary"
-	"github.com/leijianzhong001/redis_agent/internal/log"
 	"io"
 	"math"
 	"strconv"
 )
 
-func ReadFloat(rd io.Reader) float64 {
-	u := ReadUint8(rd)
+func ReadFloat(rd io.Reader) (float64, error) {
+	u, err := ReadUint8(rd)
+	if err != nil {
+		return 0, err
+	}
 
 	switch u {
 	case 253:
-		return math.NaN()
+		return math.NaN(), nil
 	case 254:
-		return math.Inf(0)
+		return math.Inf(0), nil
 	case 255:
-		return math.Inf(-1)
+		return math.Inf(-1), nil
 	default:
-		buf := make([]byte, u)
-		_, err := io.ReadFull(rd, buf)
+		buf, err := ReadBytes(rd, int(u))
 		if err != nil {
-			return 0
+			return 0, err
 		}
 
 		v, err := strconv.ParseFloat(string(buf), 64)
 		if err != nil {
-			log.PanicError(err)
+			return 0, BadEncoding("invalid float %q", buf)
 		}
-		return v
+		return v, nil
 	}
 }
 
-func ReadDouble(rd io.Reader) float64 {
-	var buf = make([]byte, 8)
-	_, err := io.ReadFull(rd, buf)
+func ReadDouble(rd io.Reader) (float64, error) {
+	buf, err := ReadBytes(rd, 8)
 	if err != nil {
-		log.PanicError(err)
+		return 0, err
 	}
 	num := binary.LittleEndian.Uint64(buf)
-	return math.Float64frombits(num)
+	return math.Float64frombits(num), nil
+}
+
+// ReadBinaryFloat 读取4字节的二进制float, 见 rdb.c/rdbLoadBinaryFloatValue
+func ReadBinaryFloat(rd io.Reader) (float32, error) {
+	buf, err := ReadBytes(rd, 4)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float32frombits(binary.LittleEndian.Uint32(buf)), nil
 }
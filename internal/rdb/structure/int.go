@@ -5,54 +5,77 @@ import (
 	"io"
 )
 
-func ReadUint8(rd io.Reader) uint8 {
-	b := ReadByte(rd)
-	return b
+func ReadUint8(rd io.Reader) (uint8, error) {
+	return ReadByte(rd)
 }
 
-func ReadUint16(rd io.Reader) uint16 {
-	buf := ReadBytes(rd, 2)
-	return binary.LittleEndian.Uint16(buf)
+func ReadUint16(rd io.Reader) (uint16, error) {
+	buf, err := ReadBytes(rd, 2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(buf), nil
 }
 
-func ReadUint24(rd io.Reader) uint32 {
-	buf := ReadBytes(rd, 3)
+func ReadUint24(rd io.Reader) (uint32, error) {
+	buf, err := ReadBytes(rd, 3)
+	if err != nil {
+		return 0, err
+	}
 	buf = append(buf, 0)
-	return binary.LittleEndian.Uint32(buf)
+	return binary.LittleEndian.Uint32(buf), nil
 }
 
-func ReadUint32(rd io.Reader) uint32 {
-	buf := ReadBytes(rd, 4)
-	return binary.LittleEndian.Uint32(buf)
+func ReadUint32(rd io.Reader) (uint32, error) {
+	buf, err := ReadBytes(rd, 4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(buf), nil
 }
 
-func ReadUint64(rd io.Reader) uint64 {
-	buf := ReadBytes(rd, 8)
-	return binary.LittleEndian.Uint64(buf)
+func ReadUint64(rd io.Reader) (uint64, error) {
+	buf, err := ReadBytes(rd, 8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf), nil
 }
 
-func ReadInt8(rd io.Reader) int8 {
-	b := ReadByte(rd)
-	return int8(b)
+func ReadInt8(rd io.Reader) (int8, error) {
+	b, err := ReadByte(rd)
+	return int8(b), err
 }
 
-func ReadInt16(rd io.Reader) int16 {
-	buf := ReadBytes(rd, 2)
-	return int16(binary.LittleEndian.Uint16(buf))
+func ReadInt16(rd io.Reader) (int16, error) {
+	buf, err := ReadBytes(rd, 2)
+	if err != nil {
+		return 0, err
+	}
+	return int16(binary.LittleEndian.Uint16(buf)), nil
 }
 
-func ReadInt24(rd io.Reader) int32 {
-	buf := ReadBytes(rd, 3)
+func ReadInt24(rd io.Reader) (int32, error) {
+	buf, err := ReadBytes(rd, 3)
+	if err != nil {
+		return 0, err
+	}
 	buf = append([]byte{0}, buf...)
-	return int32(binary.LittleEndian.Uint32(buf)) >> 8
+	return int32(binary.LittleEndian.Uint32(buf)) >> 8, nil
 }
 
-func ReadInt32(rd io.Reader) int32 {
-	buf := ReadBytes(rd, 4)
-	return int32(binary.LittleEndian.Uint32(buf))
+func ReadInt32(rd io.Reader) (int32, error) {
+	buf, err := ReadBytes(rd, 4)
+	if err != nil {
+		return 0, err
+	}
+	return int32(binary.LittleEndian.Uint32(buf)), nil
 }
 
-func ReadInt64(rd io.Reader) int64 {
-	buf := ReadBytes(rd, 8)
-	return int64(binary.LittleEndian.Uint64(buf))
+func ReadInt64(rd io.Reader) (int64, error) {
+	buf, err := ReadBytes(rd, 8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
 }
@@ -8,15 +8,34 @@ import (
 	"strings"
 )
 
-func ReadIntset(rd io.Reader) []string {
-	rd = bufio.NewReader(strings.NewReader(ReadString(rd)))
+func ReadIntset(rd io.Reader) ([]string, error) {
+	str, err := ReadString(rd)
+	if err != nil {
+		return nil, err
+	}
+	rd = bufio.NewReader(strings.NewReader(str))
 
-	encodingType := int(ReadUint32(rd))
-	size := int(ReadUint32(rd))
+	encodingType, err := ReadUint32(rd)
+	if err != nil {
+		return nil, err
+	}
+	if encodingType != 2 && encodingType != 4 && encodingType != 8 {
+		return nil, BadEncoding("invalid intset encoding %d", encodingType)
+	}
+	size, err := ReadUint32(rd)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(size)*uint64(encodingType) > uint64(len(str)) {
+		return nil, BadEncoding("intset size %d exceeds blob length %d", size, len(str))
+	}
 	elements := make([]string, size)
 
-	for i := 0; i < size; i++ {
-		intBytes := ReadBytes(rd, encodingType)
+	for i := 0; i < int(size); i++ {
+		intBytes, err := ReadBytes(rd, int(encodingType))
+		if err != nil {
+			return nil, err
+		}
 		var intString string
 		switch encodingType {
 		case 2:
@@ -28,5 +47,5 @@ func ReadIntset(rd io.Reader) []string {
 		}
 		elements[i] = intString
 	}
-	return elements
+	return elements, nil
 }
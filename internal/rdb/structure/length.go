@@ -2,8 +2,6 @@ package structure
 
 import (
 	"encoding/binary"
-	"fmt"
-	"github.com/leijianzhong001/redis_agent/internal/log"
 	"io"
 )
 
@@ -17,15 +15,15 @@ const (
 )
 
 // ReadLength 读取长度。即按照整数编码的方式读取整形值或字符串长度
-func ReadLength(rd io.Reader) uint64 {
+func ReadLength(rd io.Reader) (uint64, error) {
 	length, special, err := readEncodedLength(rd)
-	if special {
-		log.Panicf("illegal length special=true, encoding: %d", length)
-	}
 	if err != nil {
-		log.PanicError(err)
+		return 0, err
+	}
+	if special {
+		return 0, BadEncoding("illegal length special=true, encoding: %d", length)
 	}
-	return length
+	return length, nil
 }
 
 // readEncodedLength 获取编码长度
@@ -35,7 +33,10 @@ func readEncodedLength(rd io.Reader) (length uint64, special bool, err error) {
 	// 		- **<font color=00ff00>简单的长度前缀编码字符；</font>**
 	// 		- **<font color=00ff00>使用字符串编码整型；</font>**
 	// 		- **<font color=00ff00>压缩字符串；</font>**
-	firstByte := ReadByte(rd)
+	firstByte, err := ReadByte(rd)
+	if err != nil {
+		return 0, false, err
+	}
 	// 0xc0 => 11000000 与运算，把后面的6 bit都变成0，然后右移6位，取前两个字节
 	first2bits := (firstByte & 0xc0) >> 6 // first 2 bits of encoding
 	switch first2bits {
@@ -46,7 +47,10 @@ func readEncodedLength(rd io.Reader) (length uint64, special bool, err error) {
 		length = uint64(firstByte) & 0x3f
 	case RDB14ByteLen:
 		// 01 如果高位以 01 开始：当前 byte 剩余 6 bit，加上接下来的 8 bit 表示一个整数。
-		nextByte := ReadByte(rd)
+		nextByte, err := ReadByte(rd)
+		if err != nil {
+			return 0, false, err
+		}
 		// 取后6个bit,然后左移八位，给nextByte腾地方
 		// 以实际长度783为例，firstByte为 01000011，nextByte为 00001111
 		// uint64(firstByte)                              ==>  00000000 00000000 00000000 00000000 00000000 00000000 00000000 01000011
@@ -59,17 +63,17 @@ func readEncodedLength(rd io.Reader) (length uint64, special bool, err error) {
 		if firstByte == RDB32ByteLen {
 			_, err = io.ReadFull(rd, lengthBuffer[0:4])
 			if err != nil {
-				return 0, false, fmt.Errorf("read len32Bit failed: %s", err.Error())
+				return 0, false, readError(err, 4)
 			}
 			length = uint64(binary.BigEndian.Uint32(lengthBuffer))
 		} else if firstByte == RDB64ByteLen {
 			_, err = io.ReadFull(rd, lengthBuffer)
 			if err != nil {
-				return 0, false, fmt.Errorf("read len64Bit failed: %s", err.Error())
+				return 0, false, readError(err, 8)
 			}
 			length = binary.BigEndian.Uint64(lengthBuffer)
 		} else {
-			return 0, false, fmt.Errorf("illegal length encoding: %x", firstByte)
+			return 0, false, BadEncoding("illegal length encoding: %x", firstByte)
 		}
 	case lenSpecial:
 		// 11 如果高位以 11 开始：特殊编码格式，剩余 6 bit 用于表示该格式, 剩余6位为：
@@ -2,7 +2,6 @@ package structure
 
 import (
 	"bufio"
-	"github.com/leijianzhong001/redis_agent/internal/log"
 	"io"
 	"math"
 	"strconv"
@@ -38,99 +37,156 @@ const (
 	lpEncoding32BitStr     = 0xF0 // 11110000 LP_ENCODING_32BIT_STR
 )
 
-func ReadListpack(rd io.Reader) []string {
-	rd = bufio.NewReader(strings.NewReader(ReadString(rd)))
+func ReadListpack(rd io.Reader) ([]string, error) {
+	elements, _, err := ReadListpackWithSize(rd)
+	return elements, err
+}
+
+// ReadListpackWithSize 读取listpack, 同时返回整个listpack占用的字节数
+func ReadListpackWithSize(rd io.Reader) ([]string, uint64, error) {
+	str, err := ReadString(rd)
+	if err != nil {
+		return nil, 0, err
+	}
+	elements, err := parseListpack(str)
+	if err != nil {
+		return nil, 0, err
+	}
+	return elements, uint64(len(str)), nil
+}
+
+// parseListpack 解析listpack的原始字节
+func parseListpack(str string) ([]string, error) {
+	rd := bufio.NewReader(strings.NewReader(str))
 
-	_ = ReadUint32(rd) // bytes
-	size := int(ReadUint16(rd))
+	if _, err := ReadUint32(rd); err != nil { // bytes
+		return nil, err
+	}
+	lpSize, err := ReadUint16(rd)
+	if err != nil {
+		return nil, err
+	}
+	size := int(lpSize)
 	var elements []string
 	for i := 0; i < size; i++ {
-		ele := readListpackEntry(rd)
+		ele, err := readListpackEntry(rd)
+		if err != nil {
+			return nil, err
+		}
 		elements = append(elements, ele)
 	}
-	lastByte := ReadByte(rd)
+	lastByte, err := ReadByte(rd)
+	if err != nil {
+		return nil, err
+	}
 	if lastByte != 0xFF {
-		log.Panicf("ReadListpack: last byte is not 0xFF, but [%d]", lastByte)
+		return nil, BadEncoding("ReadListpack: last byte is not 0xFF, but [%d]", lastByte)
 	}
-	return elements
+	return elements, nil
 }
 
 // redis/src/Listpack.c lpGet()
-func readListpackEntry(rd io.Reader) string {
+func readListpackEntry(rd io.Reader) (string, error) {
 	var val int64
 	var uval, negstart, negmax uint64
-	fireByte := ReadByte(rd)
+	var backlen int
+	fireByte, err := ReadByte(rd)
+	if err != nil {
+		return "", err
+	}
 	if (fireByte & lpEncoding7BitUintMask) == lpEncoding7BitUint { // 7bit uint
 
 		uval = uint64(fireByte & 0x7f) // 0x7f is 01111111
 		negmax = 0
-		negstart = math.MaxUint64             // uint
-		_ = ReadBytes(rd, lpEncodeBacklen(1)) // encode: 1 byte
+		negstart = math.MaxUint64 // uint
+		backlen = 1               // encode: 1 byte
 
 	} else if (fireByte & lpEncoding6BitStrMask) == lpEncoding6BitStr { // 6bit length str
 
-		length := int(fireByte & 0x3f) // 0x3f is 00111111
-		ele := string(ReadBytes(rd, length))
-		_ = ReadBytes(rd, lpEncodeBacklen(1+length)) // encode: 1byte, str: length
-		return ele
+		length := int(fireByte & 0x3f)                  // 0x3f is 00111111
+		return readListpackString(rd, length, 1+length) // encode: 1byte, str: length
 
 	} else if (fireByte & lpEncoding13BitIntMask) == lpEncoding13BitInt { // 13bit int
 
-		secondByte := ReadByte(rd)
+		secondByte, err := ReadByte(rd)
+		if err != nil {
+			return "", err
+		}
 		uval = (uint64(fireByte&0x1f) << 8) + uint64(secondByte) // 5bit + 8bit, 0x1f is 00011111
 		negstart = uint64(1) << 12
 		negmax = 8191 // uint13_max
-		_ = ReadBytes(rd, lpEncodeBacklen(2))
+		backlen = 2
 
 	} else if (fireByte & lpEncoding16BitIntMask) == lpEncoding16BitInt { // 16bit int
 
-		uval = uint64(ReadUint16(rd))
+		v, err := ReadUint16(rd)
+		if err != nil {
+			return "", err
+		}
+		uval = uint64(v)
 		negstart = uint64(1) << 15
-		negmax = 65535                        // uint16_max
-		_ = ReadBytes(rd, lpEncodeBacklen(2)) // encode: 1byte, int: 2byte
+		negmax = 65535 // uint16_max
+		backlen = 2    // encode: 1byte, int: 2byte
 
 	} else if (fireByte & lpEncoding24BitIntMask) == lpEncoding24BitInt { // 24bit int
 
-		uval = uint64(ReadUint24(rd))
+		v, err := ReadUint24(rd)
+		if err != nil {
+			return "", err
+		}
+		uval = uint64(v)
 		negstart = uint64(1) << 23
-		negmax = math.MaxUint32 >> 8            // uint24_max
-		_ = ReadBytes(rd, lpEncodeBacklen(1+3)) // encode: 1byte, int: 3byte
+		negmax = math.MaxUint32 >> 8 // uint24_max
+		backlen = 1 + 3              // encode: 1byte, int: 3byte
 
 	} else if (fireByte & lpEncoding32BitIntMask) == lpEncoding32BitInt { // 32bit int
 
-		uval = uint64(ReadUint32(rd))
+		v, err := ReadUint32(rd)
+		if err != nil {
+			return "", err
+		}
+		uval = uint64(v)
 		negstart = uint64(1) << 31
-		negmax = math.MaxUint32                 // uint32_max
-		_ = ReadBytes(rd, lpEncodeBacklen(1+4)) // encode: 1byte, int: 4byte
+		negmax = math.MaxUint32 // uint32_max
+		backlen = 1 + 4         // encode: 1byte, int: 4byte
 
 	} else if (fireByte & lpEncoding64BitIntMask) == lpEncoding64BitInt { // 64bit int
 
-		uval = ReadUint64(rd)
+		uval, err = ReadUint64(rd)
+		if err != nil {
+			return "", err
+		}
 		negstart = uint64(1) << 63
-		negmax = math.MaxUint64                 // uint64_max
-		_ = ReadBytes(rd, lpEncodeBacklen(1+8)) // encode: 1byte, int: 8byte
+		negmax = math.MaxUint64 // uint64_max
+		backlen = 1 + 8         // encode: 1byte, int: 8byte
 
 	} else if (fireByte & lpEncoding12BitStrMask) == lpEncoding12BitStr { // 12bit length str
 
-		secondByte := ReadByte(rd)
+		secondByte, err := ReadByte(rd)
+		if err != nil {
+			return "", err
+		}
 		length := (int(fireByte&0x0f) << 8) + int(secondByte) // 4bit + 8bit
-		ele := string(ReadBytes(rd, length))
-		_ = ReadBytes(rd, lpEncodeBacklen(2+length)) // encode: 2byte, str: length
-		return ele
+		return readListpackString(rd, length, 2+length)       // encode: 2byte, str: length
 
 	} else if (fireByte & lpEncoding32BitStrMask) == lpEncoding32BitStr { // 32bit length str
 
-		length := int(ReadUint32(rd))
-		ele := string(ReadBytes(rd, length))
-		_ = ReadBytes(rd, lpEncodeBacklen(5+length)) // encode: 1byte, length: 4byte, str: length
-		return ele
+		v, err := ReadUint32(rd)
+		if err != nil {
+			return "", err
+		}
+		length := int(v)
+		return readListpackString(rd, length, 5+length) // encode: 1byte, length: 4byte, str: length
 
 	} else {
 		// redis use this value, don't know why
 		// uval = 12345678900000000 + uint64(fireByte)
 		// negstart = math.MaxUint64
 		// negmax = 0
-		log.Panicf("unknown encoding: %x", fireByte)
+		return "", BadEncoding("unknown listpack encoding: %x", fireByte)
+	}
+	if _, err = ReadBytes(rd, lpEncodeBacklen(backlen)); err != nil {
+		return "", err
 	}
 
 	/* We reach this code path only for integer encodings.
@@ -147,7 +203,19 @@ func readListpackEntry(rd io.Reader) string {
 		val = int64(uval)
 	}
 
-	return strconv.FormatInt(val, 10)
+	return strconv.FormatInt(val, 10), nil
+}
+
+// readListpackString 读取listpack中长度为length的字符串，并跳过entryLen对应的backlen
+func readListpackString(rd io.Reader, length int, entryLen int) (string, error) {
+	ele, err := ReadBytes(rd, length)
+	if err != nil {
+		return "", err
+	}
+	if _, err = ReadBytes(rd, lpEncodeBacklen(entryLen)); err != nil {
+		return "", err
+	}
+	return string(ele), nil
 }
 
 /* the function just returns the length(byte) of `backlen`. */
@@ -0,0 +1,65 @@
+package structure
+
+import (
+	"io"
+	"math"
+)
+
+// SkipBytes 跳过n个字节
+func SkipBytes(rd io.Reader, n uint64) error {
+	if n > math.MaxInt64 {
+		return BadEncoding("length %d out of range", n)
+	}
+	written, err := io.CopyN(io.Discard, rd, int64(n))
+	if err != nil {
+		if err == io.EOF && uint64(written) < n {
+			return readError(io.ErrUnexpectedEOF, int(n))
+		}
+		return err
+	}
+	return nil
+}
+
+// SkipString 按照字符串编码的方式跳过一个字符串, 不解压缩LZF字符串, 也不将整数编码转换为字符串
+// ziplist、listpack、intset和zipmap在rdb中都以字符串保存, 同样可以用它跳过
+func SkipString(rd io.Reader) error {
+	length, special, err := readEncodedLength(rd)
+	if err != nil {
+		return err
+	}
+	if !special {
+		return SkipBytes(rd, length)
+	}
+	switch length {
+	case RDBEncInt8:
+		return SkipBytes(rd, 1)
+	case RDBEncInt16:
+		return SkipBytes(rd, 2)
+	case RDBEncInt32:
+		return SkipBytes(rd, 4)
+	case RDBEncLZF:
+		inLen, err := ReadLength(rd) // 压缩后字符串长度
+		if err != nil {
+			return err
+		}
+		if _, err = ReadLength(rd); err != nil { // 压缩前字符串长度
+			return err
+		}
+		return SkipBytes(rd, inLen)
+	default:
+		return BadEncoding("unknown string encode type %d", length)
+	}
+}
+
+// SkipFloat 跳过一个以字符串形式保存的double, 格式见 ReadFloat
+func SkipFloat(rd io.Reader) error {
+	u, err := ReadUint8(rd)
+	if err != nil {
+		return err
+	}
+	if u >= 253 {
+		// NaN、+inf、-inf 没有后续内容
+		return nil
+	}
+	return SkipBytes(rd, uint64(u))
+}
@@ -1,7 +1,6 @@
 package structure
 
 import (
-	"github.com/leijianzhong001/redis_agent/internal/log"
 	"io"
 	"strconv"
 )
@@ -14,42 +13,62 @@ const (
 )
 
 // ReadString 按照字符串编码的方式读取字符串内容
-func ReadString(rd io.Reader) string {
+func ReadString(rd io.Reader) (string, error) {
 	// 获取下一个字符串的长度
 	length, special, err := readEncodedLength(rd)
 	if err != nil {
-		log.PanicError(err)
+		return "", err
 	}
 	if special {
 		switch length {
 		case RDBEncInt8:
 			// 为 0 时：之后 8 bit 用于存储该整型。
-			b := ReadInt8(rd)
-			return strconv.Itoa(int(b))
+			b, err := ReadInt8(rd)
+			return strconv.Itoa(int(b)), err
 		case RDBEncInt16:
 			// 为 1 时：之后 16 bit 用于存储该整型。
-			b := ReadInt16(rd)
-			return strconv.Itoa(int(b))
+			b, err := ReadInt16(rd)
+			return strconv.Itoa(int(b)), err
 		case RDBEncInt32:
 			// 为 2 时：之后 32 bit 用于存储该整型。
-			b := ReadInt32(rd)
-			return strconv.Itoa(int(b))
+			b, err := ReadInt32(rd)
+			return strconv.Itoa(int(b)), err
 		case RDBEncLZF:
 			// 为3时： 压缩字符串编码
-			inLen := ReadLength(rd)         // 压缩后字符串长度
-			outLen := ReadLength(rd)        // 压缩前字符串长度
-			in := ReadBytes(rd, int(inLen)) // 读取压缩后长度的字符串
+			inLen, err := ReadLength(rd) // 压缩后字符串长度
+			if err != nil {
+				return "", err
+			}
+			outLen, err := ReadLength(rd) // 压缩前字符串长度
+			if err != nil {
+				return "", err
+			}
+			in, err := ReadBytes(rd, int(inLen)) // 读取压缩后长度的字符串
+			if err != nil {
+				return "", err
+			}
 
 			return lzfDecompress(in, int(outLen))
 		default:
-			log.Panicf("Unknown string encode type %d", length)
+			return "", BadEncoding("unknown string encode type %d", length)
 		}
 	}
 	// 如果不是11开头的特殊编码，说明是 简单长度前缀字符串方法， 直接读取指定长度的字符串
-	return string(ReadBytes(rd, int(length)))
+	buf, err := ReadBytes(rd, int(length))
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
 }
 
-func lzfDecompress(in []byte, outLen int) string {
+// lzfMaxRatio lzf压缩数据解压之后的最大倍数
+const lzfMaxRatio = 88
+
+func lzfDecompress(in []byte, outLen int) (string, error) {
+	// 一个最长的回溯引用用3个字节表示264个字节, 超过这个比例的outLen一定是损坏的
+	if outLen < 0 || outLen > len(in)*lzfMaxRatio {
+		return "", BadEncoding("lzf decompress failed: outLen: %d, inLen: %d", outLen, len(in))
+	}
 	out := make([]byte, outLen)
 
 	i, o := 0, 0
@@ -57,19 +76,33 @@ func lzfDecompress(in []byte, outLen int) string {
 		ctrl := int(in[i])
 		i++
 		if ctrl < 32 {
+			// 字面量, 之后的 ctrl+1 个字节原样拷贝
+			if i+ctrl >= len(in) || o+ctrl >= outLen {
+				return "", BadEncoding("lzf decompress failed: literal out of range, i: %d, o: %d", i, o)
+			}
 			for x := 0; x <= ctrl; x++ {
 				out[o] = in[i]
 				i++
 				o++
 			}
 		} else {
+			// 回溯引用, 从已经解压的数据中拷贝 length+2 个字节
 			length := ctrl >> 5
 			if length == 7 {
+				if i >= len(in) {
+					return "", BadEncoding("lzf decompress failed: truncated back reference")
+				}
 				length = length + int(in[i])
 				i++
 			}
+			if i >= len(in) {
+				return "", BadEncoding("lzf decompress failed: truncated back reference")
+			}
 			ref := o - ((ctrl & 0x1f) << 8) - int(in[i]) - 1
 			i++
+			if ref < 0 || o+length+1 >= outLen {
+				return "", BadEncoding("lzf decompress failed: back reference out of range, ref: %d, o: %d", ref, o)
+			}
 			for x := 0; x <= length+1; x++ {
 				out[o] = out[ref]
 				ref++
@@ -78,7 +111,7 @@ func lzfDecompress(in []byte, outLen int) string {
 		}
 	}
 	if o != outLen {
-		log.Panicf("lzf decompress failed: outLen: %d, o: %d", outLen, o)
+		return "", BadEncoding("lzf decompress failed: outLen: %d, o: %d", outLen, o)
 	}
-	return string(out)
+	return string(out), nil
 }
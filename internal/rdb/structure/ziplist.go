@@ -3,7 +3,6 @@ package structure
 import (
 	"bufio"
 	"encoding/binary"
-	"github.com/leijianzhong001/redis_agent/internal/log"
 	"io"
 	"strconv"
 	"strings"
@@ -23,33 +22,65 @@ const (
 	zipInt64B = 0xe0 // 11100000
 )
 
-func ReadZipList(rd io.Reader) []string {
-	rd = bufio.NewReader(strings.NewReader(ReadString(rd)))
+func ReadZipList(rd io.Reader) ([]string, error) {
+	str, err := ReadString(rd)
+	if err != nil {
+		return nil, err
+	}
+	rd = bufio.NewReader(strings.NewReader(str))
 
 	// The general layout of the ziplist is as follows:
 	// <zlbytes> <zltail> <zllen> <entry> <entry> ... <entry> <zlend>
-	_ = ReadUint32(rd) // zlbytes 整个压缩列表占用的字节数
-	_ = ReadUint32(rd) // zltail 尾节点的起始地址距离压缩列表起始地址的偏移量
+	if _, err = ReadUint32(rd); err != nil { // zlbytes 整个压缩列表占用的字节数
+		return nil, err
+	}
+	if _, err = ReadUint32(rd); err != nil { // zltail 尾节点的起始地址距离压缩列表起始地址的偏移量
+		return nil, err
+	}
 
-	size := int(ReadUint16(rd)) // zllen 压缩列表中的元素数量
+	zllen, err := ReadUint16(rd) // zllen 压缩列表中的元素数量
+	if err != nil {
+		return nil, err
+	}
+	size := int(zllen)
 	var elements []string
 	if size == 65535 { // 2^16-1, we need to traverse the entire list to know how many items it holds.
 		// 如果节点实际数量超出了最大值65534，则记录为65535，节点的真实数量只有完全遍历整个压缩列表才能知道
-		for firstByte := ReadByte(rd); firstByte != 0xFE; firstByte = ReadByte(rd) {
-			ele := readZipListEntry(rd, firstByte)
+		for {
+			firstByte, err := ReadByte(rd)
+			if err != nil {
+				return nil, err
+			}
+			if firstByte == 0xFF {
+				break
+			}
+			ele, err := readZipListEntry(rd, firstByte)
+			if err != nil {
+				return nil, err
+			}
 			elements = append(elements, ele)
 		}
 	} else {
 		for i := 0; i < size; i++ {
-			firstByte := ReadByte(rd)
-			ele := readZipListEntry(rd, firstByte)
+			firstByte, err := ReadByte(rd)
+			if err != nil {
+				return nil, err
+			}
+			ele, err := readZipListEntry(rd, firstByte)
+			if err != nil {
+				return nil, err
+			}
 			elements = append(elements, ele)
 		}
-		if lastByte := ReadByte(rd); lastByte != 0xFF {
-			log.Panicf("invalid zipList lastByte encoding: %d", lastByte)
+		lastByte, err := ReadByte(rd)
+		if err != nil {
+			return nil, err
+		}
+		if lastByte != 0xFF {
+			return nil, BadEncoding("invalid zipList lastByte encoding: %d", lastByte)
 		}
 	}
-	return elements
+	return elements, nil
 }
 
 /*
@@ -68,53 +99,72 @@ func ReadZipList(rd io.Reader) []string {
  * 2、`encoding`：编码属性，**记录`content`的数据类型**（字符串还是整数）以及长度，占用1个、2个或5个字节
  * 3、`contents`：负责保存节点的数据，可以是字符串或整数
  */
-func readZipListEntry(rd io.Reader, firstByte byte) string {
+func readZipListEntry(rd io.Reader, firstByte byte) (string, error) {
+	var err error
 	// read prevlen
 	if firstByte == 0xFE {
-		_ = ReadUint32(rd) // read 4 bytes prevlen
+		if _, err = ReadUint32(rd); err != nil { // read 4 bytes prevlen
+			return "", err
+		}
 	}
 
 	// read encoding
-	firstByte = ReadByte(rd)
+	firstByte, err = ReadByte(rd)
+	if err != nil {
+		return "", err
+	}
 	first2bits := (firstByte & 0xc0) >> 6 // first 2 bits of encoding
 	switch first2bits {
 	case zipStr06B:
 		length := int(firstByte & 0x3f) // 0x3f = 00111111
-		return string(ReadBytes(rd, length))
+		return readZipListString(rd, length)
 	case zipStr14B:
-		secondByte := ReadByte(rd)
+		secondByte, err := ReadByte(rd)
+		if err != nil {
+			return "", err
+		}
 		length := (int(firstByte&0x3f) << 8) | int(secondByte)
-		return string(ReadBytes(rd, length))
+		return readZipListString(rd, length)
 	case zipStr32B:
-		lenBytes := ReadBytes(rd, 4)
+		lenBytes, err := ReadBytes(rd, 4)
+		if err != nil {
+			return "", err
+		}
 		length := binary.BigEndian.Uint32(lenBytes)
-		return string(ReadBytes(rd, int(length)))
+		return readZipListString(rd, int(length))
 	}
 	switch firstByte {
 	case zipInt08B:
-		v := ReadInt8(rd)
-		return strconv.FormatInt(int64(v), 10)
+		v, err := ReadInt8(rd)
+		return strconv.FormatInt(int64(v), 10), err
 	case zipInt16B:
-		v := ReadInt16(rd)
-		return strconv.FormatInt(int64(v), 10)
+		v, err := ReadInt16(rd)
+		return strconv.FormatInt(int64(v), 10), err
 	case zipInt24B:
-		v := ReadInt24(rd)
-		return strconv.FormatInt(int64(v), 10)
+		v, err := ReadInt24(rd)
+		return strconv.FormatInt(int64(v), 10), err
 	case zipInt32B:
-		v := ReadInt32(rd)
-		return strconv.FormatInt(int64(v), 10)
+		v, err := ReadInt32(rd)
+		return strconv.FormatInt(int64(v), 10), err
 	case zipInt64B:
-		v := ReadInt64(rd)
-		return strconv.FormatInt(v, 10)
+		v, err := ReadInt64(rd)
+		return strconv.FormatInt(v, 10), err
 	}
 	if (firstByte >> 4) == zipInt04B {
 		v := int64(firstByte & 0x0f) // 0x0f = 00001111
 		v = v - 1                    // 1-13 -> 0-12
 		if v < 0 || v > 12 {
-			log.Panicf("invalid zipInt04B encoding: %d", v)
+			return "", BadEncoding("invalid zipInt04B encoding: %d", v)
 		}
-		return strconv.FormatInt(v, 10)
+		return strconv.FormatInt(v, 10), nil
+	}
+	return "", BadEncoding("invalid zipList entry encoding: %d", firstByte)
+}
+
+func readZipListString(rd io.Reader, length int) (string, error) {
+	buf, err := ReadBytes(rd, length)
+	if err != nil {
+		return "", err
 	}
-	log.Panicf("invalid encoding: %d", firstByte)
-	return ""
+	return string(buf), nil
 }
@@ -0,0 +1,92 @@
+package structure
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+const (
+	zipmapBigLen = 254 // ZIPMAP_BIGLEN 长度大于等于254时，后面紧跟4个字节表示真实长度
+	zipmapEnd    = 255 // ZIPMAP_END zipmap结束符
+)
+
+// ReadZipmap 读取zipmap编码的hash（redis 2.6之前的小hash编码），按照 field1, value1, field2, value2 ... 的顺序返回
+// zipmap的结构如下(见zipmap.c)：
+//
+//	<zmlen><len>"foo"<len><free>"bar"<len>"hello"<len><free>"world"<end>
+//
+//	- `zmlen` 1字节，记录键值对的数量。当数量大于等于254时，该值无意义，只有完全遍历整个zipmap才能知道
+//	- `len` 1字节或5字节，记录之后字符串的长度。第一个字节小于254时即为长度，等于254时后面4个字节才是真实长度，等于255时表示zipmap结束
+//	- `free` 1字节，记录value之后未使用的空闲字节数, 读取时需要跳过
+//	- `end` 1字节，0xFF 标记zipmap的结束
+func ReadZipmap(rd io.Reader) ([]string, error) {
+	str, err := ReadString(rd)
+	if err != nil {
+		return nil, err
+	}
+	rd = bufio.NewReader(strings.NewReader(str))
+
+	if _, err = ReadByte(rd); err != nil { // zmlen 不可信，统一遍历到结束符
+		return nil, err
+	}
+	var elements []string
+	for {
+		fieldLen, end, err := readZipmapLength(rd)
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			break
+		}
+		field, err := ReadBytes(rd, int(fieldLen))
+		if err != nil {
+			return nil, err
+		}
+
+		valueLen, end, err := readZipmapLength(rd)
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			return nil, BadEncoding("ReadZipmap: unexpected end of zipmap after field [%s]", field)
+		}
+		free, err := ReadByte(rd)
+		if err != nil {
+			return nil, err
+		}
+		value, err := ReadBytes(rd, int(valueLen))
+		if err != nil {
+			return nil, err
+		}
+		// 跳过value之后的空闲字节
+		if _, err = ReadBytes(rd, int(free)); err != nil {
+			return nil, err
+		}
+
+		elements = append(elements, string(field), string(value))
+	}
+	return elements, nil
+}
+
+// readZipmapLength 读取zipmap中的长度编码, end为true表示读到了zipmap结束符
+func readZipmapLength(rd io.Reader) (length uint32, end bool, err error) {
+	firstByte, err := ReadByte(rd)
+	if err != nil {
+		return 0, false, err
+	}
+	switch firstByte {
+	case zipmapEnd:
+		return 0, true, nil
+	case zipmapBigLen:
+		// zipmap.c 中直接memcpy了unsigned int, 这里按照小端序读取
+		buf, err := ReadBytes(rd, 4)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.LittleEndian.Uint32(buf), false, nil
+	default:
+		return uint32(firstByte), false, nil
+	}
+}
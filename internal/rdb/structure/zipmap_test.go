@@ -0,0 +1,70 @@
+package structure
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// rdbString 将原始字节按照rdb的简单长度前缀方式编码为字符串
+func rdbString(raw []byte) []byte {
+	if len(raw) < 64 {
+		return append([]byte{byte(len(raw))}, raw...)
+	}
+	return append([]byte{0x40 | byte(len(raw)>>8), byte(len(raw))}, raw...)
+}
+
+func TestReadZipmap(t *testing.T) {
+	// {"foo" => "bar", "hello" => "world"}, 其中"bar"之后有2个空闲字节
+	blob := []byte{0x02,
+		0x03, 'f', 'o', 'o', 0x03, 0x02, 'b', 'a', 'r', 0x00, 0x00,
+		0x05, 'h', 'e', 'l', 'l', 'o', 0x05, 0x00, 'w', 'o', 'r', 'l', 'd',
+		0xff}
+	elements, err := ReadZipmap(bytes.NewReader(rdbString(blob)))
+	if err != nil {
+		t.Fatalf("ReadZipmap() error: %v", err)
+	}
+	expected := []string{"foo", "bar", "hello", "world"}
+	if len(elements) != len(expected) {
+		t.Fatalf("ReadZipmap() = %v, want %v", elements, expected)
+	}
+	for i := range expected {
+		if elements[i] != expected[i] {
+			t.Errorf("ReadZipmap()[%d] = %s, want %s", i, elements[i], expected[i])
+		}
+	}
+}
+
+func TestReadZipmapBigLen(t *testing.T) {
+	// value长度为300, 使用 0xfe + 4字节小端序 表示长度; zmlen 为254表示数量未知
+	value := bytes.Repeat([]byte{'v'}, 300)
+	blob := []byte{0xfe, 0x01, 'k', 0xfe, 0x2c, 0x01, 0x00, 0x00, 0x00}
+	blob = append(blob, value...)
+	blob = append(blob, 0xff)
+	elements, err := ReadZipmap(bytes.NewReader(rdbString(blob)))
+	if err != nil {
+		t.Fatalf("ReadZipmap() error: %v", err)
+	}
+	if len(elements) != 2 || elements[0] != "k" || elements[1] != string(value) {
+		t.Fatalf("ReadZipmap() returned unexpected elements, len=%d", len(elements))
+	}
+}
+
+func TestReadZipmapEmpty(t *testing.T) {
+	elements, err := ReadZipmap(bytes.NewReader(rdbString([]byte{0x00, 0xff})))
+	if err != nil {
+		t.Fatalf("ReadZipmap() error: %v", err)
+	}
+	if len(elements) != 0 {
+		t.Fatalf("ReadZipmap() = %v, want empty", elements)
+	}
+}
+
+func TestReadZipmapTruncated(t *testing.T) {
+	// value声明长度为3, 但只有2个字节
+	blob := []byte{0x01, 0x01, 'k', 0x03, 0x00, 'v', 'v'}
+	_, err := ReadZipmap(bytes.NewReader(rdbString(blob)))
+	if !errors.Is(err, ErrTruncated) {
+		t.Fatalf("ReadZipmap() error = %v, want ErrTruncated", err)
+	}
+}
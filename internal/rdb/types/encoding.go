@@ -0,0 +1,138 @@
+package types
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/leijianzhong001/redis_agent/internal/utils"
+)
+
+// redis对象的编码, 与 OBJECT ENCODING 命令的返回值一致
+const (
+	EncodingRaw        = "raw"
+	EncodingInt        = "int"
+	EncodingEmbstr     = "embstr"
+	EncodingHashtable  = "hashtable"
+	EncodingZipmap     = "zipmap"
+	EncodingLinkedlist = "linkedlist"
+	EncodingZiplist    = "ziplist"
+	EncodingIntset     = "intset"
+	EncodingSkiplist   = "skiplist"
+	EncodingQuicklist  = "quicklist"
+	EncodingListpack   = "listpack"
+	EncodingStream     = "stream"
+	EncodingModule     = "module"
+)
+
+// EncodingConfig 紧凑编码的阈值配置, 对应redis.conf中的以下配置项(7.0之后ziplist改名为listpack, 旧名称作为别名保留):
+//   - hash-max-ziplist-entries / hash-max-ziplist-value
+//   - zset-max-ziplist-entries / zset-max-ziplist-value
+//   - set-max-intset-entries
+//   - list-max-ziplist-size
+//
+// 满足阈值的对象在redis中会以ziplist、listpack或intset编码保存, 不满足时转换为dict、skiplist等编码
+type EncodingConfig struct {
+	HashMaxEntries      uint64
+	HashMaxValue        uint64
+	ZsetMaxEntries      uint64
+	ZsetMaxValue        uint64
+	SetMaxIntsetEntries uint64
+	// ListMaxSize 为正数时表示quicklist每个节点最多保存的元素个数, 为 -1 ~ -5 时表示每个节点最多占用 4KB ~ 64KB
+	ListMaxSize int64
+}
+
+// DefaultEncodingConfig redis的默认配置
+var DefaultEncodingConfig = EncodingConfig{
+	HashMaxEntries:      128,
+	HashMaxValue:        64,
+	ZsetMaxEntries:      128,
+	ZsetMaxValue:        64,
+	SetMaxIntsetEntries: 512,
+	ListMaxSize:         -2,
+}
+
+var encodingConfigLock sync.RWMutex
+var encodingConfig = DefaultEncodingConfig
+
+// SetEncodingConfig 设置计算内存开销时使用的阈值配置, 需要在解析rdb之前调用
+func SetEncodingConfig(config EncodingConfig) {
+	encodingConfigLock.Lock()
+	defer encodingConfigLock.Unlock()
+	encodingConfig = config
+}
+
+func getEncodingConfig() EncodingConfig {
+	encodingConfigLock.RLock()
+	defer encodingConfigLock.RUnlock()
+	return encodingConfig
+}
+
+// sourceEncoding rdb中的类型字节对应的编码
+func sourceEncoding(typeByte byte) string {
+	switch typeByte {
+	case rdbTypeList:
+		return EncodingLinkedlist
+	case rdbTypeSet, rdbTypeHash:
+		return EncodingHashtable
+	case rdbTypeZSet, rdbTypeZSet2:
+		return EncodingSkiplist
+	case rdbTypeHashZipmap:
+		return EncodingZipmap
+	case rdbTypeListZiplist, rdbTypeZSetZiplist, rdbTypeHashZiplist:
+		return EncodingZiplist
+	case rdbTypeSetIntset:
+		return EncodingIntset
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		return EncodingQuicklist
+	case rdbTypeHashListpack, rdbTypeZSetListpack:
+		return EncodingListpack
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2:
+		return EncodingStream
+	case rdbTypeModule, rdbTypeModule2:
+		return EncodingModule
+	default:
+		return EncodingRaw
+	}
+}
+
+// compactEncoding 对象满足阈值时在redis中使用的紧凑编码
+// 源编码为listpack, 或者按照7.0之后的内存模型计算时(加载时ziplist会被转换为listpack)使用listpack, 其余使用ziplist
+func compactEncoding(source string, profile *utils.MemProfile) string {
+	if source == EncodingListpack || profile.Listpack {
+		return EncodingListpack
+	}
+	return EncodingZiplist
+}
+
+// packedOverhead 计算依次保存在同一个ziplist或listpack中的元素的开销
+// ziplist和listpack都是一整块连续内存，在这里应用一次jemalloc规则
+func packedOverhead(encoding string, elements []string) uint64 {
+	return utils.MallocOverhead(packedSize(encoding, elements))
+}
+
+// packedSize 不应用jemalloc规则的ziplist或listpack大小
+func packedSize(encoding string, elements []string) uint64 {
+	if encoding == EncodingListpack {
+		size := utils.ListpackOverhead()
+		for _, element := range elements {
+			size += utils.LpEntryOverhead(element)
+		}
+		return size
+	}
+	size := utils.ZiplistOverhead()
+	var previousEntryLength uint64
+	for _, element := range elements {
+		previousEntryLength = utils.ZlentryOverhead(previousEntryLength, element)
+		size += previousEntryLength
+	}
+	return size
+}
+
+// parseIntsetValue 判断元素能否保存在intset中, 只有规范表示的64位整数才可以
+func parseIntsetValue(element string) (int64, bool) {
+	v, err := strconv.ParseInt(element, 10, 64)
+	if err != nil || strconv.FormatInt(v, 10) != element {
+		return 0, false
+	}
+	return v, true
+}
@@ -0,0 +1,78 @@
+package types
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/leijianzhong001/redis_agent/internal/utils"
+)
+
+func TestListMemOverhead(t *testing.T) {
+	list := &ListObject{key: "user1:list", elements: []string{"a", "b", "c"}, nodeEncoding: EncodingZiplist}
+	topLevel := utils.DictEntryOverhead() + utils.SdsOverhead(list.key) + utils.RedisObjOverhead() + utils.QuicklistOverhead()
+	// 3个元素都在同一个节点中, 最后一个没有满的节点也要计算
+	want := topLevel + utils.QuicklistNodeOverhead() + utils.MallocOverhead(packedSize(EncodingZiplist, list.elements))
+	if got := list.MemOverhead(); got != want {
+		t.Errorf("MemOverhead() = %d, want %d", got, want)
+	}
+
+	// list-max-ziplist-size 为1时每个元素一个节点
+	SetEncodingConfig(EncodingConfig{ListMaxSize: 1})
+	defer SetEncodingConfig(DefaultEncodingConfig)
+	want = topLevel + 3*(utils.QuicklistNodeOverhead()+utils.MallocOverhead(packedSize(EncodingZiplist, []string{"a"})))
+	if got := list.MemOverhead(); got != want {
+		t.Errorf("MemOverhead() with fill=1 = %d, want %d", got, want)
+	}
+}
+
+func TestSetMemOverheadIntset(t *testing.T) {
+	set := &SetObject{key: "user1:set", elements: []string{"1", "2", "300"}, encoding: EncodingHashtable}
+	want := utils.DictEntryOverhead() + utils.SdsOverhead(set.key) + utils.RedisObjOverhead() + utils.IntsetOverhead([]int64{1, 2, 300})
+	if got := set.MemOverhead(); got != want {
+		t.Errorf("MemOverhead() = %d, want %d", got, want)
+	}
+
+	// 非规范的整数不能保存在intset中
+	set.elements = append(set.elements, "01")
+	if got := set.MemOverhead(); got <= want {
+		t.Errorf("MemOverhead() of hashtable set = %d, intset = %d", got, want)
+	}
+}
+
+func TestZsetMemOverheadCompact(t *testing.T) {
+	zset := &ZsetObject{key: "user1:zset", elements: []ZSetEntry{{Member: "a", Score: "1.000000"}, {Member: "b", Score: "2.5"}}}
+	compact := zset.MemOverhead()
+	SetEncodingConfig(EncodingConfig{})
+	defer SetEncodingConfig(DefaultEncodingConfig)
+	if compact == 0 || compact >= zset.MemOverhead() {
+		t.Errorf("compact overhead %d, skiplist overhead %d", compact, zset.MemOverhead())
+	}
+}
+
+func TestParseObjectMemProfile(t *testing.T) {
+	// rdb中ziplist编码的hash, 7.0之后加载时会被转换为listpack
+	zipmapHash := func(profile *utils.MemProfile) *HashObject {
+		blob := []byte{0x01, 0x01, 'f', 0x01, 0x00, 'v', 0xff}
+		o, err := ParseObject(bytes.NewReader(append([]byte{byte(len(blob))}, blob...)), rdbTypeHashZipmap, "user1:hash", profile)
+		if err != nil {
+			t.Fatalf("ParseObject() error: %v", err)
+		}
+		return o.(*HashObject)
+	}
+
+	pre7, redis7 := zipmapHash(&utils.MemProfilePre7), zipmapHash(&utils.MemProfileRedis7)
+	if pre7.Encoding() != EncodingZiplist || redis7.Encoding() != EncodingListpack {
+		t.Errorf("Encoding() pre-7.0 = %s, 7.x = %s", pre7.Encoding(), redis7.Encoding())
+	}
+	// 没有指定内存模型时使用默认的内存模型
+	if got := zipmapHash(nil).Encoding(); got != pre7.Encoding() {
+		t.Errorf("Encoding() with nil profile = %s, want %s", got, pre7.Encoding())
+	}
+
+	// 同一个进程中不同的对象可以使用不同的内存模型
+	SetEncodingConfig(EncodingConfig{})
+	defer SetEncodingConfig(DefaultEncodingConfig)
+	if pre7.MemOverhead()-redis7.MemOverhead() != utils.MemProfilePre7.DictOverhead()-utils.MemProfileRedis7.DictOverhead() {
+		t.Errorf("MemOverhead() pre-7.0 = %d, 7.x = %d", pre7.MemOverhead(), redis7.MemOverhead())
+	}
+}
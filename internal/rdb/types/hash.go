@@ -1,65 +1,71 @@
 package types
 
 import (
-	"github.com/leijianzhong001/redis_agent/internal/log"
+	"fmt"
 	"github.com/leijianzhong001/redis_agent/internal/rdb/structure"
 	"github.com/leijianzhong001/redis_agent/internal/utils"
 	"io"
 )
 
 type HashObject struct {
-	key   string
-	value map[string]string
+	memProfileHolder
+	key      string
+	value    map[string]string
+	encoding string // rdb中的源编码
 }
 
-func (o *HashObject) LoadFromBuffer(rd io.Reader, key string, typeByte byte) {
+func (o *HashObject) LoadFromBuffer(rd io.Reader, key string, typeByte byte) error {
 	o.key = key
+	o.encoding = sourceEncoding(typeByte)
 	o.value = make(map[string]string)
 	switch typeByte {
 	case rdbTypeHash:
-		o.readHash(rd)
+		return o.readHash(rd)
 	case rdbTypeHashZipmap:
-		o.readHashZipmap(rd)
+		return o.readPairs(structure.ReadZipmap(rd))
 	case rdbTypeHashZiplist:
-		o.readHashZiplist(rd)
+		return o.readPairs(structure.ReadZipList(rd))
 	case rdbTypeHashListpack:
-		o.readHashListpack(rd)
+		return o.readPairs(structure.ReadListpack(rd))
 	default:
-		log.Panicf("unknown hash type. typeByte=[%d]", typeByte)
+		return fmt.Errorf("%w: unknown hash type %d", ErrUnknownType, typeByte)
 	}
 }
 
-func (o *HashObject) readHash(rd io.Reader) {
-	size := int(structure.ReadLength(rd))
-	for i := 0; i < size; i++ {
-		key := structure.ReadString(rd)
-		value := structure.ReadString(rd)
-		o.value[key] = value
+func (o *HashObject) readHash(rd io.Reader) error {
+	size, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
 	}
-}
-
-func (o *HashObject) readHashZipmap(rd io.Reader) {
-	log.Panicf("not implemented rdbTypeZipmap")
-}
-
-func (o *HashObject) readHashZiplist(rd io.Reader) {
-	list := structure.ReadZipList(rd)
-	size := len(list)
-	for i := 0; i < size; i += 2 {
-		key := list[i]
-		value := list[i+1]
+	for i := uint64(0); i < size; i++ {
+		key, err := structure.ReadString(rd)
+		if err != nil {
+			return err
+		}
+		value, err := structure.ReadString(rd)
+		if err != nil {
+			return err
+		}
 		o.value[key] = value
 	}
+	return nil
 }
 
-func (o *HashObject) readHashListpack(rd io.Reader) {
-	list := structure.ReadListpack(rd)
+// readPairs 从zipmap、ziplist或listpack中读取到的 field1, value1, field2, value2 ... 列表中填充hash
+func (o *HashObject) readPairs(list []string, err error) error {
+	if err != nil {
+		return err
+	}
 	size := len(list)
+	if size%2 != 0 {
+		return structure.BadEncoding("hash pair list size is not even. size=[%d]", size)
+	}
 	for i := 0; i < size; i += 2 {
 		key := list[i]
 		value := list[i+1]
 		o.value[key] = value
 	}
+	return nil
 }
 
 func (o *HashObject) Rewrite() []RedisCmd {
@@ -83,8 +89,12 @@ func (o *HashObject) Rewrite() []RedisCmd {
 // 因为hash类型内部有两个`dict`结构，所以最终会有产生两种`rehash`，一种`rehash`基准是`field`个数，另一种`rehash`基准是`key`个数，结合`jemalloc`内存分配规则，`hash`类型的容量评估模型为：
 // 		总内存消耗 = [dictEntry大小 + key_SDS大小 + redisObject大小 + dict大小 + (dictEntry大小 + field_SDS大小 + val_SDS大小) * field个数 + field_bucket个数 * 指针大小] * key个数 + key_bucket个数 * 指针大小
 func (o *HashObject) MemOverhead() uint64 {
+	if o.fitsCompact() {
+		return o.compactMemOverhead()
+	}
+
 	// dictEntry大小 + key_SDS大小 + redisObject大小 + dict大小
-	topLevelObjOverhead := utils.DictEntryOverhead() + utils.SdsOverhead(o.key) + utils.RedisObjOverhead() + utils.DictOverhead()
+	topLevelObjOverhead := utils.DictEntryOverhead() + utils.SdsOverhead(o.key) + utils.RedisObjOverhead() + o.memProfile().DictOverhead()
 
 	// (dictEntry大小 + field_SDS大小 + val_SDS大小) * field个数
 	var dataOverhead uint64
@@ -94,6 +104,49 @@ func (o *HashObject) MemOverhead() uint64 {
 
 	// field_bucket个数 * 指针大小
 	fieldBucketOverhead := utils.FieldBucketOverhead(uint64(len(o.value)))
+	// 过期时间的开销由Loader按照过期字典统一计算
 	return topLevelObjOverhead + dataOverhead + fieldBucketOverhead
-	// todo 加过期时间开销
+}
+
+func (o *HashObject) Type() string {
+	return HashType
+}
+
+func (o *HashObject) Len() uint64 {
+	return uint64(len(o.value))
+}
+
+func (o *HashObject) Encoding() string {
+	if o.fitsCompact() {
+		return compactEncoding(o.encoding, o.memProfile())
+	}
+	return EncodingHashtable
+}
+
+// fitsCompact 判断当前hash是否满足 hash-max-ziplist-entries 和 hash-max-ziplist-value
+// redis加载rdb时, 无论源编码是什么, 满足阈值的hash都会以ziplist(或listpack)保存, 否则转换为dict
+func (o *HashObject) fitsCompact() bool {
+	config := getEncodingConfig()
+	if uint64(len(o.value)) > config.HashMaxEntries {
+		return false
+	}
+	for field, value := range o.value {
+		if uint64(len(field)) > config.HashMaxValue || uint64(len(value)) > config.HashMaxValue {
+			return false
+		}
+	}
+	return true
+}
+
+// compactMemOverhead ziplist(或listpack)编码的hash的内存开销
+// 所有的field和value依次保存在同一个ziplist中，所以:
+// 		单个key的内存消耗 = dictEntry大小 + key_SDS大小 + redisObject大小 + ziplist大小
+func (o *HashObject) compactMemOverhead() uint64 {
+	topLevelObjOverhead := utils.DictEntryOverhead() + utils.SdsOverhead(o.key) + utils.RedisObjOverhead()
+
+	elements := make([]string, 0, len(o.value)*2)
+	for field, value := range o.value {
+		elements = append(elements, field, value)
+	}
+	return topLevelObjOverhead + packedOverhead(compactEncoding(o.encoding, o.memProfile()), elements)
 }
@@ -0,0 +1,35 @@
+package types
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseHashZipmap(t *testing.T) {
+	// rdb字符串编码的zipmap: {"foo" => "bar", "hello" => "world"}
+	blob := []byte{0x02,
+		0x03, 'f', 'o', 'o', 0x03, 0x00, 'b', 'a', 'r',
+		0x05, 'h', 'e', 'l', 'l', 'o', 0x05, 0x00, 'w', 'o', 'r', 'l', 'd',
+		0xff}
+	payload := append([]byte{byte(len(blob))}, blob...)
+
+	o, err := ParseObject(bytes.NewReader(payload), rdbTypeHashZipmap, "user1:hash", nil)
+	if err != nil {
+		t.Fatalf("ParseObject() error: %v", err)
+	}
+	hash, ok := o.(*HashObject)
+	if !ok {
+		t.Fatalf("ParseObject() returned %T, want *HashObject", o)
+	}
+	if len(hash.value) != 2 || hash.value["foo"] != "bar" || hash.value["hello"] != "world" {
+		t.Fatalf("unexpected hash value %v", hash.value)
+	}
+
+	// 小hash保持ziplist编码，开销应当小于超过阈值以后的dict编码
+	compact := hash.MemOverhead()
+	SetEncodingConfig(EncodingConfig{})
+	defer SetEncodingConfig(DefaultEncodingConfig)
+	if compact == 0 || compact >= hash.MemOverhead() {
+		t.Errorf("zipmap overhead %d, dict overhead %d", compact, hash.MemOverhead())
+	}
+}
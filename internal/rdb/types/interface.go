@@ -1,7 +1,8 @@
 package types
 
 import (
-	"github.com/leijianzhong001/redis_agent/internal/log"
+	"errors"
+	"fmt"
 	"github.com/leijianzhong001/redis_agent/internal/utils"
 	"io"
 )
@@ -20,6 +21,10 @@ const (
 	HashType = "hash"
 	// ZSetType is redis sorted set
 	ZSetType = "zset"
+	// StreamType is redis stream
+	StreamType = "stream"
+	// ModuleType is value of redis module data type
+	ModuleType = "module"
 	// AuxType is redis metadata key-value pair
 	AuxType = "aux"
 	// DBSizeType is for _OPCODE_RESIZEDB
@@ -60,49 +65,69 @@ const (
 	rdbModuleOpcodeSTRING = 5 // String.
 )
 
+// ErrUnknownType 无法识别的value类型
+var ErrUnknownType = errors.New("unknown type byte")
+
 type RedisCmd []string
 
 // RedisObject is interface for a redis object
 type RedisObject interface {
-	LoadFromBuffer(rd io.Reader, key string, typeByte byte)
+	LoadFromBuffer(rd io.Reader, key string, typeByte byte) error
 	Rewrite() []RedisCmd
 	MemOverhead() uint64
+	// Type 对象的类型, 与 TYPE 命令的返回值一致, 模块类型统一返回 ModuleType
+	Type() string
+	// Encoding 对象加载到redis中以后的编码, 与 OBJECT ENCODING 命令的返回值一致, 模块类型返回模块数据类型名称
+	Encoding() string
+	// Len 对象的大小, string为value的字节数(与 STRLEN 一致), 其余类型为元素数量(与 LLEN/SCARD/ZCARD/HLEN/XLEN 一致), 模块类型为0
+	Len() uint64
+}
+
+// memProfileHolder 计算内存开销时使用的内存模型, 由 ParseObject 设置, 为nil时使用 utils.DefaultMemProfile
+type memProfileHolder struct {
+	profile *utils.MemProfile
 }
 
-func ParseObject(rd io.Reader, typeByte byte, key string) RedisObject {
+func (h *memProfileHolder) setMemProfile(profile *utils.MemProfile) {
+	h.profile = profile
+}
+
+func (h *memProfileHolder) memProfile() *utils.MemProfile {
+	if h.profile == nil {
+		return utils.DefaultMemProfile
+	}
+	return h.profile
+}
+
+// ParseObject 解析value, profile为生成rdb文件的redis版本对应的内存模型, 为nil时使用 utils.DefaultMemProfile
+func ParseObject(rd io.Reader, typeByte byte, key string, profile *utils.MemProfile) (RedisObject, error) {
+	var o RedisObject
 	switch typeByte {
 	case rdbTypeString: // string
 		// StringObject 指的是 value类型为string的键值对对象
-		o := new(StringObject)
-		o.LoadFromBuffer(rd, key, typeByte)
-		return o
+		o = new(StringObject)
 	case rdbTypeList, rdbTypeListZiplist, rdbTypeListQuicklist, rdbTypeListQuicklist2: // list
-		o := new(ListObject)
-		o.LoadFromBuffer(rd, key, typeByte)
-		return o
+		o = new(ListObject)
 	case rdbTypeSet, rdbTypeSetIntset: // set
-		o := new(SetObject)
-		o.LoadFromBuffer(rd, key, typeByte)
-		return o
+		o = new(SetObject)
 	case rdbTypeZSet, rdbTypeZSet2, rdbTypeZSetZiplist, rdbTypeZSetListpack: // zset
-		o := new(ZsetObject)
-		o.LoadFromBuffer(rd, key, typeByte)
-		return o
+		o = new(ZsetObject)
 	case rdbTypeHash, rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack: // hash
-		o := new(HashObject)
-		o.LoadFromBuffer(rd, key, typeByte)
-		return o
+		o = new(HashObject)
 	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2: // stream
-		o := new(StreamObject)
-		o.LoadFromBuffer(rd, key, typeByte)
-		return o
+		o = new(StreamObject)
 	case rdbTypeModule, rdbTypeModule2: // module
-		o := new(ModuleObject)
-		o.LoadFromBuffer(rd, key, typeByte)
-		return o
+		o = new(ModuleObject)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownType, typeByte)
+	}
+	if holder, ok := o.(interface{ setMemProfile(*utils.MemProfile) }); ok {
+		holder.setMemProfile(profile)
+	}
+	if err := o.LoadFromBuffer(rd, key, typeByte); err != nil {
+		return nil, err
 	}
-	log.Panicf("unknown type byte: %d", typeByte)
-	return nil
+	return o, nil
 }
 
 func moduleTypeNameByID(moduleId uint64) string {
@@ -114,3 +139,11 @@ func moduleTypeNameByID(moduleId uint64) string {
 	}
 	return string(nameList)
 }
+
+// minCapacity 根据rdb中读取到的元素数量计算切片的初始容量，防止错误的长度导致一次性分配过多内存
+func minCapacity(size uint64) int {
+	if size > 1024 {
+		return 1024
+	}
+	return int(size)
+}
@@ -1,10 +1,11 @@
 package types
 
 import (
-	"github.com/leijianzhong001/redis_agent/internal/log"
+	"fmt"
 	"github.com/leijianzhong001/redis_agent/internal/rdb/structure"
 	"github.com/leijianzhong001/redis_agent/internal/utils"
 	"io"
+	"math"
 )
 
 // quicklist node container formats
@@ -14,24 +15,35 @@ const (
 )
 
 type ListObject struct {
+	memProfileHolder
 	key      string
 	elements []string
+	encoding string // rdb中的源编码
+	// nodeEncoding quicklist节点的编码, RDB_TYPE_LIST_QUICKLIST_2 为listpack, 其余为ziplist
+	nodeEncoding string
 }
 
-func (o *ListObject) LoadFromBuffer(rd io.Reader, key string, typeByte byte) {
+func (o *ListObject) LoadFromBuffer(rd io.Reader, key string, typeByte byte) error {
 	o.key = key
+	o.encoding = sourceEncoding(typeByte)
+	o.nodeEncoding = EncodingZiplist
+	if typeByte == rdbTypeListQuicklist2 {
+		o.nodeEncoding = EncodingListpack
+	}
+	var err error
 	switch typeByte {
 	case rdbTypeList:
-		o.readList(rd)
+		err = o.readList(rd)
 	case rdbTypeListZiplist:
-		o.elements = structure.ReadZipList(rd)
+		o.elements, err = structure.ReadZipList(rd)
 	case rdbTypeListQuicklist:
-		o.readQuickList(rd)
+		err = o.readQuickList(rd)
 	case rdbTypeListQuicklist2:
-		o.readQuickList2(rd)
+		err = o.readQuickList2(rd)
 	default:
-		log.Panicf("unknown list type %d", typeByte)
+		err = fmt.Errorf("%w: unknown list type %d", ErrUnknownType, typeByte)
 	}
+	return err
 }
 
 func (o *ListObject) Rewrite() []RedisCmd {
@@ -43,85 +55,152 @@ func (o *ListObject) Rewrite() []RedisCmd {
 	return cmds
 }
 
-func (o *ListObject) readList(rd io.Reader) {
-	size := int(structure.ReadLength(rd))
-	for i := 0; i < size; i++ {
-		ele := structure.ReadString(rd)
+func (o *ListObject) readList(rd io.Reader) error {
+	size, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < size; i++ {
+		ele, err := structure.ReadString(rd)
+		if err != nil {
+			return err
+		}
 		o.elements = append(o.elements, ele)
 	}
+	return nil
 }
 
-func (o *ListObject) readQuickList(rd io.Reader) {
+func (o *ListObject) readQuickList(rd io.Reader) error {
 	// 这个是节点个数，不是元素个数
-	size := int(structure.ReadLength(rd))
-	for i := 0; i < size; i++ {
-		ziplistElements := structure.ReadZipList(rd)
+	size, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < size; i++ {
+		ziplistElements, err := structure.ReadZipList(rd)
+		if err != nil {
+			return err
+		}
 		o.elements = append(o.elements, ziplistElements...)
 	}
+	return nil
 }
 
-func (o *ListObject) readQuickList2(rd io.Reader) {
-	size := int(structure.ReadLength(rd))
-	for i := 0; i < size; i++ {
-		container := structure.ReadLength(rd)
+func (o *ListObject) readQuickList2(rd io.Reader) error {
+	size, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < size; i++ {
+		container, err := structure.ReadLength(rd)
+		if err != nil {
+			return err
+		}
 		if container == quicklistNodeContainerPlain {
-			ele := structure.ReadString(rd)
+			ele, err := structure.ReadString(rd)
+			if err != nil {
+				return err
+			}
 			o.elements = append(o.elements, ele)
 		} else if container == quicklistNodeContainerPacked {
-			listpackElements := structure.ReadListpack(rd)
+			listpackElements, err := structure.ReadListpack(rd)
+			if err != nil {
+				return err
+			}
 			o.elements = append(o.elements, listpackElements...)
 		} else {
-			log.Panicf("unknown quicklist container %d", container)
+			return structure.BadEncoding("unknown quicklist container %d", container)
 		}
 	}
+	return nil
 }
 
-const maxZipListSize = uint64(8192)
+// quicklist节点大小的限制, 见quicklist.c中的 optimization_level 和 SIZE_SAFETY_LIMIT
+var quicklistOptimizationLevel = []uint64{4096, 8192, 16384, 32768, 65536}
+
+const quicklistSizeSafetyLimit = uint64(8192)
+
+// quicklistNodeLimit 根据 list-max-ziplist-size 计算每个节点的字节数上限和元素个数上限
+func quicklistNodeLimit(fill int64) (sizeLimit uint64, countLimit uint64) {
+	if fill >= 0 {
+		// 按照元素个数限制时, 单个节点的大小仍然不能超过 SIZE_SAFETY_LIMIT
+		return quicklistSizeSafetyLimit, uint64(fill)
+	}
+	level := int(-fill) - 1
+	if level >= len(quicklistOptimizationLevel) {
+		level = len(quicklistOptimizationLevel) - 1
+	}
+	return quicklistOptimizationLevel[level], math.MaxUint64
+}
 
 // MemOverhead 计算当前key加载到redis中以后的内存开销
-// 一个`quicklist`存储结构最终会产生以下几个消耗内存的结构(相关代码可查阅`t_hash.c`中的`hashTypeLookupWriteOrCreate`函数)：
-//		- 1个`dictEntry`结构，24字节，负责保存当前的哈希对象；
+// 一个`quicklist`存储结构最终会产生以下几个消耗内存的结构(相关代码可查阅`t_list.c`中的`pushGenericCommand`函数)：
+//		- 1个`dictEntry`结构，24字节，负责保存当前的列表对象；
 //		- 1个`SDS`结构，用作`key`字符串，占`4~18`个字节；
 //		- 1个`redisObject`结构，`16`字节，其指针指向当前`key`下属的`quicklist`结构；
-//		- 1个`quicklist`结构，40字节，负责保存哈希对象的键值对；
+//		- 1个`quicklist`结构，40字节；
 //		- `quicklist.len`个`quicklistNode`结构，每个`quicklistNode`占用32字节,总长度为`quicklist.len * 32`
-//		- `quicklistNode`中的`ziplist`的长度按照`8kb`算，所以`ziplist`的总长度为`quicklist.len * 8192`
-// 按照默认的配置，redis的所有节点不压缩，且每个ziplist的最大长度为`8KB`。而`quicklist`的插入方式是首先判断当前头节点(或尾节点)插入新元素以后是否小于8KB，如果小于，则将当前元素插入到当前头节点(或尾节点)的`ziplist`中，否则创建一个新的`quicklistNode`
-// 所以我们在计算`quicklistNode`中的`ziplist`长度时，可以简单的按照`8KB`来算
-// `ziplist`不是具体的结构体，所以没有下级结构
-// 单个key的内存消耗 = `dictEntry`结构大小 + key_SDS大小 + redisObject大小 + `quicklist`结构 + quicklist.len * 32 + quicklist.len * 8192
+//		- 每个`quicklistNode`下的`ziplist`(7.0之后为`listpack`)
+// `quicklist`的插入方式是首先判断当前尾节点插入新元素以后是否超过`list-max-ziplist-size`的限制，如果没有超过，则将当前元素插入到尾节点的`ziplist`中，否则创建一个新的`quicklistNode`
+// 默认配置为-2, 即每个`ziplist`最大`8KB`。这里按照rdb中的元素依次模拟插入，得到每个节点的`ziplist`长度，并对每个`ziplist`应用一次jemalloc规则
+// 单个key的内存消耗 = `dictEntry`结构大小 + key_SDS大小 + redisObject大小 + `quicklist`结构 + quicklist.len * 32 + 所有ziplist的大小
 func (o *ListObject) MemOverhead() uint64 {
 	// `dictEntry`结构大小 + key_SDS大小 + redisObject大小 + `quicklist`结构
 	topLevelObjOverhead := utils.DictEntryOverhead() + utils.SdsOverhead(o.key) + utils.RedisObjOverhead() + utils.QuicklistOverhead()
 
+	sizeLimit, countLimit := quicklistNodeLimit(getEncodingConfig().ListMaxSize)
+	nodeEncoding := compactEncoding(o.nodeEncoding, o.memProfile())
+	emptyNodeSize := packedSize(nodeEncoding, nil)
+
 	var dataOverhead uint64
-	var previousEntryLength uint64
-	// 当前ziplist长度
-	currentZipListSize := utils.ZiplistOverhead()
 	// 当前quicklist中 quickListNode的数量
 	quickListNodeCount := uint64(0)
-	// quicklist.len * 32 + quicklist.len * 8192
+	// 当前节点的长度和元素个数
+	currentNodeSize := emptyNodeSize
+	currentNodeCount := uint64(0)
+	var previousEntryLength uint64
 	for _, element := range o.elements {
-		// ziplist结构 = ziplist header + ziplist end + 所有entry
-		// entry结构 = previous_entry_length + encoding + len(content)
-		// 当前元素所在的entry的长度
-		currentEntrySize := utils.ZlentryOverhead(previousEntryLength, element)
-		if currentZipListSize+currentEntrySize > maxZipListSize {
-			// 说明当前ziplist已经满了，此时将quickListNode数量 + 1
+		currentEntrySize := nodeEntrySize(nodeEncoding, previousEntryLength, element)
+		if currentNodeCount > 0 && (currentNodeSize+currentEntrySize > sizeLimit || currentNodeCount >= countLimit) {
+			// 说明当前节点已经满了，到这个地方应用jmalloc规则分配一次内存，当前元素放到新的节点中
 			quickListNodeCount++
-			// 累加ziplist长度，到这个地方应用jmalloc规则分配一次内存
-			dataOverhead += utils.MallocOverhead(currentZipListSize)
-			// 满了以后重置当前zipList长度，开始下一个zipList累加
-			currentZipListSize = utils.ZiplistOverhead()
-		} else {
-			// 当前ziplist没满，继续累加
-			currentZipListSize += currentEntrySize
+			dataOverhead += utils.MallocOverhead(currentNodeSize)
+			currentNodeSize = emptyNodeSize
+			currentNodeCount = 0
+			currentEntrySize = nodeEntrySize(nodeEncoding, 0, element)
 		}
+		currentNodeSize += currentEntrySize
+		currentNodeCount++
+		// 上一个entry的长度
+		previousEntryLength = currentEntrySize
+	}
+	if currentNodeCount > 0 {
+		// 最后一个没有满的节点
+		quickListNodeCount++
+		dataOverhead += utils.MallocOverhead(currentNodeSize)
+	}
 
-		// 上一个zlentry的长度
-		previousEntryLength = uint64(len(element))
+	return topLevelObjOverhead + utils.QuicklistNodeOverhead()*quickListNodeCount + dataOverhead
+}
 
+// nodeEntrySize quicklist节点中单个元素的长度, ziplist需要记录前一个元素的长度, listpack不需要
+func nodeEntrySize(nodeEncoding string, previousEntryLength uint64, element string) uint64 {
+	if nodeEncoding == EncodingListpack {
+		return utils.LpEntryOverhead(element)
 	}
+	return utils.ZlentryOverhead(previousEntryLength, element)
+}
 
-	return topLevelObjOverhead + utils.QuicklistNodeOverhead()*quickListNodeCount + dataOverhead
+func (o *ListObject) Type() string {
+	return ListType
+}
+
+// Len list的元素数量, 与 LLEN 一致
+func (o *ListObject) Len() uint64 {
+	return uint64(len(o.elements))
+}
+
+// Encoding 3.2之后所有的list都以quicklist保存
+func (o *ListObject) Encoding() string {
+	return EncodingQuicklist
 }
@@ -1,44 +1,166 @@
 package types
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/leijianzhong001/redis_agent/internal/log"
 	"github.com/leijianzhong001/redis_agent/internal/rdb/structure"
+	"github.com/leijianzhong001/redis_agent/internal/utils"
 	"io"
 )
 
+// moduleValueOverhead moduleValue结构体开销, redisObject的ptr指向该结构
+// typedef struct moduleValue {
+//     moduleType *type; // 8
+//     void *value;      // 8
+// } moduleValue;
+const moduleValueOverhead = 16
+
 type ModuleObject struct {
+	key        string
+	moduleName string        // 模块数据类型名称, 固定9个字符, 例如 MBbloom--
+	encver     int           // 模块数据类型的编码版本
+	size       uint64        // value在rdb中占用的字节数, 没有解析器时以此估算内存开销
+	decoder    ModuleDecoder // 为空说明没有可用的解析器
 }
 
-func (o *ModuleObject) LoadFromBuffer(rd io.Reader, key string, typeByte byte) {
+func (o *ModuleObject) LoadFromBuffer(rd io.Reader, key string, typeByte byte) error {
+	o.key = key
+	moduleId, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
+	o.moduleName = moduleTypeNameByID(moduleId)
+	o.encver = int(moduleId & 1023)
+	factory := lookupModuleDecoder(o.moduleName)
+
 	if typeByte == rdbTypeModule {
-		log.Panicf("module type with version 1 is not supported, key=[%s]", key)
+		// 版本1的模块value没有opcode注解, 没有对应的解析器就无法知道value的边界
+		if factory == nil {
+			return fmt.Errorf("%w: module type with version 1 is not supported without a registered decoder, module name=[%s], key=[%s]",
+				ErrUnknownType, o.moduleName, key)
+		}
+		counter := &countingReader{rd: rd}
+		decoder := factory()
+		if err = decoder.Load(&ModuleIO{rd: counter}, o.encver); err != nil {
+			return err
+		}
+		o.decoder = decoder
+		o.size = counter.n
+		return nil
+	}
+
+	// module2 先按照opcode注解完整读取value, 再交给解析器解析。解析失败时退化为按照字节数估算, 不影响后续key的读取
+	var value bytes.Buffer
+	if err = skipModuleValue(io.TeeReader(rd, &value), o.moduleName); err != nil {
+		return err
+	}
+	o.size = uint64(value.Len())
+	if factory == nil {
+		return nil
+	}
+	decoder := factory()
+	if err = decoder.Load(&ModuleIO{rd: &value, annotated: true}, o.encver); err != nil {
+		log.Warnf("decode module value failed, fallback to opaque size. module name=[%s], encver=[%d], key=[%s], error=[%v]",
+			o.moduleName, o.encver, key, err)
+		return nil
+	}
+	o.decoder = decoder
+	return nil
+}
+
+// ReadModuleAux 读取并跳过 RDB_OPCODE_MODULE_AUX(0xF7) 之后的模块辅助数据, 返回模块名称
+// 格式为 <moduleid> <when_opcode> <when> <模块数据>, 模块数据与 module2 类型的value一样带有opcode注解, 所以不需要加载模块也可以跳过
+func ReadModuleAux(rd io.Reader) (string, error) {
+	moduleId, err := structure.ReadLength(rd)
+	if err != nil {
+		return "", err
 	}
-	moduleId := structure.ReadLength(rd)
 	moduleName := moduleTypeNameByID(moduleId)
-	opcode := structure.ReadByte(rd)
+	whenOpcode, err := structure.ReadLength(rd)
+	if err != nil {
+		return moduleName, err
+	}
+	if whenOpcode != rdbModuleOpcodeUINT {
+		return moduleName, structure.BadEncoding("bad when_opcode=[%d] of module aux, module name=[%s]", whenOpcode, moduleName)
+	}
+	if _, err = structure.ReadLength(rd); err != nil { // when
+		return moduleName, err
+	}
+	return moduleName, skipModuleValue(rd, moduleName)
+}
+
+// skipModuleValue 按照opcode注解跳过模块数据, 直到遇到 rdbModuleOpcodeEOF, 见 rdb.c/rdbLoadCheckModuleValue
+func skipModuleValue(rd io.Reader, moduleName string) error {
+	opcode, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
 	for opcode != rdbModuleOpcodeEOF {
 		switch opcode {
-		case rdbModuleOpcodeSINT:
-		case rdbModuleOpcodeUINT:
-			structure.ReadLength(rd)
+		case rdbModuleOpcodeSINT, rdbModuleOpcodeUINT:
+			_, err = structure.ReadLength(rd)
 		case rdbModuleOpcodeFLOAT:
-			structure.ReadFloat(rd)
+			_, err = structure.ReadBinaryFloat(rd)
 		case rdbModuleOpcodeDOUBLE:
-			structure.ReadDouble(rd)
+			_, err = structure.ReadDouble(rd)
 		case rdbModuleOpcodeSTRING:
-			structure.ReadString(rd)
+			_, err = structure.ReadString(rd)
 		default:
-			log.Panicf("unknown module opcode=[%d], module name=[%s]", opcode, moduleName)
+			return structure.BadEncoding("unknown module opcode=[%d], module name=[%s]", opcode, moduleName)
+		}
+		if err != nil {
+			return err
+		}
+		opcode, err = structure.ReadLength(rd)
+		if err != nil {
+			return err
 		}
-		opcode = structure.ReadByte(rd)
 	}
+	return nil
 }
 
+// Rewrite 由模块解析器生成重建命令, 没有解析器或解析器不支持时返回nil
 func (o *ModuleObject) Rewrite() []RedisCmd {
-	log.Panicf("module Rewrite not implemented")
-	return nil
+	if o.decoder == nil {
+		return nil
+	}
+	return o.decoder.Rewrite(o.key)
 }
 
+// MemOverhead 计算当前key加载到redis中以后的内存开销
+// 单个key的内存消耗 = dictEntry大小 + key_SDS大小 + redisObject大小 + moduleValue大小 + 模块数据大小
+// 模块数据大小由解析器估算, 没有解析器时按照value在rdb中占用的字节数估算
 func (o *ModuleObject) MemOverhead() uint64 {
+	topLevelObjOverhead := utils.DictEntryOverhead() + utils.SdsOverhead(o.key) + utils.RedisObjOverhead() + utils.MallocOverhead(moduleValueOverhead)
+	if o.decoder != nil {
+		return topLevelObjOverhead + o.decoder.MemOverhead()
+	}
+	return topLevelObjOverhead + utils.MallocOverhead(o.size)
+}
+
+// countingReader 记录已经读取的字节数
+type countingReader struct {
+	rd io.Reader
+	n  uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.n += uint64(n)
+	return n, err
+}
+
+func (o *ModuleObject) Type() string {
+	return ModuleType
+}
+
+// Encoding 模块类型的编码为模块数据类型名称, 如 MBbloom--
+func (o *ModuleObject) Encoding() string {
+	return o.moduleName
+}
+
+// Len 模块类型的元素数量没有统一的定义
+func (o *ModuleObject) Len() uint64 {
 	return 0
 }
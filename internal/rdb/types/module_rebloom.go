@@ -0,0 +1,110 @@
+package types
+
+import (
+	"github.com/leijianzhong001/redis_agent/internal/rdb/structure"
+	"github.com/leijianzhong001/redis_agent/internal/utils"
+)
+
+// RedisBloom 的布隆过滤器, 见 RedisBloom/src/rebloom.c 中的 BFRdbLoad
+const (
+	bloomModuleName       = "MBbloom--"
+	bloomEncodingVersion  = 4 // BF_ENCODING_VERSION
+	bloomMinOptionsEncver = 2 // BF_MIN_OPTIONS_ENC
+	bloomMinGrowthEncver  = 4 // BF_MIN_GROWTH_ENC
+	bloomMaxFilters       = 1000
+
+	// typedef struct SBChain {
+	//     SBLink *filters;  // 8
+	//     size_t size;      // 8
+	//     size_t nfilters;  // 8
+	//     unsigned options; // 4
+	//     unsigned growth;  // 4
+	// } SBChain;
+	bloomChainOverhead = 32
+	// typedef struct SBLink {
+	//     struct bloom inner; // 56
+	//     size_t size;        // 8
+	// } SBLink;
+	bloomLinkOverhead = 64
+)
+
+func init() {
+	RegisterModuleDecoder(bloomModuleName, func() ModuleDecoder { return &bloomDecoder{} })
+}
+
+type bloomDecoder struct {
+	filterBytes []uint64 // 每个子过滤器位数组的字节数
+}
+
+func (d *bloomDecoder) Load(mio *ModuleIO, encver int) error {
+	if encver > bloomEncodingVersion {
+		return structure.BadEncoding("unsupported %s encver=[%d]", bloomModuleName, encver)
+	}
+	if _, err := mio.LoadUnsigned(); err != nil { // size
+		return err
+	}
+	nfilters, err := mio.LoadUnsigned()
+	if err != nil {
+		return err
+	}
+	if nfilters >= bloomMaxFilters {
+		return structure.BadEncoding("too many filters=[%d] in %s", nfilters, bloomModuleName)
+	}
+	if encver >= bloomMinOptionsEncver {
+		if _, err = mio.LoadUnsigned(); err != nil { // options
+			return err
+		}
+	}
+	if encver >= bloomMinGrowthEncver {
+		if _, err = mio.LoadUnsigned(); err != nil { // growth
+			return err
+		}
+	}
+
+	d.filterBytes = make([]uint64, 0, nfilters)
+	for i := uint64(0); i < nfilters; i++ {
+		if _, err = mio.LoadUnsigned(); err != nil { // entries
+			return err
+		}
+		if _, err = mio.LoadDouble(); err != nil { // error
+			return err
+		}
+		if _, err = mio.LoadUnsigned(); err != nil { // hashes
+			return err
+		}
+		if _, err = mio.LoadDouble(); err != nil { // bpe
+			return err
+		}
+		if encver != 0 {
+			if _, err = mio.LoadUnsigned(); err != nil { // bits
+				return err
+			}
+			if _, err = mio.LoadUnsigned(); err != nil { // n2
+				return err
+			}
+		}
+		bf, err := mio.LoadString()
+		if err != nil {
+			return err
+		}
+		if _, err = mio.LoadUnsigned(); err != nil { // size
+			return err
+		}
+		d.filterBytes = append(d.filterBytes, uint64(len(bf)))
+	}
+	return nil
+}
+
+// MemOverhead SBChain + SBLink数组 + 每个子过滤器的位数组
+func (d *bloomDecoder) MemOverhead() uint64 {
+	overhead := utils.MallocOverhead(bloomChainOverhead) + utils.MallocOverhead(bloomLinkOverhead*uint64(len(d.filterBytes)))
+	for _, size := range d.filterBytes {
+		overhead += utils.MallocOverhead(size)
+	}
+	return overhead
+}
+
+// Rewrite 布隆过滤器只能通过 BF.SCANDUMP/BF.LOADCHUNK 重建, 暂不支持
+func (d *bloomDecoder) Rewrite(key string) []RedisCmd {
+	return nil
+}
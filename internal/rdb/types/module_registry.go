@@ -0,0 +1,103 @@
+package types
+
+import (
+	"github.com/leijianzhong001/redis_agent/internal/log"
+	"github.com/leijianzhong001/redis_agent/internal/rdb/structure"
+	"io"
+	"sync"
+)
+
+// ModuleDecoder 模块数据类型的解析器, 每个value创建一个实例
+type ModuleDecoder interface {
+	// Load 从mio中读取一个value, encver为模块数据类型的编码版本, 与模块中rdb_load回调的参数一致
+	Load(mio *ModuleIO, encver int) error
+	// MemOverhead 模块value自身的内存开销, 不包含dictEntry、key、redisObject以及moduleValue
+	MemOverhead() uint64
+	// Rewrite 返回重建该value的命令, 不支持时返回nil
+	Rewrite(key string) []RedisCmd
+}
+
+// ModuleDecoderFactory 创建一个新的解析器实例
+type ModuleDecoderFactory func() ModuleDecoder
+
+var moduleDecoderLock sync.RWMutex
+var moduleDecoders = make(map[string]ModuleDecoderFactory)
+
+// RegisterModuleDecoder 按照模块数据类型名称注册解析器, 名称固定为9个字符, 与 RedisModule_CreateDataType 的name参数一致
+func RegisterModuleDecoder(moduleName string, factory ModuleDecoderFactory) {
+	if len(moduleName) != 9 {
+		log.Panicf("module type name must be 9 characters, name=[%s]", moduleName)
+	}
+	moduleDecoderLock.Lock()
+	defer moduleDecoderLock.Unlock()
+	moduleDecoders[moduleName] = factory
+}
+
+func lookupModuleDecoder(moduleName string) ModuleDecoderFactory {
+	moduleDecoderLock.RLock()
+	defer moduleDecoderLock.RUnlock()
+	return moduleDecoders[moduleName]
+}
+
+// ModuleIO 读取模块value, 对应redis中的 RedisModuleIO
+// module2类型的value中, 每个值之前都有一个表示其类型的opcode注解, 版本1的module类型则没有
+type ModuleIO struct {
+	rd        io.Reader
+	annotated bool
+}
+
+// expect 读取并校验opcode注解
+func (mio *ModuleIO) expect(opcode uint64) error {
+	if !mio.annotated {
+		return nil
+	}
+	actual, err := structure.ReadLength(mio.rd)
+	if err != nil {
+		return err
+	}
+	if actual != opcode {
+		return structure.BadEncoding("unexpected module opcode=[%d], expect=[%d]", actual, opcode)
+	}
+	return nil
+}
+
+// LoadUnsigned 对应 RedisModule_LoadUnsigned
+func (mio *ModuleIO) LoadUnsigned() (uint64, error) {
+	if err := mio.expect(rdbModuleOpcodeUINT); err != nil {
+		return 0, err
+	}
+	return structure.ReadLength(mio.rd)
+}
+
+// LoadSigned 对应 RedisModule_LoadSigned
+func (mio *ModuleIO) LoadSigned() (int64, error) {
+	if err := mio.expect(rdbModuleOpcodeSINT); err != nil {
+		return 0, err
+	}
+	v, err := structure.ReadLength(mio.rd)
+	return int64(v), err
+}
+
+// LoadDouble 对应 RedisModule_LoadDouble
+func (mio *ModuleIO) LoadDouble() (float64, error) {
+	if err := mio.expect(rdbModuleOpcodeDOUBLE); err != nil {
+		return 0, err
+	}
+	return structure.ReadDouble(mio.rd)
+}
+
+// LoadFloat 对应 RedisModule_LoadFloat
+func (mio *ModuleIO) LoadFloat() (float32, error) {
+	if err := mio.expect(rdbModuleOpcodeFLOAT); err != nil {
+		return 0, err
+	}
+	return structure.ReadBinaryFloat(mio.rd)
+}
+
+// LoadString 对应 RedisModule_LoadString 和 RedisModule_LoadStringBuffer
+func (mio *ModuleIO) LoadString() (string, error) {
+	if err := mio.expect(rdbModuleOpcodeSTRING); err != nil {
+		return "", err
+	}
+	return structure.ReadString(mio.rd)
+}
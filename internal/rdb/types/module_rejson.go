@@ -0,0 +1,91 @@
+package types
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/leijianzhong001/redis_agent/internal/rdb/structure"
+	"github.com/leijianzhong001/redis_agent/internal/utils"
+)
+
+// RedisJSON 2.x 的json类型, value以序列化后的json字符串保存, 见 RedisJSON/redis_json/src/redisjson.rs
+const (
+	jsonModuleName       = "ReJSON-RL"
+	jsonMinStringEncver  = 3 // 从该版本开始value为单个json字符串
+	jsonValueOverhead    = 8 // ijson 中的 IValue 是一个带标记的指针
+	jsonHeaderOverhead   = 16
+	jsonObjEntryOverhead = 24 // key(IString) + value(IValue) + 哈希槽位
+	jsonInlineIntMax     = 1<<23 - 1
+	jsonInlineIntMin     = -(1 << 23)
+)
+
+func init() {
+	RegisterModuleDecoder(jsonModuleName, func() ModuleDecoder { return &jsonDecoder{} })
+}
+
+type jsonDecoder struct {
+	data     string
+	overhead uint64
+}
+
+func (d *jsonDecoder) Load(mio *ModuleIO, encver int) error {
+	if encver < jsonMinStringEncver {
+		return structure.BadEncoding("unsupported %s encver=[%d]", jsonModuleName, encver)
+	}
+	data, err := mio.LoadString()
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err = decoder.Decode(&value); err != nil {
+		return structure.BadEncoding("invalid json in %s: %v", jsonModuleName, err)
+	}
+	d.data = data
+	d.overhead = jsonValueOverhead + jsonNodeOverhead(value)
+	return nil
+}
+
+// jsonNodeOverhead 估算一个json节点在ijson中除 IValue 本身以外的堆内存开销
+// null、bool以及24位以内的整数直接保存在 IValue 中, 不额外分配内存
+func jsonNodeOverhead(value interface{}) uint64 {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil && i >= jsonInlineIntMin && i <= jsonInlineIntMax {
+			return 0
+		}
+		return utils.MallocOverhead(jsonHeaderOverhead)
+	case string:
+		return jsonStringOverhead(v)
+	case []interface{}:
+		overhead := utils.MallocOverhead(jsonHeaderOverhead + jsonValueOverhead*uint64(len(v)))
+		for _, item := range v {
+			overhead += jsonNodeOverhead(item)
+		}
+		return overhead
+	case map[string]interface{}:
+		overhead := utils.MallocOverhead(jsonHeaderOverhead + jsonObjEntryOverhead*uint64(len(v)))
+		for field, item := range v {
+			overhead += jsonStringOverhead(field) + jsonNodeOverhead(item)
+		}
+		return overhead
+	default:
+		return 0
+	}
+}
+
+func jsonStringOverhead(s string) uint64 {
+	if len(s) == 0 {
+		return 0
+	}
+	return utils.MallocOverhead(jsonHeaderOverhead + uint64(len(s)))
+}
+
+func (d *jsonDecoder) MemOverhead() uint64 {
+	return d.overhead
+}
+
+func (d *jsonDecoder) Rewrite(key string) []RedisCmd {
+	return []RedisCmd{{"JSON.SET", key, "$", d.data}}
+}
@@ -0,0 +1,107 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+// moduleIdBytes 按照64位长度编码(RDB_64BITLEN)生成模块id
+func moduleIdBytes(name string, encver uint64) []byte {
+	var id uint64
+	for i := 0; i < len(name); i++ {
+		id = id<<6 | uint64(strings.IndexByte(moduleTypeNameCharSet, name[i]))
+	}
+	id = id<<10 | encver
+	buf := make([]byte, 9)
+	buf[0] = 0x81
+	binary.BigEndian.PutUint64(buf[1:], id)
+	return buf
+}
+
+// moduleValue 带有opcode注解的模块value, 只支持6bit以内的无符号整数
+type moduleValue []byte
+
+func (v moduleValue) uint(n byte) moduleValue {
+	return append(v, rdbModuleOpcodeUINT, n)
+}
+
+func (v moduleValue) double(f float64) moduleValue {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(f))
+	return append(append(v, rdbModuleOpcodeDOUBLE), buf...)
+}
+
+func (v moduleValue) str(s string) moduleValue {
+	return append(append(v, rdbModuleOpcodeSTRING, byte(len(s))), s...)
+}
+
+func (v moduleValue) eof() moduleValue {
+	return append(v, rdbModuleOpcodeEOF)
+}
+
+func TestParseModuleJSON(t *testing.T) {
+	payload := append(moduleIdBytes(jsonModuleName, 3), moduleValue{}.str(`{"a":[1,"x"]}`).eof()...)
+	o, err := ParseObject(bytes.NewReader(payload), rdbTypeModule2, "user1:json", nil)
+	if err != nil {
+		t.Fatalf("ParseObject() error: %v", err)
+	}
+	module := o.(*ModuleObject)
+	if _, ok := module.decoder.(*jsonDecoder); !ok {
+		t.Fatalf("decoder = %T, want *jsonDecoder", module.decoder)
+	}
+	cmds := module.Rewrite()
+	if len(cmds) != 1 || strings.Join(cmds[0], " ") != `JSON.SET user1:json $ {"a":[1,"x"]}` {
+		t.Errorf("Rewrite() = %v", cmds)
+	}
+}
+
+func TestParseModuleBloom(t *testing.T) {
+	bits := strings.Repeat("\x00", 32)
+	header := moduleValue{}.uint(10).uint(1).uint(0).uint(2) // size, nfilters, options, growth
+	value := header.uint(10).double(0.01).uint(7).double(9.6).uint(8).uint(8).str(bits).uint(10).eof()
+	o, err := ParseObject(bytes.NewReader(append(moduleIdBytes(bloomModuleName, 4), value...)), rdbTypeModule2, "user1:bf", nil)
+	if err != nil {
+		t.Fatalf("ParseObject() error: %v", err)
+	}
+	module := o.(*ModuleObject)
+	decoder, ok := module.decoder.(*bloomDecoder)
+	if !ok || len(decoder.filterBytes) != 1 || decoder.filterBytes[0] != 32 {
+		t.Fatalf("decoder = %+v", module.decoder)
+	}
+	if module.Rewrite() != nil {
+		t.Errorf("Rewrite() should be nil for bloom filters")
+	}
+}
+
+func TestParseModuleOpaque(t *testing.T) {
+	value := moduleValue{}.uint(1).str(strings.Repeat("v", 40)).eof()
+	payload := append(moduleIdBytes("unknown-m", 1), value...)
+	rd := bytes.NewReader(append(payload, 0xAA))
+	o, err := ParseObject(rd, rdbTypeModule2, "user1:m", nil)
+	if err != nil {
+		t.Fatalf("ParseObject() error: %v", err)
+	}
+	module := o.(*ModuleObject)
+	if module.decoder != nil || module.size != uint64(len(value)) || rd.Len() != 1 {
+		t.Fatalf("decoder=%v, size=%d, remaining=%d", module.decoder, module.size, rd.Len())
+	}
+	if module.MemOverhead() <= module.size {
+		t.Errorf("MemOverhead() = %d, size = %d", module.MemOverhead(), module.size)
+	}
+
+	// 无法解析的value退化为按照字节数估算, 且不影响后续读取
+	broken := append(moduleIdBytes(jsonModuleName, 3), moduleValue{}.str("{").eof()...)
+	o, err = ParseObject(bytes.NewReader(broken), rdbTypeModule2, "user1:json", nil)
+	if err != nil || o.(*ModuleObject).decoder != nil {
+		t.Fatalf("ParseObject() = %v, %v", o, err)
+	}
+
+	_, err = ParseObject(bytes.NewReader(payload), rdbTypeModule, "user1:m", nil)
+	if !errors.Is(err, ErrUnknownType) {
+		t.Errorf("module v1 without decoder error = %v, want ErrUnknownType", err)
+	}
+}
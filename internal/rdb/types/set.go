@@ -1,36 +1,48 @@
 package types
 
 import (
-	"github.com/leijianzhong001/redis_agent/internal/log"
+	"fmt"
 	"github.com/leijianzhong001/redis_agent/internal/rdb/structure"
 	"github.com/leijianzhong001/redis_agent/internal/utils"
 	"io"
 )
 
 type SetObject struct {
+	memProfileHolder
 	key      string
 	elements []string
+	encoding string // rdb中的源编码
 }
 
-func (o *SetObject) LoadFromBuffer(rd io.Reader, key string, typeByte byte) {
+func (o *SetObject) LoadFromBuffer(rd io.Reader, key string, typeByte byte) error {
 	o.key = key
+	o.encoding = sourceEncoding(typeByte)
+	var err error
 	switch typeByte {
 	case rdbTypeSet:
-		o.readSet(rd)
+		err = o.readSet(rd)
 	case rdbTypeSetIntset:
-		o.elements = structure.ReadIntset(rd)
+		o.elements, err = structure.ReadIntset(rd)
 	default:
-		log.Panicf("unknown set type. typeByte=[%d]", typeByte)
+		err = fmt.Errorf("%w: unknown set type %d", ErrUnknownType, typeByte)
 	}
+	return err
 }
 
-func (o *SetObject) readSet(rd io.Reader) {
-	size := int(structure.ReadLength(rd))
-	o.elements = make([]string, size)
-	for i := 0; i < size; i++ {
-		val := structure.ReadString(rd)
-		o.elements[i] = val
+func (o *SetObject) readSet(rd io.Reader) error {
+	size, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
 	}
+	o.elements = make([]string, 0, minCapacity(size))
+	for i := uint64(0); i < size; i++ {
+		val, err := structure.ReadString(rd)
+		if err != nil {
+			return err
+		}
+		o.elements = append(o.elements, val)
+	}
+	return nil
 }
 
 func (o *SetObject) Rewrite() []RedisCmd {
@@ -54,8 +66,13 @@ func (o *SetObject) Rewrite() []RedisCmd {
 //
 // 单key内存开销 = dictEntry大小 + key_SDS大小 + redisObject大小 + dict大小 + (dictEntry大小 + val_SDS大小) * value个数 + value_bucket个数 * 指针大小
 func (o *SetObject) MemOverhead() uint64 {
+	if values, ok := o.intsetValues(); ok {
+		// 单key内存开销 = dictEntry大小 + key_SDS大小 + redisObject大小 + intset大小
+		return utils.DictEntryOverhead() + utils.SdsOverhead(o.key) + utils.RedisObjOverhead() + utils.IntsetOverhead(values)
+	}
+
 	// `dictEntry`结构大小 + key_SDS大小 + redisObject大小 + dict大小
-	topLevelObjOverhead := utils.DictEntryOverhead() + utils.SdsOverhead(o.key) + utils.RedisObjOverhead() + utils.DictOverhead()
+	topLevelObjOverhead := utils.DictEntryOverhead() + utils.SdsOverhead(o.key) + utils.RedisObjOverhead() + o.memProfile().DictOverhead()
 	var dataOverhead uint64
 	for _, element := range o.elements {
 		dataOverhead += utils.DictEntryOverhead() + utils.SdsOverhead(element)
@@ -63,3 +80,34 @@ func (o *SetObject) MemOverhead() uint64 {
 	valueBucketOverhead := utils.FieldBucketOverhead(uint64(len(o.elements)))
 	return topLevelObjOverhead + dataOverhead + valueBucketOverhead
 }
+
+// intsetValues 元素个数不超过 set-max-intset-entries 且都是整数时, redis以intset保存当前set
+func (o *SetObject) intsetValues() ([]int64, bool) {
+	if uint64(len(o.elements)) > getEncodingConfig().SetMaxIntsetEntries {
+		return nil, false
+	}
+	values := make([]int64, len(o.elements))
+	for i, element := range o.elements {
+		v, ok := parseIntsetValue(element)
+		if !ok {
+			return nil, false
+		}
+		values[i] = v
+	}
+	return values, true
+}
+
+func (o *SetObject) Type() string {
+	return SetType
+}
+
+func (o *SetObject) Len() uint64 {
+	return uint64(len(o.elements))
+}
+
+func (o *SetObject) Encoding() string {
+	if _, ok := o.intsetValues(); ok {
+		return EncodingIntset
+	}
+	return EncodingHashtable
+}
@@ -0,0 +1,64 @@
+package types
+
+import (
+	"fmt"
+	"github.com/leijianzhong001/redis_agent/internal/rdb/structure"
+	"io"
+)
+
+// CanSkip 判断是否可以不解析value而直接跳过, stream和module的结构较为复杂, 只能通过 ParseObject 读取
+func CanSkip(typeByte byte) bool {
+	switch typeByte {
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeModule, rdbTypeModule2:
+		return false
+	default:
+		return true
+	}
+}
+
+// SkipObject 跳过一个value, 只读取确定value边界所需的长度信息, 用于在不解析value的情况下对rdb文件分帧
+// 跳过的字节与 ParseObject 读取的字节完全一致, 调用前需要用 CanSkip 判断是否支持该类型
+func SkipObject(rd io.Reader, typeByte byte) error {
+	switch typeByte {
+	case rdbTypeString, rdbTypeHashZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZSetZiplist,
+		rdbTypeHashZiplist, rdbTypeHashListpack, rdbTypeZSetListpack:
+		return structure.SkipString(rd)
+	case rdbTypeList, rdbTypeSet, rdbTypeListQuicklist:
+		return skipElements(rd, structure.SkipString)
+	case rdbTypeHash:
+		return skipElements(rd, structure.SkipString, structure.SkipString)
+	case rdbTypeZSet:
+		return skipElements(rd, structure.SkipString, structure.SkipFloat)
+	case rdbTypeZSet2:
+		return skipElements(rd, structure.SkipString, skipBinaryDouble)
+	case rdbTypeListQuicklist2:
+		return skipElements(rd, skipLength, structure.SkipString) // container + 节点内容
+	default:
+		return fmt.Errorf("%w: type %d can not be skipped", ErrUnknownType, typeByte)
+	}
+}
+
+// skipElements 跳过 <size> 以及之后的size个元素, 每个元素依次由parts中的函数跳过
+func skipElements(rd io.Reader, parts ...func(io.Reader) error) error {
+	size, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < size; i++ {
+		for _, skip := range parts {
+			if err = skip(rd); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func skipLength(rd io.Reader) error {
+	_, err := structure.ReadLength(rd)
+	return err
+}
+
+func skipBinaryDouble(rd io.Reader) error {
+	return structure.SkipBytes(rd, 8)
+}
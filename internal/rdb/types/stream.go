@@ -3,8 +3,8 @@ package types
 import (
 	"encoding/binary"
 	"fmt"
-	"github.com/leijianzhong001/redis_agent/internal/log"
 	"github.com/leijianzhong001/redis_agent/internal/rdb/structure"
+	"github.com/leijianzhong001/redis_agent/internal/utils"
 	"io"
 	"strconv"
 )
@@ -40,91 +40,88 @@ import (
  * the stream full entry. */
 
 type StreamObject struct {
+	memProfileHolder
 	key  string
 	cmds []RedisCmd
+
+	// 以下字段用于计算内存开销
+	length        uint64                // 消息数量, 即 XLEN
+	listpackSizes []uint64              // 每个listpack节点的字节数
+	groups        []streamConsumerGroup // 消费者组
+}
+
+// streamConsumerGroup 消费者组, 只保留计算内存开销需要的信息
+type streamConsumerGroup struct {
+	name      string
+	pelSize   uint64 // 消费者组的PEL(pending entries list)中的元素数量
+	consumers []streamConsumer
+}
+
+// streamConsumer 消费者, 只保留计算内存开销需要的信息
+type streamConsumer struct {
+	name    string
+	pelSize uint64 // 消费者的PEL中的元素数量
 }
 
-func (o *StreamObject) LoadFromBuffer(rd io.Reader, key string, typeByte byte) {
+func (o *StreamObject) LoadFromBuffer(rd io.Reader, key string, typeByte byte) error {
 	o.key = key
 	switch typeByte {
-	case rdbTypeStreamListpacks:
-		o.readStream(rd, key, typeByte)
-	case rdbTypeStreamListpacks2:
-		o.readStream(rd, key, typeByte)
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2:
+		return o.readStream(rd, key, typeByte)
 	default:
-		log.Panicf("unknown hash type. typeByte=[%d]", typeByte)
+		return fmt.Errorf("%w: unknown stream type %d", ErrUnknownType, typeByte)
 	}
 }
 
 // see redis rewriteStreamObject()
 
-func (o *StreamObject) readStream(rd io.Reader, masterKey string, typeByte byte) {
+func (o *StreamObject) readStream(rd io.Reader, masterKey string, typeByte byte) error {
 	// 1. length(number of listpack), k1, v1, k2, v2, ..., number, ms, seq
 
 	/* Load the number of Listpack. */
-	nListpack := int(structure.ReadLength(rd))
-	for i := 0; i < nListpack; i++ {
+	nListpack, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < nListpack; i++ {
 		/* Load key */
-		key := structure.ReadString(rd)
+		key, err := structure.ReadString(rd)
+		if err != nil {
+			return err
+		}
+		if len(key) != 16 {
+			return structure.BadEncoding("stream listpack key length is not 16. length=[%d]", len(key))
+		}
 
 		/* key is streamId, like: 1612181627287-0 */
 		masterMs := int64(binary.BigEndian.Uint64([]byte(key[:8])))
 		masterSeq := int64(binary.BigEndian.Uint64([]byte(key[8:])))
 
 		/* value is a listpack */
-		elements := structure.ReadListpack(rd)
-		inx := 0
-
-		/* The front of stream listpack is master entry */
-		/* Parse the master entry */
-		count := nextInteger(&inx, elements)          // count
-		deleted := nextInteger(&inx, elements)        // deleted
-		numFields := int(nextInteger(&inx, elements)) // num-fields
-
-		fields := elements[3 : 3+numFields] // fields
-		inx = 3 + numFields
-
-		// master entry end by zero
-		lastEntry := nextString(&inx, elements)
-		if lastEntry != "0" {
-			log.Panicf("master entry not ends by zero. lastEntry=[%s]", lastEntry)
+		elements, lpSize, err := structure.ReadListpackWithSize(rd)
+		if err != nil {
+			return err
 		}
-
-		/* Parse entries */
-		for count != 0 || deleted != 0 {
-			flags := nextInteger(&inx, elements) // [is_same_fields|is_deleted]
-			entryMs := nextInteger(&inx, elements)
-			entrySeq := nextInteger(&inx, elements)
-
-			args := []string{"xadd", masterKey, fmt.Sprintf("%v-%v", entryMs+masterMs, entrySeq+masterSeq)}
-
-			if flags&2 == 2 { // same fields, get field from master entry.
-				for j := 0; j < numFields; j++ {
-					args = append(args, fields[j], nextString(&inx, elements))
-				}
-			} else { // get field by lp.Next()
-				num := int(nextInteger(&inx, elements))
-				args = append(args, elements[inx:inx+num*2]...)
-				inx += num * 2
-			}
-
-			_ = nextString(&inx, elements) // lp_count
-
-			if flags&1 == 1 { // is_deleted
-				deleted -= 1
-			} else {
-				count -= 1
-				o.cmds = append(o.cmds, args)
-			}
+		o.listpackSizes = append(o.listpackSizes, lpSize)
+		if err = o.readStreamListpack(elements, masterKey, masterMs, masterSeq); err != nil {
+			return err
 		}
 	}
 
 	/* Load total number of items inside the stream. */
-	_ = structure.ReadLength(rd) // number
+	if o.length, err = structure.ReadLength(rd); err != nil { // number
+		return err
+	}
 
 	/* Load the last entry ID. */
-	lastMs := structure.ReadLength(rd)
-	lastSeq := structure.ReadLength(rd)
+	lastMs, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
+	lastSeq, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
 	lastid := fmt.Sprintf("%v-%v", lastMs, lastSeq)
 	if nListpack == 0 {
 		/* Use the XADD MAXLEN 0 trick to generate an empty stream if
@@ -139,114 +136,306 @@ func (o *StreamObject) readStream(rd io.Reader, masterKey string, typeByte byte)
 	o.cmds = append(o.cmds, []string{"xsetid", masterKey, lastid})
 
 	if typeByte == rdbTypeStreamListpacks2 {
-		/* Load the first entry ID. */
-		_ = structure.ReadLength(rd) // first_ms
-		_ = structure.ReadLength(rd) // first_seq
-
-		/* Load the maximal deleted entry ID. */
-		_ = structure.ReadLength(rd) // max_deleted_ms
-		_ = structure.ReadLength(rd) // max_deleted_seq
-
-		/* Load the offset. */
-		_ = structure.ReadLength(rd) // offset
+		/* Load the first entry ID: first_ms, first_seq.
+		 * Load the maximal deleted entry ID: max_deleted_ms, max_deleted_seq.
+		 * Load the offset. */
+		for j := 0; j < 5; j++ {
+			if _, err = structure.ReadLength(rd); err != nil {
+				return err
+			}
+		}
 	}
 
 	/* 2. nConsumerGroup, groupName, ms, seq, PEL, Consumers */
 
 	/* Load the number of groups. */
-	nConsumerGroup := int(structure.ReadLength(rd))
-	for i := 0; i < nConsumerGroup; i++ {
-		/* Load groupName */
-		groupName := structure.ReadString(rd)
+	nConsumerGroup, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < nConsumerGroup; i++ {
+		if err = o.readConsumerGroup(rd, masterKey, typeByte); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		/* Load the last ID */
-		lastMs := structure.ReadLength(rd)
-		lastSeq := structure.ReadLength(rd)
-		lastid := fmt.Sprintf("%v-%v", lastMs, lastSeq)
+// readStreamListpack 解析一个stream listpack, 最前面是master entry, 之后是每一个具体的entry
+func (o *StreamObject) readStreamListpack(elements []string, masterKey string, masterMs int64, masterSeq int64) error {
+	inx := 0
 
-		/* Create Group */
-		o.cmds = append(o.cmds, []string{"CREATE", masterKey, groupName, lastid})
+	/* The front of stream listpack is master entry */
+	/* Parse the master entry */
+	count, err := nextInteger(&inx, elements) // count
+	if err != nil {
+		return err
+	}
+	deleted, err := nextInteger(&inx, elements) // deleted
+	if err != nil {
+		return err
+	}
+	numFieldsInt, err := nextInteger(&inx, elements) // num-fields
+	if err != nil {
+		return err
+	}
+	numFields := int(numFieldsInt)
+	if numFields < 0 || 3+numFields > len(elements) {
+		return structure.BadEncoding("stream master entry num-fields out of range. numFields=[%d]", numFields)
+	}
 
-		/* Load group offset. */
-		if typeByte == rdbTypeStreamListpacks2 {
-			_ = structure.ReadLength(rd) // offset
+	fields := elements[3 : 3+numFields] // fields
+	inx = 3 + numFields
+
+	// master entry end by zero
+	lastEntry, err := nextString(&inx, elements)
+	if err != nil {
+		return err
+	}
+	if lastEntry != "0" {
+		return structure.BadEncoding("master entry not ends by zero. lastEntry=[%s]", lastEntry)
+	}
+
+	/* Parse entries */
+	for count != 0 || deleted != 0 {
+		flags, err := nextInteger(&inx, elements) // [is_same_fields|is_deleted]
+		if err != nil {
+			return err
+		}
+		entryMs, err := nextInteger(&inx, elements)
+		if err != nil {
+			return err
+		}
+		entrySeq, err := nextInteger(&inx, elements)
+		if err != nil {
+			return err
+		}
+
+		args := []string{"xadd", masterKey, fmt.Sprintf("%v-%v", entryMs+masterMs, entrySeq+masterSeq)}
+
+		if flags&2 == 2 { // same fields, get field from master entry.
+			for j := 0; j < numFields; j++ {
+				value, err := nextString(&inx, elements)
+				if err != nil {
+					return err
+				}
+				args = append(args, fields[j], value)
+			}
+		} else { // get field by lp.Next()
+			num, err := nextInteger(&inx, elements)
+			if err != nil {
+				return err
+			}
+			if num < 0 || inx+int(num)*2 > len(elements) {
+				return structure.BadEncoding("stream entry num-fields out of range. num=[%d]", num)
+			}
+			args = append(args, elements[inx:inx+int(num)*2]...)
+			inx += int(num) * 2
 		}
 
-		/* Load the global PEL */
-		nPel := int(structure.ReadLength(rd))
-		mapId2Time := make(map[string]uint64)
-		mapId2Count := make(map[string]uint64)
+		if _, err = nextString(&inx, elements); err != nil { // lp_count
+			return err
+		}
+
+		if flags&1 == 1 { // is_deleted
+			deleted -= 1
+		} else {
+			count -= 1
+			o.cmds = append(o.cmds, args)
+		}
+	}
+	return nil
+}
+
+// readConsumerGroup 读取一个消费者组以及其中的PEL和消费者
+func (o *StreamObject) readConsumerGroup(rd io.Reader, masterKey string, typeByte byte) error {
+	/* Load groupName */
+	groupName, err := structure.ReadString(rd)
+	if err != nil {
+		return err
+	}
+
+	/* Load the last ID */
+	lastMs, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
+	lastSeq, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
+	lastid := fmt.Sprintf("%v-%v", lastMs, lastSeq)
+
+	/* Create Group */
+	o.cmds = append(o.cmds, []string{"CREATE", masterKey, groupName, lastid})
+	group := streamConsumerGroup{name: groupName}
+
+	/* Load group offset. */
+	if typeByte == rdbTypeStreamListpacks2 {
+		if _, err = structure.ReadLength(rd); err != nil { // offset
+			return err
+		}
+	}
+
+	/* Load the global PEL */
+	nPel, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
+	group.pelSize = nPel
+	mapId2Time := make(map[string]uint64)
+	mapId2Count := make(map[string]uint64)
+
+	for j := uint64(0); j < nPel; j++ {
+		/* Load streamId */
+		streamId, err := readStreamId(rd)
+		if err != nil {
+			return err
+		}
+
+		/* Load deliveryTime */
+		deliveryTime, err := structure.ReadUint64(rd)
+		if err != nil {
+			return err
+		}
+
+		/* Load deliveryCount */
+		deliveryCount, err := structure.ReadLength(rd)
+		if err != nil {
+			return err
+		}
+
+		/* Save deliveryTime and deliveryCount  */
+		mapId2Time[streamId] = deliveryTime
+		mapId2Count[streamId] = deliveryCount
+	}
+
+	/* Generate XCLAIMs for each consumer that happens to
+	 * have pending entries. Empty consumers are discarded. */
+	nConsumer, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
+	}
+	for j := uint64(0); j < nConsumer; j++ {
+		/* Load consumerName */
+		consumerName, err := structure.ReadString(rd)
+		if err != nil {
+			return err
+		}
+
+		/* Load lastSeenTime */
+		if _, err = structure.ReadUint64(rd); err != nil {
+			return err
+		}
+
+		/* Consumer PEL */
+		nPEL, err := structure.ReadLength(rd)
+		if err != nil {
+			return err
+		}
+		group.consumers = append(group.consumers, streamConsumer{name: consumerName, pelSize: nPEL})
+		for i := uint64(0); i < nPEL; i++ {
 
-		for j := 0; j < nPel; j++ {
 			/* Load streamId */
-			tmpBytes := structure.ReadBytes(rd, 16)
-			ms := binary.BigEndian.Uint64(tmpBytes[:8])
-			seq := binary.BigEndian.Uint64(tmpBytes[8:])
-			streamId := fmt.Sprintf("%v-%v", ms, seq)
-
-			/* Load deliveryTime */
-			deliveryTime := structure.ReadUint64(rd)
-
-			/* Load deliveryCount */
-			deliveryCount := structure.ReadLength(rd)
-
-			/* Save deliveryTime and deliveryCount  */
-			mapId2Time[streamId] = deliveryTime
-			mapId2Count[streamId] = deliveryCount
-		}
-
-		/* Generate XCLAIMs for each consumer that happens to
-		 * have pending entries. Empty consumers are discarded. */
-		nConsumer := int(structure.ReadLength(rd))
-		for j := 0; j < nConsumer; j++ {
-			/* Load consumerName */
-			consumerName := structure.ReadString(rd)
-
-			/* Load lastSeenTime */
-			_ = structure.ReadUint64(rd)
-
-			/* Consumer PEL */
-			nPEL := int(structure.ReadLength(rd))
-			for i := 0; i < nPEL; i++ {
-
-				/* Load streamId */
-				tmpBytes := structure.ReadBytes(rd, 16)
-				ms := binary.BigEndian.Uint64(tmpBytes[:8])
-				seq := binary.BigEndian.Uint64(tmpBytes[8:])
-				streamId := fmt.Sprintf("%v-%v", ms, seq)
-
-				/* Send */
-				args := []string{
-					"xclaim", masterKey, groupName, consumerName, "0", streamId,
-					"TIME", strconv.FormatUint(mapId2Time[streamId], 10),
-					"RETRYCOUNT", strconv.FormatUint(mapId2Count[streamId], 10),
-					"JUSTID", "FORCE"}
-				o.cmds = append(o.cmds, args)
+			streamId, err := readStreamId(rd)
+			if err != nil {
+				return err
 			}
+
+			/* Send */
+			args := []string{
+				"xclaim", masterKey, groupName, consumerName, "0", streamId,
+				"TIME", strconv.FormatUint(mapId2Time[streamId], 10),
+				"RETRYCOUNT", strconv.FormatUint(mapId2Count[streamId], 10),
+				"JUSTID", "FORCE"}
+			o.cmds = append(o.cmds, args)
 		}
 	}
+	o.groups = append(o.groups, group)
+	return nil
 }
 
-func nextInteger(inx *int, elements []string) int64 {
-	ele := elements[*inx]
-	*inx++
+// readStreamId 读取16字节的原始streamId, 前8个字节为ms, 后8个字节为seq
+func readStreamId(rd io.Reader) (string, error) {
+	tmpBytes, err := structure.ReadBytes(rd, 16)
+	if err != nil {
+		return "", err
+	}
+	ms := binary.BigEndian.Uint64(tmpBytes[:8])
+	seq := binary.BigEndian.Uint64(tmpBytes[8:])
+	return fmt.Sprintf("%v-%v", ms, seq), nil
+}
+
+func nextInteger(inx *int, elements []string) (int64, error) {
+	ele, err := nextString(inx, elements)
+	if err != nil {
+		return 0, err
+	}
 	i, err := strconv.ParseInt(ele, 10, 64)
 	if err != nil {
-		log.Panicf("integer is not a number. ele=[%s]", ele)
+		return 0, structure.BadEncoding("integer is not a number. ele=[%s]", ele)
 	}
-	return i
+	return i, nil
 }
 
-func nextString(inx *int, elements []string) string {
+func nextString(inx *int, elements []string) (string, error) {
+	if *inx >= len(elements) {
+		return "", structure.BadEncoding("stream listpack ends unexpectedly. inx=[%d]", *inx)
+	}
 	ele := elements[*inx]
 	*inx++
-	return ele
+	return ele, nil
 }
 
 func (o *StreamObject) Rewrite() []RedisCmd {
 	return o.cmds
 }
 
+// MemOverhead 计算当前key加载到redis中以后的内存开销
+// 一个`stream`存储结构最终会产生以下几个消耗内存的结构(相关代码可查阅`t_stream.c`)：
+//		- 1个`dictEntry`结构，24字节，负责保存当前的stream对象；
+//		- 1个`SDS`结构，用作`key`字符串，占`4~18`个字节；
+//		- 1个`redisObject`结构，`16`字节，指向当前`key`下属的`stream`结构；
+//		- 1个`stream`结构以及其中的`rax`结构；
+//		- 1棵以streamId为key的基数树，每个叶子节点指向一个`listpack`，listpack按照实际字节数应用jemalloc规则；
+//		- 每个消费者组一个`streamCG`结构，以及一棵保存PEL的基数树，PEL中每个元素对应一个`streamNACK`结构；
+//		- 每个消费者一个`streamConsumer`结构，以及一棵保存该消费者PEL的基数树，其中的元素与消费者组共享`streamNACK`；
+// 单个key的内存消耗 = dictEntry大小 + key_SDS大小 + redisObject大小 + stream结构 + 基数树 + listpack总大小 + 消费者组开销 + 消费者开销
 func (o *StreamObject) MemOverhead() uint64 {
-	return 0
+	topLevelObjOverhead := utils.DictEntryOverhead() + utils.SdsOverhead(o.key) + utils.RedisObjOverhead()
+
+	// stream结构 + 保存listpack的基数树 + 所有listpack
+	dataOverhead := o.memProfile().StreamOverhead() + memProfiler.SizeofStreamRadixTree(uint64(len(o.listpackSizes)))
+	for _, lpSize := range o.listpackSizes {
+		dataOverhead += utils.MallocOverhead(lpSize)
+	}
+
+	if len(o.groups) == 0 {
+		return topLevelObjOverhead + dataOverhead
+	}
+
+	// 以消费者组名称为key的基数树
+	groupOverhead := memProfiler.SizeofStreamRadixTree(uint64(len(o.groups)))
+	for _, group := range o.groups {
+		// streamCG结构 + PEL基数树 + streamNACK + 以消费者名称为key的基数树
+		groupOverhead += o.memProfile().StreamCG() + memProfiler.SizeofStreamRadixTree(group.pelSize) + memProfiler.StreamNACK(group.pelSize)
+		groupOverhead += memProfiler.SizeofStreamRadixTree(uint64(len(group.consumers)))
+		for _, consumer := range group.consumers {
+			// streamConsumer结构 + 消费者PEL基数树, streamNACK已经在消费者组中计算过了
+			groupOverhead += memProfiler.StreamConsumer([]byte(consumer.name)) + memProfiler.SizeofStreamRadixTree(consumer.pelSize)
+		}
+	}
+	return topLevelObjOverhead + dataOverhead + groupOverhead
+}
+
+func (o *StreamObject) Type() string {
+	return StreamType
+}
+
+func (o *StreamObject) Encoding() string {
+	return EncodingStream
+}
+
+func (o *StreamObject) Len() uint64 {
+	return o.length
 }
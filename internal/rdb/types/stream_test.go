@@ -0,0 +1,79 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// lpUint 7bit无符号整数的listpack entry
+func lpUint(v byte) []byte {
+	return []byte{v, 1}
+}
+
+// lpStr 6bit长度字符串的listpack entry
+func lpStr(s string) []byte {
+	return append(append([]byte{0x80 | byte(len(s))}, s...), byte(1+len(s)))
+}
+
+func streamId(ms uint64, seq uint64) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], ms)
+	binary.BigEndian.PutUint64(buf[8:], seq)
+	return buf
+}
+
+// streamPayload 包含一个entry(f=v)、一个消费者组g和一个消费者c的stream, 消费者组和消费者的PEL中各有一个元素
+func streamPayload() []byte {
+	var entries []byte
+	// master entry: count=1, deleted=0, num-fields=1, "f", 0
+	for _, e := range [][]byte{lpUint(1), lpUint(0), lpUint(1), lpStr("f"), lpUint(0)} {
+		entries = append(entries, e...)
+	}
+	// entry: flags=SAMEFIELDS, ms-diff=0, seq-diff=0, "v", lp-count=3
+	for _, e := range [][]byte{lpUint(2), lpUint(0), lpUint(0), lpStr("v"), lpUint(3)} {
+		entries = append(entries, e...)
+	}
+	lp := make([]byte, 6)
+	binary.LittleEndian.PutUint32(lp[:4], uint32(6+len(entries)+1))
+	binary.LittleEndian.PutUint16(lp[4:], 10)
+	lp = append(append(lp, entries...), 0xFF)
+
+	var payload []byte
+	payload = append(payload, 0x01, 0x10)        // listpack数量, streamId长度16
+	payload = append(payload, streamId(1, 0)...) // listpack的master streamId
+	payload = append(payload, byte(len(lp)))
+	payload = append(payload, lp...)
+	payload = append(payload, 0x01, 0x01, 0x00) // 元素数量, last id
+	payload = append(payload, 0x01, 0x01, 'g')  // 消费者组数量, 组名
+	payload = append(payload, 0x01, 0x00)       // 消费者组的last id
+	payload = append(payload, 0x01)             // 消费者组的PEL
+	payload = append(payload, streamId(1, 0)...)
+	payload = append(payload, make([]byte, 8)...) // delivery time
+	payload = append(payload, 0x01)               // delivery count
+	payload = append(payload, 0x01, 0x01, 'c')    // 消费者数量, 消费者名
+	payload = append(payload, make([]byte, 8)...) // seen time
+	payload = append(payload, 0x01)               // 消费者的PEL
+	payload = append(payload, streamId(1, 0)...)
+	return payload
+}
+
+func TestParseStream(t *testing.T) {
+	o, err := ParseObject(bytes.NewReader(streamPayload()), rdbTypeStreamListpacks, "user1:stream", nil)
+	if err != nil {
+		t.Fatalf("ParseObject() error: %v", err)
+	}
+	stream := o.(*StreamObject)
+	if len(stream.listpackSizes) != 1 || len(stream.groups) != 1 {
+		t.Fatalf("listpackSizes=%v, groups=%v", stream.listpackSizes, stream.groups)
+	}
+	group := stream.groups[0]
+	if group.name != "g" || group.pelSize != 1 || len(group.consumers) != 1 || group.consumers[0].pelSize != 1 {
+		t.Fatalf("unexpected consumer group %+v", group)
+	}
+
+	withoutGroups := &StreamObject{key: stream.key, listpackSizes: stream.listpackSizes}
+	if withoutGroups.MemOverhead() == 0 || stream.MemOverhead() <= withoutGroups.MemOverhead() {
+		t.Errorf("stream overhead %d, without groups %d", stream.MemOverhead(), withoutGroups.MemOverhead())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/leijianzhong001/redis_agent/internal/rdb/structure"
 	"github.com/leijianzhong001/redis_agent/internal/utils"
 	"io"
+	"strconv"
 )
 
 type StringObject struct {
@@ -12,9 +13,11 @@ type StringObject struct {
 }
 
 // LoadFromBuffer 从指定的reader中读取一个字符串，并填充到当前对象
-func (o *StringObject) LoadFromBuffer(rd io.Reader, key string, _ byte) {
+func (o *StringObject) LoadFromBuffer(rd io.Reader, key string, _ byte) error {
 	o.key = key
-	o.value = structure.ReadString(rd)
+	var err error
+	o.value, err = structure.ReadString(rd)
+	return err
 }
 
 func (o *StringObject) Rewrite() []RedisCmd {
@@ -29,7 +32,26 @@ func (o *StringObject) Rewrite() []RedisCmd {
 // 		1个SDS结构，用作key字符串，视字符串长短占`4~18`个字节；
 // 		1个`redisObject`结构，16字节，用作val对象（这个`redisObject`对象就是`dictEntry`中的共用体v）；
 // 		1个SDS结构，用作val字符串，占`4~18`个字节;
+// 过期时间的开销由Loader按照过期字典统一计算
 func (o *StringObject) MemOverhead() uint64 {
-	// todo 加过期时间开销
 	return utils.DictEntryOverhead() + utils.SdsOverhead(o.key) + utils.StringValueOverhead(o.value)
 }
+
+func (o *StringObject) Type() string {
+	return StringType
+}
+
+// Encoding 长度不超过20且可以转换为long long的字符串为int编码, 其余按照长度区分embstr和raw
+func (o *StringObject) Encoding() string {
+	if _, err := strconv.ParseInt(o.value, 10, 64); err == nil && len(o.value) <= 20 {
+		return EncodingInt
+	}
+	if uint64(len(o.value)) <= utils.EmbStrEncodingMaxLen {
+		return EncodingEmbstr
+	}
+	return EncodingRaw
+}
+
+func (o *StringObject) Len() uint64 {
+	return uint64(len(o.value))
+}
@@ -2,10 +2,11 @@ package types
 
 import (
 	"fmt"
-	"github.com/leijianzhong001/redis_agent/internal/log"
 	"github.com/leijianzhong001/redis_agent/internal/rdb/structure"
 	"github.com/leijianzhong001/redis_agent/internal/utils"
 	"io"
+	"math"
+	"strconv"
 )
 
 type ZSetEntry struct {
@@ -14,70 +15,65 @@ type ZSetEntry struct {
 }
 
 type ZsetObject struct {
+	memProfileHolder
 	key      string
 	elements []ZSetEntry
+	encoding string // rdb中的源编码
 }
 
-func (o *ZsetObject) LoadFromBuffer(rd io.Reader, key string, typeByte byte) {
+func (o *ZsetObject) LoadFromBuffer(rd io.Reader, key string, typeByte byte) error {
 	o.key = key
+	o.encoding = sourceEncoding(typeByte)
 	switch typeByte {
 	case rdbTypeZSet:
-		o.readZset(rd)
+		return o.readZset(rd, structure.ReadFloat)
 	case rdbTypeZSet2:
-		o.readZset2(rd)
+		return o.readZset(rd, structure.ReadDouble)
 	case rdbTypeZSetZiplist:
-		o.readZsetZiplist(rd)
+		return o.readZsetPairs(structure.ReadZipList(rd))
 	case rdbTypeZSetListpack:
-		o.readZsetListpack(rd)
+		return o.readZsetPairs(structure.ReadListpack(rd))
 	default:
-		log.Panicf("unknown zset type. typeByte=[%d]", typeByte)
+		return fmt.Errorf("%w: unknown zset type %d", ErrUnknownType, typeByte)
 	}
 }
 
-func (o *ZsetObject) readZset(rd io.Reader) {
-	size := int(structure.ReadLength(rd))
-	o.elements = make([]ZSetEntry, size)
-	for i := 0; i < size; i++ {
-		o.elements[i].Member = structure.ReadString(rd)
-		score := structure.ReadFloat(rd)
-		o.elements[i].Score = fmt.Sprintf("%f", score)
+// readZset 读取 member, score 依次排列的zset, rdbTypeZSet的score为字符串, rdbTypeZSet2的score为二进制double
+func (o *ZsetObject) readZset(rd io.Reader, readScore func(io.Reader) (float64, error)) error {
+	size, err := structure.ReadLength(rd)
+	if err != nil {
+		return err
 	}
-}
-
-func (o *ZsetObject) readZset2(rd io.Reader) {
-	size := int(structure.ReadLength(rd))
-	o.elements = make([]ZSetEntry, size)
-	for i := 0; i < size; i++ {
-		o.elements[i].Member = structure.ReadString(rd)
-		score := structure.ReadDouble(rd)
-		o.elements[i].Score = fmt.Sprintf("%f", score)
+	o.elements = make([]ZSetEntry, 0, minCapacity(size))
+	for i := uint64(0); i < size; i++ {
+		member, err := structure.ReadString(rd)
+		if err != nil {
+			return err
+		}
+		score, err := readScore(rd)
+		if err != nil {
+			return err
+		}
+		o.elements = append(o.elements, ZSetEntry{Member: member, Score: fmt.Sprintf("%f", score)})
 	}
+	return nil
 }
 
-func (o *ZsetObject) readZsetZiplist(rd io.Reader) {
-	list := structure.ReadZipList(rd)
-	size := len(list)
-	if size%2 != 0 {
-		log.Panicf("zset listpack size is not even. size=[%d]", size)
+// readZsetPairs 从ziplist或listpack中读取到的 member1, score1, member2, score2 ... 列表中填充zset
+func (o *ZsetObject) readZsetPairs(list []string, err error) error {
+	if err != nil {
+		return err
 	}
-	o.elements = make([]ZSetEntry, size/2)
-	for i := 0; i < size; i += 2 {
-		o.elements[i/2].Member = list[i]
-		o.elements[i/2].Score = list[i+1]
-	}
-}
-
-func (o *ZsetObject) readZsetListpack(rd io.Reader) {
-	list := structure.ReadListpack(rd)
 	size := len(list)
 	if size%2 != 0 {
-		log.Panicf("zset listpack size is not even. size=[%d]", size)
+		return structure.BadEncoding("zset pair list size is not even. size=[%d]", size)
 	}
 	o.elements = make([]ZSetEntry, size/2)
 	for i := 0; i < size; i += 2 {
 		o.elements[i/2].Member = list[i]
 		o.elements[i/2].Score = list[i+1]
 	}
+	return nil
 }
 
 func (o *ZsetObject) Rewrite() []RedisCmd {
@@ -105,8 +101,12 @@ func (o *ZsetObject) Rewrite() []RedisCmd {
 // 4^n = C， `n`为索引节点层数编号,`C`为该层元素数量元素数量。 假如元素总量为3000w, 那么这里的n的最大值为`12`，即最大可能有12层索引节点($4^{12}=16777216$)。
 // 单key内存开销 = dictEntry + key_sds + value_redisObject + zset + dict + dictEntry * n + 8 * elementbucketCount($elementbucketCount= 2^b, elementbucketCount >= n$) + skiplist + zskiplistNode * n
 func (o *ZsetObject) MemOverhead() uint64 {
+	if o.fitsCompact() {
+		return o.compactMemOverhead()
+	}
+
 	// `dictEntry`结构大小 + key_SDS大小 + redisObject大小 + dict大小
-	topLevelObjOverhead := utils.DictEntryOverhead() + utils.SdsOverhead(o.key) + utils.RedisObjOverhead() + utils.ZsetOverhead() + utils.DictOverhead() + utils.FieldBucketOverhead(uint64(len(o.elements))) + utils.ZskiplistOverhead()
+	topLevelObjOverhead := utils.DictEntryOverhead() + utils.SdsOverhead(o.key) + utils.RedisObjOverhead() + utils.ZsetOverhead() + o.memProfile().DictOverhead() + utils.FieldBucketOverhead(uint64(len(o.elements))) + utils.ZskiplistOverhead()
 	var dataOverhead uint64
 	for _, element := range o.elements {
 		dataOverhead += utils.DictEntryOverhead() + utils.ZskiplistNodeOverhead(element.Member)
@@ -120,3 +120,52 @@ func (o *ZsetObject) MemOverhead() uint64 {
 	valueBucketOverhead := utils.FieldBucketOverhead(uint64(len(o.elements)))
 	return topLevelObjOverhead + dataOverhead + indexOverhead + valueBucketOverhead
 }
+
+// fitsCompact 判断当前zset是否满足 zset-max-ziplist-entries 和 zset-max-ziplist-value
+func (o *ZsetObject) fitsCompact() bool {
+	config := getEncodingConfig()
+	if uint64(len(o.elements)) > config.ZsetMaxEntries {
+		return false
+	}
+	for _, element := range o.elements {
+		if uint64(len(element.Member)) > config.ZsetMaxValue {
+			return false
+		}
+	}
+	return true
+}
+
+// compactMemOverhead ziplist(或listpack)编码的zset的内存开销
+// member和score依次保存在同一个ziplist中, score以字符串形式保存, 整数分值会按照整数编码
+// 		单个key的内存消耗 = dictEntry大小 + key_SDS大小 + redisObject大小 + ziplist大小
+func (o *ZsetObject) compactMemOverhead() uint64 {
+	topLevelObjOverhead := utils.DictEntryOverhead() + utils.SdsOverhead(o.key) + utils.RedisObjOverhead()
+
+	elements := make([]string, 0, len(o.elements)*2)
+	for _, element := range o.elements {
+		score := element.Score
+		if f, err := strconv.ParseFloat(score, 64); err == nil {
+			score = strconv.FormatFloat(f, 'g', 17, 64)
+			if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+				score = strconv.FormatInt(int64(f), 10)
+			}
+		}
+		elements = append(elements, element.Member, score)
+	}
+	return topLevelObjOverhead + packedOverhead(compactEncoding(o.encoding, o.memProfile()), elements)
+}
+
+func (o *ZsetObject) Type() string {
+	return ZSetType
+}
+
+func (o *ZsetObject) Len() uint64 {
+	return uint64(len(o.elements))
+}
+
+func (o *ZsetObject) Encoding() string {
+	if o.fitsCompact() {
+		return compactEncoding(o.encoding, o.memProfile())
+	}
+	return EncodingSkiplist
+}
@@ -3,5 +3,8 @@ package reader
 import "github.com/leijianzhong001/redis_agent/internal/entry"
 
 type Reader interface {
+	// StartRead 开始读取, 读取结束或者出错时关闭返回的channel
 	StartRead() chan *entry.Entry
+	// Err 返回读取过程中遇到的错误, 需要在StartRead返回的channel关闭之后调用
+	Err() error
 }
@@ -1,6 +1,7 @@
 package reader
 
 import (
+	"fmt"
 	"github.com/leijianzhong001/redis_agent/internal/entry"
 	"github.com/leijianzhong001/redis_agent/internal/log"
 	"github.com/leijianzhong001/redis_agent/internal/rdb"
@@ -10,39 +11,51 @@ import (
 )
 
 type rdbReader struct {
-	path string
-	ch   chan *entry.Entry
+	path    string
+	options rdb.LoaderOptions
+	ch      chan *entry.Entry
+	err     error
 }
 
-func NewRDBReader(path string) Reader {
+func NewRDBReader(path string, options rdb.LoaderOptions) (Reader, error) {
 	log.Infof("NewRDBReader: path=[%s]", path)
 	absolutePath, err := filepath.Abs(path)
 	if err != nil {
-		log.Panicf("NewRDBReader: filepath.Abs error: %s", err.Error())
+		return nil, fmt.Errorf("NewRDBReader: filepath.Abs error: %w", err)
 	}
 	log.Infof("NewRDBReader: absolute path=[%s]", absolutePath)
 	r := new(rdbReader)
 	r.path = absolutePath
-	return r
+	r.options = options
+	return r, nil
 }
 
 func (r *rdbReader) StartRead() chan *entry.Entry {
 	r.ch = make(chan *entry.Entry, 1024)
 
 	go func() {
+		// channel关闭之前r.err已经写入完成, 所以在channel关闭之后读取r.err是安全的
+		defer close(r.ch)
 		// start parse rdb
 		log.Infof("start send RDB. path=[%s]", r.path)
 		fi, err := os.Stat(r.path)
 		if err != nil {
-			log.Panicf("NewRDBReader: os.Stat error: %s", err.Error())
+			r.err = fmt.Errorf("NewRDBReader: os.Stat error: %w", err)
+			return
 		}
 		statistics.Metrics.RdbFileSize = uint64(fi.Size())
 		statistics.Metrics.RdbReceivedSize = uint64(fi.Size())
-		rdbLoader := rdb.NewLoader(r.path, r.ch)
-		_ = rdbLoader.ParseRDB()
+		rdbLoader := rdb.NewLoaderWithOptions(r.path, r.ch, r.options)
+		if _, err = rdbLoader.ParseRDB(); err != nil {
+			r.err = err
+			return
+		}
 		log.Infof("send RDB finished. path=[%s]", r.path)
-		close(r.ch)
 	}()
 
 	return r.ch
 }
+
+func (r *rdbReader) Err() error {
+	return r.err
+}
@@ -0,0 +1,214 @@
+package reader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/leijianzhong001/redis_agent/internal/entry"
+	"github.com/leijianzhong001/redis_agent/internal/log"
+	"github.com/leijianzhong001/redis_agent/internal/rdb/types"
+	"github.com/leijianzhong001/redis_agent/internal/statistics"
+	"github.com/leijianzhong001/redis_agent/internal/utils"
+)
+
+// ScanOptions 在线扫描keyspace的参数
+type ScanOptions struct {
+	// 每次SCAN的COUNT, 不大于0时为1000
+	Count int64
+	// 两批之间的间隔, 用于限制对线上实例的压力
+	Interval time.Duration
+	// MEMORY USAGE的SAMPLES, 不大于0时使用redis的默认值5
+	Samples int
+	// 需要扫描的逻辑库, 为空时扫描 INFO keyspace 中所有有key的逻辑库
+	Dbs []int
+}
+
+type scanReader struct {
+	options ScanOptions
+	ch      chan *entry.Entry
+	err     error
+}
+
+// NewScanReader 通过SCAN遍历keyspace, 使用 TYPE/OBJECT ENCODING/MEMORY USAGE/PTTL 得到每个key的信息
+// 不依赖bgsave, 可以在主节点上执行, 产生的entry与rdb模式一致
+func NewScanReader(options ScanOptions) Reader {
+	if options.Count <= 0 {
+		options.Count = 1000
+	}
+	log.Infof("NewScanReader: count=[%d], interval=[%v], samples=[%d], dbs=%v", options.Count, options.Interval, options.Samples, options.Dbs)
+	return &scanReader{options: options}
+}
+
+func (r *scanReader) StartRead() chan *entry.Entry {
+	r.ch = make(chan *entry.Entry, 1024)
+
+	go func() {
+		defer close(r.ch)
+		statistics.SetDecodeWorkers(1)
+		dbs := r.options.Dbs
+		if len(dbs) == 0 {
+			info, err := utils.GetRedisClient().Info(context.Background(), "keyspace").Result()
+			if err != nil {
+				r.err = fmt.Errorf("NewScanReader: info keyspace error: %w", err)
+				return
+			}
+			dbs = utils.ParseKeyspaceDbs(info)
+		}
+		for _, db := range dbs {
+			if err := r.scanDb(db); err != nil {
+				r.err = err
+				return
+			}
+		}
+		log.Infof("scan keyspace finished. dbs=%v", dbs)
+	}()
+
+	return r.ch
+}
+
+func (r *scanReader) Err() error {
+	return r.err
+}
+
+// scanDb 每个逻辑库使用单独的连接, 避免SELECT影响共享的客户端
+func (r *scanReader) scanDb(db int) error {
+	options := *utils.GetRedisClient().Options()
+	options.DB = db
+	client := redis.NewClient(&options)
+	defer client.Close()
+
+	log.Infof("start scan db. db=[%d]", db)
+	ctx := context.Background()
+	var cursor uint64
+	for {
+		keys, nextCursor, err := client.Scan(ctx, cursor, "", r.options.Count).Result()
+		if err != nil {
+			return fmt.Errorf("scan db %d error: %w", db, err)
+		}
+		entries, err := r.inspect(ctx, client, db, keys)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			r.ch <- e
+		}
+
+		cursor = nextCursor
+		statistics.Metrics.ScanDbId = db
+		statistics.Metrics.ScanCursor = cursor
+		statistics.UpdateDecodeThroughput()
+		if cursor == 0 {
+			return nil
+		}
+		if r.options.Interval > 0 {
+			time.Sleep(r.options.Interval)
+		}
+	}
+}
+
+// inspect 通过两次pipeline得到一批key的信息, 扫描过程中被删除的key会被跳过
+func (r *scanReader) inspect(ctx context.Context, client *redis.Client, db int, keys []string) ([]*entry.Entry, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	typeCmds := make([]*redis.StatusCmd, len(keys))
+	encodingCmds := make([]*redis.StringCmd, len(keys))
+	usageCmds := make([]*redis.IntCmd, len(keys))
+	pttlCmds := make([]*redis.DurationCmd, len(keys))
+	pipe := client.Pipeline()
+	for i, key := range keys {
+		typeCmds[i] = pipe.Type(ctx, key)
+		encodingCmds[i] = pipe.ObjectEncoding(ctx, key)
+		if r.options.Samples > 0 {
+			usageCmds[i] = pipe.MemoryUsage(ctx, key, r.options.Samples)
+		} else {
+			usageCmds[i] = pipe.MemoryUsage(ctx, key)
+		}
+		pttlCmds[i] = pipe.PTTL(ctx, key)
+	}
+	// 被删除的key会返回redis.Nil, 这类错误逐个命令检查, 只有网络等错误才中止扫描
+	if _, err := pipe.Exec(ctx); isFatalError(err) {
+		return nil, fmt.Errorf("inspect keys in db %d error: %w", db, err)
+	}
+
+	now := time.Now()
+	entries := make([]*entry.Entry, 0, len(keys))
+	lenPipe := client.Pipeline()
+	lenCmds := make([]*redis.IntCmd, 0, len(keys))
+	for i, key := range keys {
+		typeName, err := typeCmds[i].Result()
+		if err != nil || typeName == "none" {
+			continue
+		}
+		usage, err := usageCmds[i].Result()
+		if err != nil {
+			continue
+		}
+		pttl, err := pttlCmds[i].Result()
+		if err != nil || pttl == -2 {
+			continue
+		}
+
+		e := entry.NewEntry()
+		e.DbId = db
+		e.Key = key
+		e.Type = typeName
+		e.Encoding = encodingCmds[i].Val()
+		// MEMORY USAGE不包含过期字典的开销, 与rdb模式一样按照24字节计算
+		e.Overhead = uint64(usage)
+		if pttl >= 0 {
+			e.IsExpireKey = true
+			e.ExpireAt = now.Add(pttl).UnixNano() / int64(time.Millisecond)
+			e.Overhead += 24
+		}
+		lenCmd := LengthCmd(ctx, lenPipe, typeName, key)
+		if lenCmd == nil {
+			// TYPE对模块类型返回模块数据类型名称, 与rdb模式保持一致
+			e.Type = types.ModuleType
+			e.Encoding = typeName
+		}
+		lenCmds = append(lenCmds, lenCmd)
+		entries = append(entries, e)
+	}
+
+	// 两次pipeline之间key的类型可能已经改变, 此时长度为0
+	if _, err := lenPipe.Exec(ctx); isFatalError(err) {
+		return nil, fmt.Errorf("get length of keys in db %d error: %w", db, err)
+	}
+	for i, e := range entries {
+		if lenCmds[i] != nil {
+			e.Length = uint64(lenCmds[i].Val())
+		}
+		statistics.AddDecodedKey(0)
+	}
+	return entries, nil
+}
+
+// isFatalError 网络等错误, redis针对单个命令返回的错误(包括redis.Nil)不是致命错误
+func isFatalError(err error) bool {
+	var replyError redis.Error
+	return err != nil && !errors.As(err, &replyError)
+}
+
+// LengthCmd 得到key的大小的命令, 与 RedisObject.Len 一致, 模块类型返回nil
+func LengthCmd(ctx context.Context, pipe redis.Pipeliner, typeName string, key string) *redis.IntCmd {
+	switch typeName {
+	case types.StringType:
+		return pipe.StrLen(ctx, key)
+	case types.ListType:
+		return pipe.LLen(ctx, key)
+	case types.SetType:
+		return pipe.SCard(ctx, key)
+	case types.ZSetType:
+		return pipe.ZCard(ctx, key)
+	case types.HashType:
+		return pipe.HLen(ctx, key)
+	case types.StreamType:
+		return pipe.XLen(ctx, key)
+	}
+	return nil
+}
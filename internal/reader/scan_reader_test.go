@@ -0,0 +1,223 @@
+package reader
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/leijianzhong001/redis_agent/internal/rdb/types"
+)
+
+// fakeKey 假的redis中一个key的信息
+type fakeKey struct {
+	typeName string
+	encoding string
+	usage    int64
+	pttl     int64
+	length   int64
+}
+
+// serveFakeRedis 启动一个只支持inspect用到的命令的RESP服务端, 不在keys中的key视为已经被删除
+func serveFakeRedis(t *testing.T, keys map[string]fakeKey) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeConn(conn, keys)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveFakeConn(conn net.Conn, keys map[string]fakeKey) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		if _, err = io.WriteString(conn, fakeReply(args, keys)); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand 读取RESP数组格式的命令
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = rd.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func fakeReply(args []string, keys map[string]fakeKey) string {
+	command := strings.ToLower(args[0])
+	if command == "object" || command == "memory" {
+		command += " " + strings.ToLower(args[1])
+		args = args[1:]
+	}
+	key, ok := keys[args[1]]
+	switch command {
+	case "type":
+		if !ok {
+			return "+none\r\n"
+		}
+		return "+" + key.typeName + "\r\n"
+	case "object encoding":
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(key.encoding), key.encoding)
+	case "memory usage":
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", key.usage)
+	case "pttl":
+		if !ok {
+			return ":-2\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", key.pttl)
+	case "strlen", "llen", "scard", "zcard", "hlen", "xlen":
+		return fmt.Sprintf(":%d\r\n", key.length)
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func TestScanReaderInspect(t *testing.T) {
+	addr := serveFakeRedis(t, map[string]fakeKey{
+		"user1:s":  {typeName: types.StringType, encoding: "embstr", usage: 56, pttl: -1, length: 5},
+		"user1:h":  {typeName: types.HashType, encoding: "listpack", usage: 100, pttl: 5000, length: 3},
+		"user1:bf": {typeName: "MBbloom--", encoding: "raw", usage: 300, pttl: -1},
+	})
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	defer client.Close()
+
+	r := &scanReader{}
+	now := time.Now()
+	entries, err := r.inspect(context.Background(), client, 2, []string{"user1:s", "user1:gone", "user1:h", "user1:bf"})
+	if err != nil {
+		t.Fatalf("inspect() error: %v", err)
+	}
+	// SCAN之后被删除的key被跳过
+	if len(entries) != 3 {
+		t.Fatalf("inspect() returned %d entries, want 3", len(entries))
+	}
+
+	s, h, bf := entries[0], entries[1], entries[2]
+	if s.Key != "user1:s" || s.DbId != 2 || s.Type != types.StringType || s.Encoding != "embstr" || s.Overhead != 56 || s.Length != 5 || s.IsExpireKey {
+		t.Errorf("string entry = %+v", s)
+	}
+	// 有过期时间的key加上过期字典的开销
+	if h.Type != types.HashType || h.Overhead != 124 || h.Length != 3 || !h.IsExpireKey {
+		t.Errorf("hash entry = %+v", h)
+	}
+	if expireAt := now.Add(5*time.Second).UnixNano() / int64(time.Millisecond); h.ExpireAt < expireAt || h.ExpireAt > expireAt+1000 {
+		t.Errorf("hash ExpireAt = %d, want about %d", h.ExpireAt, expireAt)
+	}
+	// 模块类型与rdb模式一致, 类型为module, 编码为模块数据类型名称
+	if bf.Type != types.ModuleType || bf.Encoding != "MBbloom--" || bf.Overhead != 300 || bf.Length != 0 {
+		t.Errorf("module entry = %+v", bf)
+	}
+
+	if entries, err = r.inspect(context.Background(), client, 0, nil); err != nil || entries != nil {
+		t.Errorf("inspect(nil) = %v, %v", entries, err)
+	}
+}
+
+func TestScanReaderInspectNetworkError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+	defer client.Close()
+	if _, err = (&scanReader{}).inspect(context.Background(), client, 0, []string{"user1:s"}); err == nil {
+		t.Errorf("inspect() should fail when redis is unavailable")
+	}
+}
+
+func TestLengthCmd(t *testing.T) {
+	client := redis.NewClient(&redis.Options{})
+	defer client.Close()
+	pipe := client.Pipeline()
+	cases := map[string]string{
+		types.StringType: "strlen",
+		types.ListType:   "llen",
+		types.SetType:    "scard",
+		types.ZSetType:   "zcard",
+		types.HashType:   "hlen",
+		types.StreamType: "xlen",
+	}
+	for typeName, want := range cases {
+		cmd := LengthCmd(context.Background(), pipe, typeName, "user1:k")
+		if cmd == nil || cmd.Name() != want || cmd.Args()[1] != "user1:k" {
+			t.Errorf("LengthCmd(%s) = %v, want %s", typeName, cmd, want)
+		}
+	}
+	if cmd := LengthCmd(context.Background(), pipe, "MBbloom--", "user1:k"); cmd != nil {
+		t.Errorf("LengthCmd(module) = %v, want nil", cmd)
+	}
+}
+
+// replyError redis针对单个命令返回的错误
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+
+func (replyError) RedisError() {}
+
+func TestIsFatalError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{redis.Nil, false},
+		{replyError("ERR no such key"), false},
+		{fmt.Errorf("pipeline: %w", replyError("WRONGTYPE")), false},
+		{errors.New("connection reset by peer"), true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+	}
+	for _, c := range cases {
+		if got := isFatalError(c.err); got != c.want {
+			t.Errorf("isFatalError(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"math/bits"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,6 +27,13 @@ type metrics struct {
 	RdbReceivedSize uint64 `json:"rdb_received_size"`
 	RdbSendSize     uint64 `json:"rdb_send_size"`
 
+	// rdb decode
+	DecodeWorkers     int     `json:"decode_workers"`
+	DecodedKeys       uint64  `json:"decoded_keys"`
+	DecodedBytes      uint64  `json:"decoded_bytes"`
+	DecodeKeysPerSec  float64 `json:"decode_keys_per_sec"`
+	DecodeBytesPerSec float64 `json:"decode_bytes_per_sec"`
+
 	// aof
 	AofReceivedOffset uint64 `json:"aof_received_offset"`
 	AofAppliedOffset  uint64 `json:"aof_applied_offset"`
@@ -44,6 +52,10 @@ type metrics struct {
 
 var Metrics = &metrics{}
 
+// 上一次计算解析吞吐量时的计数
+var lastDecodeTime time.Time
+var lastDecodedKeys, lastDecodedBytes uint64
+
 func Handler(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
 	err := json.NewEncoder(w).Encode(Metrics)
@@ -138,6 +150,40 @@ func UpdateRDBSentSize(offset uint64) {
 	Metrics.RdbSendSize = offset
 }
 
+// rdb decode
+
+// SetDecodeWorkers 开始解析rdb文件时调用, 同时清空上一次的解析计数
+func SetDecodeWorkers(workers int) {
+	Metrics.DecodeWorkers = workers
+	atomic.StoreUint64(&Metrics.DecodedKeys, 0)
+	atomic.StoreUint64(&Metrics.DecodedBytes, 0)
+	Metrics.DecodeKeysPerSec = 0
+	Metrics.DecodeBytesPerSec = 0
+	lastDecodeTime = time.Now()
+	lastDecodedKeys, lastDecodedBytes = 0, 0
+}
+
+// AddDecodedKey 解析完成一个key, size为value在rdb文件中占用的字节数。多个worker会并发调用
+func AddDecodedKey(size uint64) {
+	atomic.AddUint64(&Metrics.DecodedKeys, 1)
+	atomic.AddUint64(&Metrics.DecodedBytes, size)
+}
+
+// UpdateDecodeThroughput 根据距离上一次调用的时间计算解析吞吐量
+func UpdateDecodeThroughput() {
+	now := time.Now()
+	seconds := now.Sub(lastDecodeTime).Seconds()
+	if seconds <= 0 {
+		return
+	}
+	keys := atomic.LoadUint64(&Metrics.DecodedKeys)
+	bytes := atomic.LoadUint64(&Metrics.DecodedBytes)
+	Metrics.DecodeKeysPerSec = float64(keys-lastDecodedKeys) / seconds
+	Metrics.DecodeBytesPerSec = float64(bytes-lastDecodedBytes) / seconds
+	lastDecodeTime = now
+	lastDecodedKeys, lastDecodedBytes = keys, bytes
+}
+
 // aof
 
 func UpdateAOFReceivedOffset(offset uint64) {
@@ -0,0 +1,33 @@
+package utils
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, str string
+		want         bool
+	}{
+		{"user1:*", "user1:cache:1", true},
+		{"user1:*", "user2:cache:1", false},
+		{"*", "", true},
+		{"user1:**:1", "user1:a:b:1", true},
+		{"user1:cache:?", "user1:cache:1", true},
+		{"user1:cache:?", "user1:cache:12", false},
+		{"user1:[ab]*", "user1:b", true},
+		{"user1:[^ab]*", "user1:b", false},
+		{"user1:[a-c]", "user1:c", true},
+		{"user1:[c-a]", "user1:b", true},
+		{"user1:[a-c]", "user1:d", false},
+		{`user1:\*`, "user1:*", true},
+		{`user1:\*`, "user1:a", false},
+		{`user1:[\]]`, "user1:]", true},
+		{"user1:[ab", "user1:a", true},
+		{"user1:[ab", "user1:ab", false},
+		{"user1:cache", "user1:cache:1", false},
+	}
+	for _, c := range cases {
+		if got := GlobMatch(c.pattern, c.str); got != c.want {
+			t.Errorf("GlobMatch(%q, %q) = %v, want %v", c.pattern, c.str, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// MemProfile 不同redis版本的内存模型差异, 计算内存开销时按照生成rdb文件的redis版本选择
+// 5.x与6.x中计算开销用到的结构体大小一致, 因此只区分7.0之前和之后
+type MemProfile struct {
+	// Name 版本名称, 如 7.x
+	Name string
+	// DictSize dict结构体的大小, 7.0之前dict中内嵌了两个dictht, 7.0之后只保留了两个table指针
+	DictSize uint64
+	// StreamSize stream结构体的大小, 7.0之后增加了 first_id、max_deleted_entry_id 和 entries_added
+	StreamSize uint64
+	// StreamCGSize streamCG结构体的大小, 7.0之后增加了 entries_read
+	StreamCGSize uint64
+	// Listpack 为true时hash、zset使用listpack替代ziplist, quicklist的节点也使用listpack(quicklist v2)
+	Listpack bool
+}
+
+var (
+	// MemProfilePre7 redis 7.0 之前(5.x、6.x)的内存模型
+	MemProfilePre7 = MemProfile{
+		Name:         "pre-7.0",
+		DictSize:     pointerSize + pointerSize + pointerSize*4*2 + longSize + 4, // type + privdata + ht[2] + rehashidx + iterators
+		StreamSize:   pointerSize + longSize + 16 + pointerSize,                  // rax + length + last_id + cgroups
+		StreamCGSize: 16 + pointerSize + pointerSize,                             // last_id + pel + consumers
+	}
+	// MemProfileRedis7 redis 7.x 的内存模型
+	MemProfileRedis7 = MemProfile{
+		Name:         "7.x",
+		DictSize:     pointerSize + pointerSize*2 + longSize*2 + longSize + 2 + 2 + 4, // type + ht_table[2] + ht_used[2] + rehashidx + pauserehash + ht_size_exp[2] + 对齐
+		StreamSize:   MemProfilePre7.StreamSize + 16 + 16 + 8,                         // + first_id + max_deleted_entry_id + entries_added
+		StreamCGSize: MemProfilePre7.StreamCGSize + 8,                                 // + entries_read
+		Listpack:     true,
+	}
+)
+
+// DefaultMemProfile 无法确定redis版本时使用的内存模型
+var DefaultMemProfile = &MemProfilePre7
+
+// MemProfileForVersion 根据redis版本号(如 6.2.7)选择内存模型, 无法识别的版本号使用 DefaultMemProfile
+func MemProfileForVersion(version string) *MemProfile {
+	major, err := strconv.Atoi(strings.SplitN(strings.TrimSpace(version), ".", 2)[0])
+	if err != nil {
+		return DefaultMemProfile
+	}
+	if major >= 7 {
+		return &MemProfileRedis7
+	}
+	return &MemProfilePre7
+}
@@ -15,6 +15,7 @@
 package utils
 
 import (
+	"math"
 	"math/rand"
 	"sort"
 	"strconv"
@@ -107,8 +108,9 @@ func (m *MemProfiler) SizeofStreamRadixTree(numElements uint64) uint64 {
 	return 16*numElements + numNodes*4 + numNodes*30*8
 }
 
-func (m *MemProfiler) StreamOverhead() uint64 {
-	return 2*pointerSize + 8 + 16 + // stream struct
+// StreamOverhead stream结构体和rax结构体的开销, stream结构体的大小与redis版本有关
+func (p *MemProfile) StreamOverhead() uint64 {
+	return p.StreamSize + // stream struct
 		pointerSize + 8*2 // rax struct
 }
 
@@ -116,8 +118,9 @@ func (m *MemProfiler) StreamConsumer(name []byte) uint64 {
 	return pointerSize*2 + 8 + SdsOverhead(string(name))
 }
 
-func (m *MemProfiler) StreamCG() uint64 {
-	return pointerSize*2 + 16
+// StreamCG streamCG结构体的开销, 与redis版本有关
+func (p *MemProfile) StreamCG() uint64 {
+	return p.StreamCGSize
 }
 
 func (m *MemProfiler) StreamNACK(length uint64) uint64 {
@@ -139,8 +142,8 @@ func (m *MemProfiler) LinkedListEntryOverhead() uint64 {
 }
 
 // SkiplistOverhead get memory use of a skiplist
-func (m *MemProfiler) SkiplistOverhead(size uint64) uint64 {
-	return 2*pointerSize + DictOverhead() + (2*pointerSize + 16)
+func (p *MemProfile) SkiplistOverhead(size uint64) uint64 {
+	return 2*pointerSize + p.DictOverhead() + (2*pointerSize + 16)
 }
 
 // SkiplistEntryOverhead get memory use of a skiplist entry
@@ -256,8 +259,9 @@ func SdsOverhead(val string) uint64 {
 }
 
 const (
-	intEncodingMaxLen    = 20
-	embStrEncodingMaxLen = 44
+	intEncodingMaxLen = 20
+	// EmbStrEncodingMaxLen 小于等于该长度的字符串使用embstr编码, 见object.c/OBJ_ENCODING_EMBSTR_SIZE_LIMIT
+	EmbStrEncodingMaxLen = 44
 )
 
 // StringValueOverhead get memory use of a string
@@ -274,7 +278,12 @@ func StringValueOverhead(val string) uint64 {
 		return RedisObjOverhead() + 0
 	}
 
-	// OBJ_ENCODING_RAW 和 OBJ_ENCODING_EMBSTR的区别在于其内存分配操作进行了两次，一次给redisObject, 一次给SDS, 但二者占用的内存大小是一致的
+	// OBJ_ENCODING_EMBSTR 只分配一次内存, redisObject和sdshdr8连续存放, 见object.c/createEmbeddedStringObject
+	if stringLen <= EmbStrEncodingMaxLen {
+		return MallocOverhead(1 + LRU_BITS + 4 + pointerSize + sizeOfSdshdr8 + stringLen)
+	}
+
+	// OBJ_ENCODING_RAW 分配两次内存，一次给redisObject, 一次给SDS
 	sdsSize := SdsOverhead(val)
 	return RedisObjOverhead() + sdsSize
 }
@@ -328,8 +337,17 @@ func RedisObjOverhead() uint64 {
 //    long rehashidx;      // rehash索引，代表下一次执行扩容单步操作要迁移的ht[0]hash表数组索引，当不进行rehash时，值为-1 8
 //    int iterators;       // 当前该字典迭代器个数,迭代器用于遍历字典键值对                                           4
 //} dict;
-func DictOverhead() uint64 {
-	return MallocOverhead(pointerSize + pointerSize + DictHtOverhead()*2 + pointerSize + 4)
+// 7.0之后dictht被合并进dict，结构大小见 MemProfile.DictSize
+//struct dict {
+//    dictType *type;                  // 8
+//    dictEntry **ht_table[2];         // 16
+//    unsigned long ht_used[2];        // 16
+//    long rehashidx;                  // 8
+//    int16_t pauserehash;             // 2
+//    signed char ht_size_exp[2];      // 2
+//};
+func (p *MemProfile) DictOverhead() uint64 {
+	return MallocOverhead(p.DictSize)
 }
 
 // DictHtOverhead 返回dictht结构体占用的内存大小
@@ -454,6 +472,85 @@ func ZlentryOverhead(previousEntryLength uint64, context string) uint64 {
 	return uint64(previousEntryLengthOverhead + encodingOverhead + sz)
 }
 
+// ListpackOverhead 结构开销
+// listpack的结构 ：<tot-bytes> <num-elements> <element-1> ... <element-N> <listpack-end-byte>
+//		- `tot-bytes`  4字节，记录整个listpack占用的内存字节数。
+//		- `num-elements` 2字节，记录元素个数。
+//		- `listpack-end-byte` 1字节，0xFF 标记listpack的结束。
+// 见listpack.c#lpNew函数。与ziplist一样，jemalloc规则在计算listpack总开销时应用一次
+func ListpackOverhead() uint64 {
+	return 4 + 2 + 1
+}
+
+// LpEntryOverhead listpack中单个元素的开销
+// entry结构为 <encoding-type><element-data><element-tot-len>, 不再记录前一个元素的长度，所以不会有ziplist的连锁更新问题
+//		- 能够转换为整数的元素按照 7bit/13bit/16bit/24bit/32bit/64bit 整数编码，分别占用 1/2/3/4/5/9 个字节
+//		- 字符串按照 6bit/12bit/32bit 长度编码，encoding分别占用 1/2/5 个字节
+//		- `element-tot-len` 记录encoding + element-data的长度，每个字节使用7bit，占用1~5个字节
+// 见listpack.c#lpEncodeGetType函数
+func LpEntryOverhead(element string) uint64 {
+	var size uint64
+	if v, err := strconv.ParseInt(element, 10, 64); err == nil && strconv.FormatInt(v, 10) == element {
+		switch {
+		case v >= 0 && v <= 127:
+			size = 1
+		case v >= -4096 && v <= 4095:
+			size = 2
+		case v >= math.MinInt16 && v <= math.MaxInt16:
+			size = 3
+		case v >= -8388608 && v <= 8388607:
+			size = 4
+		case v >= math.MinInt32 && v <= math.MaxInt32:
+			size = 5
+		default:
+			size = 9
+		}
+	} else {
+		length := uint64(len(element))
+		if length < 64 {
+			size = 1 + length
+		} else if length < 4096 {
+			size = 2 + length
+		} else {
+			size = 5 + length
+		}
+	}
+
+	// element-tot-len
+	switch {
+	case size <= 127:
+		return size + 1
+	case size < 16383:
+		return size + 2
+	case size < 2097151:
+		return size + 3
+	case size < 268435455:
+		return size + 4
+	default:
+		return size + 5
+	}
+}
+
+// IntsetOverhead 整数集合开销
+// typedef struct intset {
+//    uint32_t encoding; // 元素宽度, 2、4、8字节 4
+//    uint32_t length;   // 元素个数 4
+//    int8_t contents[];
+//} intset;
+// 所有元素按照最大元素所需的宽度保存，见intset.c#_intsetValueEncoding函数
+func IntsetOverhead(values []int64) uint64 {
+	width := uint64(2)
+	for _, v := range values {
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			width = 8
+			break
+		} else if v < math.MinInt16 || v > math.MaxInt16 {
+			width = 4
+		}
+	}
+	return MallocOverhead(4 + 4 + width*uint64(len(values)))
+}
+
 // ZsetOverhead Zset结构开销
 // typedef struct zset {
 //    dict *dict; // 8
@@ -18,3 +18,46 @@ func TestZslRandomLevelFunc(t *testing.T) {
 		fmt.Printf("level: %d, count: %d\n", i, u)
 	}
 }
+
+func TestLpEntryOverhead(t *testing.T) {
+	cases := map[string]uint64{
+		"7":                       2,
+		"-100":                    3,
+		"30000":                   4,
+		"100000":                  5,
+		"3000000000":              10,
+		"007":                     5, // 不是规范的整数表示，按照字符串编码
+		"hello":                   7,
+		string(make([]byte, 100)): 103,
+	}
+	for element, want := range cases {
+		if got := LpEntryOverhead(element); got != want {
+			t.Errorf("LpEntryOverhead(%q) = %d, want %d", element, got, want)
+		}
+	}
+}
+
+func TestIntsetOverhead(t *testing.T) {
+	if got := IntsetOverhead([]int64{1, 2, 3}); got != MallocOverhead(8+2*3) {
+		t.Errorf("IntsetOverhead(int16) = %d", got)
+	}
+	if got := IntsetOverhead([]int64{1, 1 << 40}); got != MallocOverhead(8+8*2) {
+		t.Errorf("IntsetOverhead(int64) = %d", got)
+	}
+}
+
+func TestMemProfileForVersion(t *testing.T) {
+	cases := map[string]*MemProfile{"5.0.14": &MemProfilePre7, "6.2.7": &MemProfilePre7, "7.0.11": &MemProfileRedis7, "7.2.0": &MemProfileRedis7, "": DefaultMemProfile, "unknown": DefaultMemProfile}
+	for version, want := range cases {
+		if got := MemProfileForVersion(version); got != want {
+			t.Errorf("MemProfileForVersion(%q) = %s, want %s", version, got.Name, want.Name)
+		}
+	}
+
+	if got := MemProfilePre7.DictOverhead(); got != 96 {
+		t.Errorf("DictOverhead() before 7.0 = %d, want 96", got)
+	}
+	if got := MemProfileRedis7.DictOverhead(); got != 64 {
+		t.Errorf("DictOverhead() of 7.x = %d, want 64", got)
+	}
+}
@@ -3,6 +3,8 @@ package utils
 import (
 	"context"
 	"github.com/go-redis/redis/v8"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -64,3 +66,24 @@ func ParseInfoProp(info string, prop string) string {
 	}
 	return ""
 }
+
+// ParseKeyspaceDbs 从 INFO keyspace 的结果中解析出有key的逻辑库, 如 db0:keys=1,expires=0,avg_ttl=0 => 0
+func ParseKeyspaceDbs(info string) []int {
+	dbs := make([]int, 0, 1)
+	for _, ele := range strings.Split(info, "\r\n") {
+		if !strings.HasPrefix(ele, "db") {
+			continue
+		}
+		index := strings.IndexByte(ele, ':')
+		if index < 0 {
+			continue
+		}
+		db, err := strconv.Atoi(ele[2:index])
+		if err != nil {
+			continue
+		}
+		dbs = append(dbs, db)
+	}
+	sort.Ints(dbs)
+	return dbs
+}
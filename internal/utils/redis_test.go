@@ -3,6 +3,7 @@ package utils
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -16,3 +17,13 @@ func TestRedisClient(t *testing.T) {
 	}
 	fmt.Println(result)
 }
+
+func TestParseKeyspaceDbs(t *testing.T) {
+	info := "# Keyspace\r\ndb3:keys=2,expires=1,avg_ttl=100\r\ndb0:keys=10,expires=0,avg_ttl=0\r\n"
+	if dbs := ParseKeyspaceDbs(info); !reflect.DeepEqual(dbs, []int{0, 3}) {
+		t.Errorf("ParseKeyspaceDbs() = %v, want [0 3]", dbs)
+	}
+	if dbs := ParseKeyspaceDbs("# Keyspace\r\n"); len(dbs) != 0 {
+		t.Errorf("ParseKeyspaceDbs() of empty keyspace = %v", dbs)
+	}
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"github.com/leijianzhong001/redis_agent/internal/cleaner"
+	"github.com/leijianzhong001/redis_agent/internal/config"
+	"github.com/leijianzhong001/redis_agent/internal/memanalysis"
 	"github.com/leijianzhong001/redis_agent/server"
 	"github.com/leijianzhong001/redis_agent/task"
 	log "github.com/sirupsen/logrus"
@@ -23,12 +26,40 @@ func init() {
 }
 
 func main() {
+	configFile := flag.String("conf", "", "agent config file in toml format, use default config if not set")
+	flag.Parse()
+	if *configFile != "" {
+		if err := config.LoadAgentConfig(*configFile); err != nil {
+			panic(err)
+		}
+	}
+
+	// 快照目录不可用时只是不保存快照, 不影响其他功能
+	if snapshotDir := config.Agent.Snapshot.Dir; snapshotDir != "" {
+		if err := memanalysis.InitSnapshotStore(snapshotDir, config.Agent.Snapshot.Retention); err != nil {
+			log.Warnf("init snapshot store %s fail, snapshots will not be saved: %v", snapshotDir, err)
+		}
+	}
+
 	cleanerX, err := cleaner.NewCleaner()
 	if err != nil {
 		panic(err)
 	}
 
-	srv := server.NewRedisAgentServer(":6389", cleanerX)
+	// 检查点目录不可用时清理任务无法恢复, 不影响清理本身
+	if checkpointDir := config.Agent.Clean.CheckpointDir; checkpointDir != "" {
+		interval := time.Duration(config.Agent.Clean.CheckpointInterval) * time.Second
+		if err = cleaner.InitCheckpointStore(checkpointDir, interval); err != nil {
+			log.Warnf("init checkpoint store %s fail, clean tasks can not be resumed: %v", checkpointDir, err)
+		}
+	}
+
+	srv := server.NewRedisAgentServer(config.Agent.Address, cleanerX)
+	if config.Agent.Clean.AutoResume {
+		if err = srv.ResumeCleanTasks(); err != nil {
+			log.Warnf("resume clean tasks fail: %v", err)
+		}
+	}
 
 	errChan, err := srv.ListenAndServe()
 	if err != nil {
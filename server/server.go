@@ -8,6 +8,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/leijianzhong001/redis_agent/internal/cleaner"
 	"github.com/leijianzhong001/redis_agent/internal/memanalysis"
+	"github.com/leijianzhong001/redis_agent/internal/statistics"
 	"github.com/leijianzhong001/redis_agent/internal/utils"
 	"github.com/leijianzhong001/redis_agent/server/middleware"
 	"github.com/leijianzhong001/redis_agent/task"
@@ -35,6 +36,8 @@ func NewRedisAgentServer(addr string, cleaner *cleaner.SystemDataCleaner) *Redis
 	router.HandleFunc("/task", agentServer.createTask).Methods("POST")
 	// 获取清理任务状态
 	router.HandleFunc("/task/{taskId}", agentServer.reportProgress).Methods("GET")
+	// 从检查点恢复清理任务
+	router.HandleFunc("/task/{taskId}/resume", agentServer.resumeTask).Methods("POST")
 
 	router.HandleFunc("/serverStatus", agentServer.serverStatus).Methods("GET")
 
@@ -44,6 +47,31 @@ func NewRedisAgentServer(addr string, cleaner *cleaner.SystemDataCleaner) *Redis
 	// 获取数据分析结果
 	router.HandleFunc("/analysisInfo", agentServer.analysisInfo).Methods("GET")
 
+	// 按照前缀逐层下钻数据分析结果, 如 /analysisInfo/tree?prefix=user1:order:
+	router.HandleFunc("/analysisInfo/tree", agentServer.analysisTree).Methods("GET")
+
+	// 获取大key, 如 /analysisInfo/bigKeys?userName=user1, 不指定userName时返回全局的大key
+	router.HandleFunc("/analysisInfo/bigKeys", agentServer.bigKeys).Methods("GET")
+
+	// 获取历史快照列表
+	router.HandleFunc("/snapshots", agentServer.listSnapshots).Methods("GET")
+	// 获取两个快照之间每个用户的变化, 如 /snapshots/trend?from=1760000000000&to=1760600000000, 不指定时比较最新的两个快照
+	router.HandleFunc("/snapshots/trend", agentServer.snapshotTrend).Methods("GET")
+	// 获取指定的历史快照
+	router.HandleFunc("/snapshots/{snapshotId}", agentServer.getSnapshot).Methods("GET")
+
+	// 获取最近一次配额检查中超出配额的用户
+	router.HandleFunc("/quotaViolations", agentServer.quotaViolations).Methods("GET")
+
+	// 获取最近一次校准的结果
+	router.HandleFunc("/calibration", agentServer.calibration).Methods("GET")
+
+	// 获取集群汇总任务的结果
+	router.HandleFunc("/clusterAnalysisInfo", agentServer.clusterAnalysisInfo).Methods("GET")
+
+	// 获取rdb解析进度和吞吐量
+	router.HandleFunc("/metrics", statistics.Handler).Methods("GET")
+
 	agentServer.httpServer.Handler = middleware.Logging(middleware.Validating(router))
 	return agentServer
 }
@@ -121,6 +149,45 @@ func (agentServer *RedisAgentServer) createTask(w http.ResponseWriter, req *http
 	response(w, SucWithMsg("succeeded in creating a task"))
 }
 
+// resumeTask 从检查点恢复中断的清理任务, 任务id不变
+func (agentServer *RedisAgentServer) resumeTask(w http.ResponseWriter, req *http.Request) {
+	taskIdInt, err := strconv.Atoi(mux.Vars(req)["taskId"])
+	if err != nil {
+		http.Error(w, "parseInt taskId error: "+mux.Vars(req)["taskId"], http.StatusBadRequest)
+		return
+	}
+
+	taskInfo, err := cleaner.ResumeTaskInfo(taskIdInt)
+	if err != nil {
+		response(w, FailWithMsg(err.Error()))
+		return
+	}
+	if err = taskInfo.RecreateTask(); err != nil {
+		response(w, FailWithMsg(err.Error()))
+		return
+	}
+
+	go agentServer.startTask(taskInfo)
+	response(w, SucWithMsg("succeeded in resuming the task"))
+}
+
+// ResumeCleanTasks 启动时恢复所有有检查点的清理任务
+func (agentServer *RedisAgentServer) ResumeCleanTasks() error {
+	taskInfos, err := cleaner.ResumableTasks()
+	if err != nil {
+		return err
+	}
+	for _, taskInfo := range taskInfos {
+		if err = taskInfo.RecreateTask(); err != nil {
+			log.Errorf("resume task %d fail: %v", taskInfo.TaskId, err)
+			continue
+		}
+		log.Infof("resume clean task %d from checkpoint", taskInfo.TaskId)
+		go agentServer.startTask(taskInfo)
+	}
+	return nil
+}
+
 func (agentServer *RedisAgentServer) startTask(taskInfo *task.GenericTaskInfo) {
 	// 匿名函数会以闭包的方式访问外围函数的变量 err, 所以后面的逻辑如果导致了err有值，那么defer函数中访问err也会有值
 	var err error
@@ -147,7 +214,11 @@ func (agentServer *RedisAgentServer) startTask(taskInfo *task.GenericTaskInfo) {
 	case task.CLEAN:
 		err = agentServer.cleaner.ExecuteClean(taskInfo)
 	case task.STATISTIC:
-		err = memanalysis.ExecuteStatistic()
+		err = memanalysis.ExecuteStatistic(taskInfo)
+	case task.AGGREGATE:
+		err = memanalysis.ExecuteAggregate(taskInfo)
+	case task.CALIBRATE:
+		err = memanalysis.ExecuteCalibrate(taskInfo)
 	case task.GENERATE:
 		var generateUserDataParam *task.GenerateUserDataParam
 		generateUserDataParam, err = taskInfo.GenerateUserDataParam()
@@ -159,6 +230,25 @@ func (agentServer *RedisAgentServer) startTask(taskInfo *task.GenericTaskInfo) {
 }
 
 func (agentServer *RedisAgentServer) checkParam(taskInfo task.GenericTaskInfo) error {
+	if taskInfo.TaskType == task.CLEAN {
+		cleanParam, err := taskInfo.CleanTaskParam()
+		if err != nil {
+			return err
+		}
+		if cleanParam.MaxOpsPerSec < 0 || cleanParam.MaxKeysPerSec < 0 {
+			return errors.New("maxOpsPerSec and maxKeysPerSec must not be negative")
+		}
+		if cleanParam.MaxInstanceOps < 0 || cleanParam.MaxLatency < 0 || cleanParam.MaxLazyfreePending < 0 {
+			return errors.New("maxInstanceOps, maxLatency and maxLazyfreePending must not be negative")
+		}
+		if err = cleaner.ValidateFilter(cleanParam); err != nil {
+			return err
+		}
+		if err = cleaner.CheckCheckpoint(taskInfo.TaskId, cleanParam); err != nil {
+			return err
+		}
+	}
+
 	if taskInfo.TaskType == task.GENERATE {
 		generateParam, err := taskInfo.GenerateUserDataParam()
 		if err != nil {
@@ -175,11 +265,86 @@ func (agentServer *RedisAgentServer) checkParam(taskInfo task.GenericTaskInfo) e
 	}
 
 	if taskInfo.TaskType == task.STATISTIC {
+		statisticParam, err := taskInfo.StatisticTaskParam()
+		if err != nil {
+			return err
+		}
+		if err = checkStatisticParam(statisticParam); err != nil {
+			return err
+		}
+
 		if task.HasProcessStatisticTask() {
 			// 有正在进行中的数据分析任务, 直接返回
 			return errors.New("there are already ongoing data analysis tasks in progress, refusing to submit new tasks")
 		}
 	}
+
+	if taskInfo.TaskType == task.AGGREGATE {
+		aggregateParam, err := taskInfo.AggregateTaskParam()
+		if err != nil {
+			return err
+		}
+		if aggregateParam.AgentPort <= 0 || aggregateParam.AgentPort > 65535 {
+			return errors.New("agentPort must be between 1 and 65535")
+		}
+		if aggregateParam.Timeout <= 0 {
+			return errors.New("timeout must be positive")
+		}
+		// 转发给分片的参数提前校验, 避免在部分分片上失败
+		statisticTask := task.GenericTaskInfo{TaskType: task.STATISTIC, TaskParam: taskInfo.StatisticParamOfAggregate()}
+		statisticParam, err := statisticTask.StatisticTaskParam()
+		if err != nil {
+			return err
+		}
+		if err = checkStatisticParam(statisticParam); err != nil {
+			return err
+		}
+	}
+
+	if taskInfo.TaskType == task.CALIBRATE {
+		calibrateParam, err := taskInfo.CalibrateTaskParam()
+		if err != nil {
+			return err
+		}
+		if calibrateParam.SampleSize <= 0 || calibrateParam.SampleSize > 100000 {
+			return errors.New("sampleSize must be between 1 and 100000")
+		}
+		if calibrateParam.IsScanMode() {
+			return errors.New("calibration compares rdb estimates, mode must be rdb")
+		}
+		if err = checkStatisticParam(&calibrateParam.StatisticTaskParam); err != nil {
+			return err
+		}
+		if task.HasProcessStatisticTask() {
+			return errors.New("there are already ongoing data analysis tasks in progress, refusing to submit new tasks")
+		}
+	}
+	return nil
+}
+
+// checkStatisticParam 校验内存统计任务的参数
+func checkStatisticParam(statisticParam *task.StatisticTaskParam) error {
+	if statisticParam.Mode != "" && statisticParam.Mode != task.StatisticModeRdb && !statisticParam.IsScanMode() {
+		return errors.New("mode must be rdb or scan")
+	}
+	if statisticParam.ScanCount < 0 || statisticParam.ScanInterval < 0 || statisticParam.MemoryUsageSamples < 0 {
+		return errors.New("scanCount, scanInterval and memoryUsageSamples must not be negative")
+	}
+	if statisticParam.Workers < 0 || statisticParam.Workers > 64 {
+		return errors.New("workers must be between 0 and 64")
+	}
+	if _, err := memanalysis.ParseAttributionRules(statisticParam.AttributionRules); err != nil {
+		return err
+	}
+	if statisticParam.TreeDepth < 0 || statisticParam.TreeDepth > 16 {
+		return errors.New("treeDepth must be between 0 and 16")
+	}
+	if statisticParam.TreeMaxChildren < 0 || statisticParam.TreeMaxChildren > 100000 {
+		return errors.New("treeMaxChildren must be between 0 and 100000")
+	}
+	if statisticParam.BigKeyTopN < 0 || statisticParam.BigKeyTopN > 1000 {
+		return errors.New("bigKeyTopN must be between 0 and 1000")
+	}
 	return nil
 }
 
@@ -218,6 +383,87 @@ func (agentServer *RedisAgentServer) analysisInfo(w http.ResponseWriter, _ *http
 	response(w, SucWithData(userAndOverhead))
 }
 
+// quotaViolations 获取超出配额的用户
+func (agentServer *RedisAgentServer) quotaViolations(w http.ResponseWriter, _ *http.Request) {
+	report := memanalysis.GetQuotaReport()
+	if report == nil {
+		response(w, FailWithMsg("no quota evaluation yet, please configure quotas and execute a statistic task first"))
+		return
+	}
+	response(w, SucWithData(report))
+}
+
+// calibration 获取内存开销估算与 MEMORY USAGE 的比较结果
+func (agentServer *RedisAgentServer) calibration(w http.ResponseWriter, _ *http.Request) {
+	report := memanalysis.GetCalibrationReport()
+	if report == nil {
+		response(w, FailWithMsg("no calibration result yet, please execute a calibrate task first"))
+		return
+	}
+	response(w, SucWithData(report))
+}
+
+// clusterAnalysisInfo 获取集群级别的内存分析结果
+func (agentServer *RedisAgentServer) clusterAnalysisInfo(w http.ResponseWriter, _ *http.Request) {
+	analysis := memanalysis.GetClusterAnalysis()
+	if analysis == nil {
+		response(w, FailWithMsg("no cluster analysis result yet, please execute an aggregate task first"))
+		return
+	}
+	response(w, SucWithData(analysis))
+}
+
+// analysisTree 获取前缀及其下一层前缀的key数量和内存开销
+func (agentServer *RedisAgentServer) analysisTree(w http.ResponseWriter, req *http.Request) {
+	prefixOverhead, err := memanalysis.GetPrefixOverhead(req.URL.Query().Get("prefix"))
+	if err != nil {
+		response(w, FailWithMsg(err.Error()))
+		return
+	}
+	response(w, SucWithData(prefixOverhead))
+}
+
+// bigKeys 获取按照内存开销和元素数量排序的大key
+func (agentServer *RedisAgentServer) bigKeys(w http.ResponseWriter, req *http.Request) {
+	rank, err := memanalysis.GetBigKeys(req.URL.Query().Get("userName"))
+	if err != nil {
+		response(w, FailWithMsg(err.Error()))
+		return
+	}
+	response(w, SucWithData(rank))
+}
+
+// listSnapshots 获取历史快照列表
+func (agentServer *RedisAgentServer) listSnapshots(w http.ResponseWriter, _ *http.Request) {
+	summaries, err := memanalysis.ListSnapshots()
+	if err != nil {
+		response(w, FailWithMsg(err.Error()))
+		return
+	}
+	response(w, SucWithData(summaries))
+}
+
+// getSnapshot 获取指定的历史快照
+func (agentServer *RedisAgentServer) getSnapshot(w http.ResponseWriter, req *http.Request) {
+	snapshot, err := memanalysis.GetSnapshot(mux.Vars(req)["snapshotId"])
+	if err != nil {
+		response(w, FailWithMsg(err.Error()))
+		return
+	}
+	response(w, SucWithData(snapshot))
+}
+
+// snapshotTrend 获取两个快照之间每个用户的变化
+func (agentServer *RedisAgentServer) snapshotTrend(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	trend, err := memanalysis.GetTrend(query.Get("from"), query.Get("to"))
+	if err != nil {
+		response(w, FailWithMsg(err.Error()))
+		return
+	}
+	response(w, SucWithData(trend))
+}
+
 func response(w http.ResponseWriter, v interface{}) {
 	data, err := json.Marshal(v)
 	if err != nil {
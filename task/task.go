@@ -20,11 +20,16 @@ const (
 	CLEAN     = iota // CLEAN 数据清理
 	STATISTIC        // STATISTIC 内存占用统计
 	GENERATE
+	AGGREGATE // AGGREGATE 在每个分片上执行内存占用统计并汇总为集群视图
+	CALIBRATE // CALIBRATE 使用 MEMORY USAGE 校准内存开销的估算
 )
 
 var locker sync.RWMutex
 var tasks = make(map[int]*GenericTaskInfo, 10)
 
+// resultLocker 保护任务执行过程中会被修改的字段(状态、日志、进度), 序列化任务信息时同样需要持有
+var resultLocker sync.Mutex
+
 type GenericTaskInfo struct {
 	// 任务id
 	TaskId int `json:"taskId"`
@@ -42,6 +47,8 @@ type GenericTaskInfo struct {
 	KeyCount int `json:"keyCount"`
 	// 任务日志
 	TaskLog []string `json:"taskLog"`
+	// 任务结果, 如清理任务dryRun时的预览结果
+	TaskResult interface{} `json:"taskResult,omitempty"`
 
 	// 任务参数对象，从TaskParam中反序列化得到
 	TaskParamObj interface{}
@@ -53,6 +60,185 @@ type CleanTaskParam struct {
 	Cursor uint64 `json:"cursor,string"`
 	// 用户名称
 	UserName string `json:"userName"`
+	// 只统计将要删除的key, 不执行unlink
+	DryRun bool `json:"dryRun,string"`
+	// 集群模式, 在每个主节点上并发清理, 此时忽略Cursor
+	Cluster bool `json:"cluster,string"`
+	// 从检查点恢复, 由恢复任务时设置。同一个任务id还有检查点时不能创建不是恢复的任务
+	Resume bool `json:"resume,string"`
+	// 每秒最多执行的命令数, 0表示不限制, 集群模式下是所有节点的总和
+	MaxOpsPerSec int `json:"maxOpsPerSec,string"`
+	// 每秒最多删除的key数, 0表示不限制, 集群模式下是所有节点的总和
+	MaxKeysPerSec int `json:"maxKeysPerSec,string"`
+	// 实例 instantaneous_ops_per_sec 的上限, 超过时退避, 0表示使用配置文件中的阈值
+	MaxInstanceOps int64 `json:"maxInstanceOps,string"`
+	// 实例往返延迟的上限, 单位是毫秒, 超过时退避, 0表示使用配置文件中的阈值
+	MaxLatency int `json:"maxLatency,string"`
+	// 实例 lazyfree_pending_objects 的上限, 超过时退避, 0表示使用配置文件中的阈值
+	MaxLazyfreePending int64 `json:"maxLazyfreePending,string"`
+
+	// 以下为过滤条件, 在匹配 userName:* 的基础上只删除满足所有条件的key
+	// 只删除这些类型的key, 多个类型以逗号分隔, 如 hash,string, 为空时不限制
+	Types string `json:"types"`
+	// 按照是否设置了过期时间过滤 volatile/persistent, 为空时不限制
+	ExpireMode string `json:"expireMode"`
+	// 只删除剩余过期时间小于该值的key, 单位是秒, 0表示不限制
+	MaxTTL int64 `json:"maxTtl,string"`
+	// 只删除空闲时间(OBJECT IDLETIME)大于该值的key, 单位是秒, 0表示不限制
+	MinIdleTime int64 `json:"minIdleTime,string"`
+	// 只删除元素数量大于该值的key, string类型为字节数, 0表示不限制
+	MinLength int64 `json:"minLength,string"`
+	// 只删除 MEMORY USAGE 大于该值的key, 单位是字节, 0表示不限制
+	MinMemoryUsage int64 `json:"minMemoryUsage,string"`
+	// 额外的glob模式, 多个模式以逗号分隔, key需要匹配其中之一
+	Patterns string `json:"patterns"`
+	// 额外的正则表达式, key需要匹配
+	Regex string `json:"regex"`
+}
+
+// 清理任务按照过期时间过滤的模式
+const (
+	// CleanExpireVolatile 只删除设置了过期时间的key
+	CleanExpireVolatile = "volatile"
+	// CleanExpirePersistent 只删除没有设置过期时间的key
+	CleanExpirePersistent = "persistent"
+)
+
+// 内存统计任务的模式
+const (
+	// StatisticModeRdb 解析rdb文件, 默认的模式
+	StatisticModeRdb = "rdb"
+	// StatisticModeScan 通过SCAN和MEMORY USAGE在线扫描keyspace, 可以在主节点上执行
+	StatisticModeScan = "scan"
+)
+
+// StatisticTaskParam 内存统计任务独有参数
+type StatisticTaskParam struct {
+	// 统计模式 rdb/scan, 默认为rdb
+	Mode string `json:"mode"`
+	// scan模式下每次SCAN的COUNT, 默认为1000
+	ScanCount int64 `json:"scanCount,string"`
+	// scan模式下两批之间的间隔, 单位是毫秒
+	ScanInterval int `json:"scanInterval,string"`
+	// scan模式下MEMORY USAGE的SAMPLES, 默认为5
+	MemoryUsageSamples int `json:"memoryUsageSamples,string"`
+	// 解析rdb文件的worker数量, 不传或者为1时顺序解析
+	Workers int `json:"workers,string"`
+	// 是否按照key在rdb文件中的顺序统计, 只在 Workers 大于1时有意义
+	Ordered bool `json:"ordered,string"`
+	// 直接分析指定路径的rdb文件(如归档的备份), 不执行bgsave。只能指向agent配置 statistic.rdb_dirs 中的目录下的文件
+	RdbPath string `json:"rdbPath"`
+	// 不执行bgsave, 直接分析 CONFIG GET dir/dbfilename 指向的rdb文件。RdbPath不为空时总是跳过bgsave
+	SkipBgsave bool `json:"skipBgsave,string"`
+	// key到用户的归属规则, json数组格式, 为空时按照第一个冒号之前的部分作为用户
+	AttributionRules string `json:"attributionRules"`
+	// 前缀树的分隔符, 默认为 :
+	TreeDelimiter string `json:"treeDelimiter"`
+	// 前缀树统计的层数, 默认为4
+	TreeDepth int `json:"treeDepth,string"`
+	// 前缀树每个前缀下最多统计的下一层前缀数量, 超出的合并到 <other> 中, 默认为1000
+	TreeMaxChildren int `json:"treeMaxChildren,string"`
+	// 全局和每个用户保留的大key数量, 默认为20
+	BigKeyTopN int `json:"bigKeyTopN,string"`
+}
+
+// IsScanMode 是否在线扫描keyspace
+func (param *StatisticTaskParam) IsScanMode() bool {
+	return param.Mode == StatisticModeScan
+}
+
+// UseExistingRdb 是否分析已经存在的rdb文件而不执行bgsave
+func (param *StatisticTaskParam) UseExistingRdb() bool {
+	return param.RdbPath != "" || param.SkipBgsave
+}
+
+// AggregateTaskParam 集群汇总任务独有参数, 其余参数原样转发给每个分片的内存统计任务
+type AggregateTaskParam struct {
+	// 逗号分隔的其他agent的地址, 如 10.0.0.1:6389,10.0.0.2:6389。为空时通过 CLUSTER NODES 发现每个分片的从节点
+	Peers string `json:"peers"`
+	// 通过 CLUSTER NODES 发现agent时agent监听的端口, 默认为6389
+	AgentPort int `json:"agentPort,string"`
+	// 等待所有分片完成的超时时间, 单位是分钟, 默认为120
+	Timeout int `json:"timeout,string"`
+}
+
+// 只属于集群汇总任务的参数, 不转发给分片
+var aggregateParamNames = map[string]bool{"peers": true, "agentPort": true, "timeout": true}
+
+// AggregateTaskParam 从map中得到AggregateTaskParam参数
+func (taskInfo *GenericTaskInfo) AggregateTaskParam() (*AggregateTaskParam, error) {
+	if taskInfo.TaskType != AGGREGATE {
+		return nil, errors.New(fmt.Sprintf("Task type error: %d, you can't call this method AggregateTaskParam", taskInfo.TaskType))
+	}
+
+	if taskInfo.TaskParamObj != nil {
+		obj := taskInfo.TaskParamObj
+		if v, ok := obj.(*AggregateTaskParam); ok {
+			return v, nil
+		}
+	}
+
+	taskParam := AggregateTaskParam{AgentPort: 6389, Timeout: 120}
+	if len(taskInfo.TaskParam) != 0 {
+		paramJson, err := json.Marshal(taskInfo.TaskParam)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(paramJson, &taskParam)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	taskInfo.TaskParamObj = &taskParam
+	return &taskParam, nil
+}
+
+// StatisticParamOfAggregate 转发给分片的内存统计任务参数
+func (taskInfo *GenericTaskInfo) StatisticParamOfAggregate() map[string]string {
+	statisticParam := make(map[string]string, len(taskInfo.TaskParam))
+	for name, value := range taskInfo.TaskParam {
+		if !aggregateParamNames[name] {
+			statisticParam[name] = value
+		}
+	}
+	return statisticParam
+}
+
+// CalibrateTaskParam 校准任务独有参数, 解析rdb文件的参数与内存统计任务一致
+type CalibrateTaskParam struct {
+	StatisticTaskParam
+	// 抽样的key数量, 默认为1000
+	SampleSize int `json:"sampleSize,string"`
+}
+
+// CalibrateTaskParam 从map中得到CalibrateTaskParam参数
+func (taskInfo *GenericTaskInfo) CalibrateTaskParam() (*CalibrateTaskParam, error) {
+	if taskInfo.TaskType != CALIBRATE {
+		return nil, errors.New(fmt.Sprintf("Task type error: %d, you can't call this method CalibrateTaskParam", taskInfo.TaskType))
+	}
+
+	if taskInfo.TaskParamObj != nil {
+		obj := taskInfo.TaskParamObj
+		if v, ok := obj.(*CalibrateTaskParam); ok {
+			return v, nil
+		}
+	}
+
+	taskParam := CalibrateTaskParam{StatisticTaskParam: StatisticTaskParam{Workers: 1}, SampleSize: 1000}
+	if len(taskInfo.TaskParam) != 0 {
+		paramJson, err := json.Marshal(taskInfo.TaskParam)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(paramJson, &taskParam)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	taskInfo.TaskParamObj = &taskParam
+	return &taskParam, nil
 }
 
 // CleanTaskParam 从map中得到CleanTaskParam参数
@@ -102,9 +288,38 @@ func (taskInfo *GenericTaskInfo) GenerateUserDataParam() (*GenerateUserDataParam
 	return &taskParam, nil
 }
 
+// StatisticTaskParam 从map中得到StatisticTaskParam参数
+func (taskInfo *GenericTaskInfo) StatisticTaskParam() (*StatisticTaskParam, error) {
+	if taskInfo.TaskType != STATISTIC {
+		return nil, errors.New(fmt.Sprintf("Task type error: %d, you can't call this method StatisticTaskParam", taskInfo.TaskType))
+	}
+
+	if taskInfo.TaskParamObj != nil {
+		obj := taskInfo.TaskParamObj
+		if v, ok := obj.(*StatisticTaskParam); ok {
+			return v, nil
+		}
+	}
+
+	taskParam := StatisticTaskParam{Workers: 1}
+	if len(taskInfo.TaskParam) != 0 {
+		paramJson, err := json.Marshal(taskInfo.TaskParam)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(paramJson, &taskParam)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	taskInfo.TaskParamObj = &taskParam
+	return &taskParam, nil
+}
+
 func (taskInfo *GenericTaskInfo) CheckTaskType() error {
-	if taskInfo.TaskType != CLEAN && taskInfo.TaskType != STATISTIC && taskInfo.TaskType != GENERATE {
-		return errors.New("task Type must be 0/1/2")
+	if taskInfo.TaskType < CLEAN || taskInfo.TaskType > CALIBRATE {
+		return errors.New("task Type must be 0/1/2/3/4")
 	}
 	return nil
 }
@@ -129,6 +344,20 @@ func (taskInfo *GenericTaskInfo) CreateTask() error {
 	return nil
 }
 
+// RecreateTask 重新创建已经结束的任务, 用于从检查点恢复任务
+func (taskInfo *GenericTaskInfo) RecreateTask() error {
+	locker.Lock()
+	if existing, ok := tasks[taskInfo.TaskId]; ok {
+		if existing.Status == PROGRESS {
+			locker.Unlock()
+			return errors.New(fmt.Sprintf("%d task is still in progress, can't recreate!", taskInfo.TaskId))
+		}
+		delete(tasks, taskInfo.TaskId)
+	}
+	locker.Unlock()
+	return taskInfo.CreateTask()
+}
+
 func FormatLog(log string) string {
 	timeStr := time.Now().Format("2006-01-02 15:04:05")
 	return fmt.Sprintf("[%s] %s", timeStr, log)
@@ -139,8 +368,26 @@ func Report(taskId int) *GenericTaskInfo {
 	return tasks[taskId]
 }
 
+// UpdateResult 持有resultLocker修改任务的进度, 如 TaskResult 和 LastScanTime
+// 执行中的任务可能正在被查询, 修改进度必须通过该方法
+func (taskInfo *GenericTaskInfo) UpdateResult(update func()) {
+	resultLocker.Lock()
+	defer resultLocker.Unlock()
+	update()
+}
+
+// MarshalJSON 持有resultLocker序列化, 避免读到执行中的任务正在修改的进度
+func (taskInfo *GenericTaskInfo) MarshalJSON() ([]byte, error) {
+	resultLocker.Lock()
+	defer resultLocker.Unlock()
+	type plainTaskInfo GenericTaskInfo
+	return json.Marshal((*plainTaskInfo)(taskInfo))
+}
+
 // AppendFailLog 追加失败日志
 func (taskInfo *GenericTaskInfo) AppendFailLog(log string) {
+	resultLocker.Lock()
+	defer resultLocker.Unlock()
 	// 更新任务状态为失败
 	taskInfo.Status = FAIL
 	// 追加日志
@@ -149,6 +396,8 @@ func (taskInfo *GenericTaskInfo) AppendFailLog(log string) {
 
 // AppendSucLog 追加成功日志
 func (taskInfo *GenericTaskInfo) AppendSucLog(log string) {
+	resultLocker.Lock()
+	defer resultLocker.Unlock()
 	// 更新任务状态为失败
 	taskInfo.Status = SUC
 	// 追加日志
@@ -182,7 +431,8 @@ func HasProcessStatisticTask() bool {
 	locker.Lock()
 	defer locker.Unlock()
 	for _, taskInfo := range tasks {
-		if taskInfo.TaskType == STATISTIC && taskInfo.Status == PROGRESS {
+		// 校准任务同样需要解析rdb文件
+		if (taskInfo.TaskType == STATISTIC || taskInfo.TaskType == CALIBRATE) && taskInfo.Status == PROGRESS {
 			return true
 		}
 	}